@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are the config files discovered in the working directory
+var configFileNames = []string{"dbmate.yaml", "dbmate.yml"}
+
+// configOptions are the global options which can be set in a config file.
+// Config keys are the long names of these options.
+var configOptions = []string{
+	"url",
+	"migrations-dir",
+	"migrations-table",
+	"schema-file",
+	"no-dump-schema",
+	"native-dump",
+	"wait",
+	"wait-timeout",
+	"lock-timeout",
+	"template-var",
+}
+
+// configPathOptions are the options whose relative paths are resolved against
+// the directory of the config file
+var configPathOptions = []string{"migrations-dir", "schema-file"}
+
+// config is the contents of a config file. Top level options apply to every
+// environment, and options of the selected environment override them.
+type config struct {
+	options      map[string]interface{}
+	environments map[string]map[string]interface{}
+}
+
+// UnmarshalYAML separates the environments from the top level options
+func (cfg *config) UnmarshalYAML(value *yaml.Node) error {
+	var raw struct {
+		Environments map[string]map[string]interface{} `yaml:"environments"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	if err := value.Decode(&cfg.options); err != nil {
+		return err
+	}
+
+	delete(cfg.options, "environments")
+	cfg.environments = raw.Environments
+
+	return nil
+}
+
+// findConfigFile returns the config file specified by --config, or the first
+// config file found in the working directory, or an empty string
+func findConfigFile(c *cli.Context) (string, error) {
+	if path := c.String("config"); path != "" {
+		return path, nil
+	}
+
+	for _, name := range configFileNames {
+		_, err := os.Stat(name)
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// applyConfig sets options from the config file which were not set by a flag or
+// environment variable, so that flags take precedence over environment
+// variables, which take precedence over the config file
+func applyConfig(c *cli.Context) error {
+	path, err := findConfigFile(c)
+	if err != nil {
+		return err
+	}
+
+	environment := c.String("environment")
+	if path == "" {
+		if environment != "" {
+			return fmt.Errorf("can't select environment %q: no config file found", environment)
+		}
+		return nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cfg config
+	if err := yaml.Unmarshal(contents, &cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	options := cfg.options
+	if environment != "" {
+		envOptions, ok := cfg.environments[environment]
+		if !ok {
+			return fmt.Errorf("%s: environment %q not found (available: %s)",
+				path, environment, strings.Join(sortedKeys(cfg.environments), ", "))
+		}
+
+		options = map[string]interface{}{}
+		for key, value := range cfg.options {
+			options[key] = value
+		}
+		for key, value := range envOptions {
+			options[key] = value
+		}
+	}
+
+	for _, key := range sortedKeys(options) {
+		if !isConfigOption(key) {
+			return fmt.Errorf("%s: unknown option %q", path, key)
+		}
+		if c.IsSet(key) {
+			continue
+		}
+		// the database url may also come from the environment variable named by --env
+		if key == "url" && os.Getenv(c.String("env")) != "" {
+			continue
+		}
+
+		values, err := configValues(key, options[key])
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if isConfigPathOption(key) {
+			for i, value := range values {
+				if !filepath.IsAbs(value) {
+					values[i] = filepath.Join(filepath.Dir(path), value)
+				}
+			}
+		}
+		for _, value := range values {
+			if err := c.Set(key, value); err != nil {
+				return fmt.Errorf("%s: invalid value for %s: %w", path, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configValues converts a config value to flag values. Lists set the option
+// once per item, and template variables may also be given as a map.
+func configValues(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = fmt.Sprint(item)
+		}
+		return values, nil
+	case map[string]interface{}:
+		if key != "template-var" {
+			return nil, fmt.Errorf("%s must not be a map", key)
+		}
+		values := []string{}
+		for _, name := range sortedKeys(v) {
+			values = append(values, fmt.Sprintf("%s=%v", name, v[name]))
+		}
+		return values, nil
+	case nil:
+		return nil, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
+
+func isConfigOption(key string) bool {
+	for _, option := range configOptions {
+		if option == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isConfigPathOption(key string) bool {
+	for _, option := range configPathOptions {
+		if option == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+const testConfig = `
+migrations-table: migrations
+template-var:
+  role: app
+environments:
+  development:
+    url: sqlite:db/development.sqlite3
+  production:
+    url: postgres://prod.example.org/app
+    migrations-dir:
+      - db/migrations
+      - db/production
+    schema-file: db/production.sql
+    lock-timeout: 30s
+    native-dump: true
+`
+
+// newTestContext returns a context with the global flags, and the given args
+func newTestContext(t *testing.T, args ...string) *cli.Context {
+	app := NewApp()
+	flagset := flag.NewFlagSet(app.Name, flag.ContinueOnError)
+	for _, f := range app.Flags {
+		require.NoError(t, f.Apply(flagset))
+	}
+	require.NoError(t, flagset.Parse(args))
+
+	return cli.NewContext(app, flagset, nil)
+}
+
+func writeTestConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "dbmate.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+
+	return path
+}
+
+func TestApplyConfig(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	path := writeTestConfig(t, testConfig)
+
+	t.Run("environment", func(t *testing.T) {
+		c := newTestContext(t, "--config", path, "--environment", "production")
+		require.NoError(t, applyConfig(c))
+
+		require.Equal(t, "postgres://prod.example.org/app", c.String("url"))
+		// paths are relative to the config file
+		dir := filepath.Dir(path)
+		require.Equal(t, []string{filepath.Join(dir, "db/migrations"), filepath.Join(dir, "db/production")},
+			c.StringSlice("migrations-dir"))
+		require.Equal(t, "migrations", c.String("migrations-table"))
+		require.Equal(t, filepath.Join(dir, "db/production.sql"), c.String("schema-file"))
+		require.Equal(t, 30*time.Second, c.Duration("lock-timeout"))
+		require.True(t, c.Bool("native-dump"))
+		require.Equal(t, []string{"role=app"}, c.StringSlice("template-var"))
+	})
+
+	t.Run("top level options only", func(t *testing.T) {
+		c := newTestContext(t, "--config", path)
+		require.NoError(t, applyConfig(c))
+
+		require.Equal(t, "", c.String("url"))
+		require.Equal(t, "migrations", c.String("migrations-table"))
+		require.Equal(t, []string{"./db/migrations"}, c.StringSlice("migrations-dir"))
+	})
+
+	t.Run("flags take precedence", func(t *testing.T) {
+		c := newTestContext(t, "--config", path, "--environment", "production",
+			"--url", "postgres://flag.example.org/app", "--schema-file", "flag.sql")
+		require.NoError(t, applyConfig(c))
+
+		require.Equal(t, "postgres://flag.example.org/app", c.String("url"))
+		require.Equal(t, "flag.sql", c.String("schema-file"))
+		require.Equal(t, "migrations", c.String("migrations-table"))
+	})
+
+	t.Run("environment variables take precedence", func(t *testing.T) {
+		t.Setenv("DATABASE_URL", "postgres://env.example.org/app")
+		t.Setenv("DBMATE_SCHEMA_FILE", "env.sql")
+		c := newTestContext(t, "--config", path, "--environment", "production")
+		require.NoError(t, applyConfig(c))
+
+		u, err := getDatabaseURL(c)
+		require.NoError(t, err)
+		require.Equal(t, "postgres://env.example.org/app", u.String())
+		require.Equal(t, "env.sql", c.String("schema-file"))
+	})
+
+	t.Run("absolute paths", func(t *testing.T) {
+		c := newTestContext(t, "--config", writeTestConfig(t, "schema-file: /var/lib/app/schema.sql\n"))
+		require.NoError(t, applyConfig(c))
+
+		require.Equal(t, "/var/lib/app/schema.sql", c.String("schema-file"))
+	})
+
+	t.Run("unknown environment", func(t *testing.T) {
+		c := newTestContext(t, "--config", path, "--environment", "staging")
+		require.EqualError(t, applyConfig(c),
+			path+`: environment "staging" not found (available: development, production)`)
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		c := newTestContext(t, "--config", writeTestConfig(t, "migrations-directory: db\n"))
+		require.ErrorContains(t, applyConfig(c), `unknown option "migrations-directory"`)
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		c := newTestContext(t, "--config", writeTestConfig(t, "lock-timeout: soon\n"))
+		require.ErrorContains(t, applyConfig(c), "invalid value for lock-timeout")
+	})
+}
+
+func TestApplyConfigDiscovery(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.Chdir(wd))
+	}()
+	require.NoError(t, os.Chdir(t.TempDir()))
+
+	// no config file
+	c := newTestContext(t)
+	require.NoError(t, applyConfig(c))
+	c = newTestContext(t, "--environment", "production")
+	require.EqualError(t, applyConfig(c), `can't select environment "production": no config file found`)
+
+	// dbmate.yml is discovered in the working directory
+	require.NoError(t, os.WriteFile("dbmate.yml", []byte(testConfig), 0o644))
+	c = newTestContext(t, "--environment", "development")
+	require.NoError(t, applyConfig(c))
+	require.Equal(t, "sqlite:db/development.sqlite3", c.String("url"))
+}
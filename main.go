@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
+	"strings"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli/v2"
@@ -14,6 +19,7 @@ import (
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/clickhouse"
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/mysql"
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/postgres"
+	_ "github.com/amacneil/dbmate/v2/pkg/driver/sqlite"
 )
 
 func main() {
@@ -23,8 +29,12 @@ func main() {
 		os.Exit(3)
 	}
 
+	// cancel running statements on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	app := NewApp()
-	err = app.Run(os.Args)
+	err = app.RunContext(ctx, os.Args)
 
 	if err != nil {
 		errText := redactLogString(fmt.Sprintf("Error: %s\n", err))
@@ -59,6 +69,16 @@ func NewApp() *cli.App {
 			Value: cli.NewStringSlice(".env"),
 			Usage: "specify a file to load environment variables from",
 		},
+		&cli.StringFlag{
+			Name:    "config",
+			EnvVars: []string{"DBMATE_CONFIG"},
+			Usage:   "specify a config file (default: dbmate.yaml or dbmate.yml, if present)",
+		},
+		&cli.StringFlag{
+			Name:    "environment",
+			EnvVars: []string{"DBMATE_ENVIRONMENT"},
+			Usage:   "select a named environment from the config file",
+		},
 		&cli.StringSliceFlag{
 			Name:    "migrations-dir",
 			Aliases: []string{"d"},
@@ -84,6 +104,11 @@ func NewApp() *cli.App {
 			EnvVars: []string{"DBMATE_NO_DUMP_SCHEMA"},
 			Usage:   "don't update the schema file on migrate/rollback",
 		},
+		&cli.BoolFlag{
+			Name:    "native-dump",
+			EnvVars: []string{"DBMATE_NATIVE_DUMP"},
+			Usage:   "build the schema file by querying the database instead of using pg_dump or mysqldump",
+		},
 		&cli.BoolFlag{
 			Name:    "wait",
 			EnvVars: []string{"DBMATE_WAIT"},
@@ -95,6 +120,16 @@ func NewApp() *cli.App {
 			Usage:   "timeout for --wait flag",
 			Value:   defaultDB.WaitTimeout,
 		},
+		&cli.DurationFlag{
+			Name:    "lock-timeout",
+			EnvVars: []string{"DBMATE_LOCK_TIMEOUT"},
+			Usage:   "maximum time to wait for the migration lock (0 waits indefinitely)",
+			Value:   defaultDB.LockTimeout,
+		},
+		&cli.StringSliceFlag{
+			Name:  "template-var",
+			Usage: "set a variable for migrations with the template:true option, e.g. tablespace=fast",
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -116,31 +151,42 @@ func NewApp() *cli.App {
 					EnvVars: []string{"DBMATE_STRICT"},
 					Usage:   "fail if migrations would be applied out of order",
 				},
+				&cli.BoolFlag{
+					Name:    "strict-checksums",
+					EnvVars: []string{"DBMATE_STRICT_CHECKSUMS"},
+					Usage:   "fail if applied migration files have been modified",
+				},
 				&cli.BoolFlag{
 					Name:    "verbose",
 					Aliases: []string{"v"},
 					EnvVars: []string{"DBMATE_VERBOSE"},
 					Usage:   "print the result of each statement execution",
 				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
 			},
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
 				db.Strict = c.Bool("strict")
+				db.StrictChecksums = c.Bool("strict-checksums")
 				db.Verbose = c.Bool("verbose")
-				return db.CreateAndMigrate()
+				db.DryRun = c.Bool("dry-run")
+				return db.CreateAndMigrateContext(c.Context)
 			}),
 		},
 		{
 			Name:  "create",
 			Usage: "Create database",
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Create()
+				return db.CreateContext(c.Context)
 			}),
 		},
 		{
 			Name:  "drop",
 			Usage: "Drop database (if it exists)",
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Drop()
+				return db.DropContext(c.Context)
 			}),
 		},
 		{
@@ -152,17 +198,35 @@ func NewApp() *cli.App {
 					EnvVars: []string{"DBMATE_STRICT"},
 					Usage:   "fail if migrations would be applied out of order",
 				},
+				&cli.BoolFlag{
+					Name:    "strict-checksums",
+					EnvVars: []string{"DBMATE_STRICT_CHECKSUMS"},
+					Usage:   "fail if applied migration files have been modified",
+				},
 				&cli.BoolFlag{
 					Name:    "verbose",
 					Aliases: []string{"v"},
 					EnvVars: []string{"DBMATE_VERBOSE"},
 					Usage:   "print the result of each statement execution",
 				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "migrate up to and including the specified version",
+				},
 			},
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
 				db.Strict = c.Bool("strict")
+				db.StrictChecksums = c.Bool("strict-checksums")
 				db.Verbose = c.Bool("verbose")
-				return db.Migrate()
+				db.DryRun = c.Bool("dry-run")
+				if version := c.String("to"); version != "" {
+					return db.MigrateToContext(c.Context, version)
+				}
+				return db.MigrateContext(c.Context)
 			}),
 		},
 		{
@@ -176,10 +240,144 @@ func NewApp() *cli.App {
 					EnvVars: []string{"DBMATE_VERBOSE"},
 					Usage:   "print the result of each statement execution",
 				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
+				&cli.IntFlag{
+					Name:  "steps",
+					Value: 1,
+					Usage: "number of migrations to roll back",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "roll back all migrations applied after the specified version",
+				},
 			},
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
 				db.Verbose = c.Bool("verbose")
-				return db.Rollback()
+				db.DryRun = c.Bool("dry-run")
+				if c.IsSet("to") && c.IsSet("steps") {
+					return fmt.Errorf("--to and --steps can't be used together")
+				}
+				if version := c.String("to"); version != "" {
+					return db.RollbackToContext(c.Context, version)
+				}
+				return db.RollbackStepsContext(c.Context, c.Int("steps"))
+			}),
+		},
+		{
+			Name:  "redo",
+			Usage: "Rollback and apply again the most recent migration",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "verbose",
+					Aliases: []string{"v"},
+					EnvVars: []string{"DBMATE_VERBOSE"},
+					Usage:   "print the result of each statement execution",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
+				&cli.IntFlag{
+					Name:  "steps",
+					Value: 1,
+					Usage: "number of migrations to roll back and apply again",
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				db.Verbose = c.Bool("verbose")
+				db.DryRun = c.Bool("dry-run")
+				return db.RedoStepsContext(c.Context, c.Int("steps"))
+			}),
+		},
+		{
+			Name:  "verify-rollbacks",
+			Usage: "Apply, rollback and apply again each pending migration, checking the schema is restored",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "verbose",
+					Aliases: []string{"v"},
+					EnvVars: []string{"DBMATE_VERBOSE"},
+					Usage:   "print the result of each statement execution",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list the migrations that would be verified, without changing the database",
+				},
+				&cli.BoolFlag{
+					Name:  "allow-applied",
+					Usage: "verify pending migrations even if the database already has migrations applied",
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				db.Verbose = c.Bool("verbose")
+				db.DryRun = c.Bool("dry-run")
+				return db.VerifyRollbacksContext(c.Context, c.Bool("allow-applied"))
+			}),
+		},
+		{
+			Name:      "baseline",
+			Usage:     "Record migrations up to a version as applied, without running them",
+			ArgsUsage: "<version>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "load-schema",
+					Usage: "load the schema file before recording migrations",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				db.DryRun = c.Bool("dry-run")
+				return db.BaselineContext(c.Context, c.Args().First(), c.Bool("load-schema"))
+			}),
+		},
+		{
+			Name:  "squash",
+			Usage: "Replace old migrations with a single migration generated from the database schema",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "before",
+					Usage:    "squash migrations before this version",
+					Required: true,
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				return db.SquashContext(c.Context, c.String("before"))
+			}),
+		},
+		{
+			Name:      "mark-applied",
+			Usage:     "Record a migration as applied, without running it",
+			ArgsUsage: "<version>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				db.DryRun = c.Bool("dry-run")
+				return db.MarkAppliedContext(c.Context, c.Args().First())
+			}),
+		},
+		{
+			Name:      "mark-pending",
+			Usage:     "Remove the record of an applied migration, without rolling it back",
+			ArgsUsage: "<version>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the SQL that would be executed, without executing it",
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				db.DryRun = c.Bool("dry-run")
+				return db.MarkPendingContext(c.Context, c.Args().First())
 			}),
 		},
 		{
@@ -194,16 +392,36 @@ func NewApp() *cli.App {
 					Name:  "quiet",
 					Usage: "don't output any text (implies --exit-code)",
 				},
+				&cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format (text or json)",
+				},
+				&cli.BoolFlag{
+					Name:    "strict-checksums",
+					EnvVars: []string{"DBMATE_STRICT_CHECKSUMS"},
+					Usage:   "fail if applied migration files have been modified",
+				},
 			},
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
 				db.Strict = c.Bool("strict")
+				db.StrictChecksums = c.Bool("strict-checksums")
 				setExitCode := c.Bool("exit-code")
 				quiet := c.Bool("quiet")
 				if quiet {
 					setExitCode = true
 				}
 
-				pending, err := db.Status(quiet)
+				var pending int
+				var err error
+				switch format := c.String("format"); format {
+				case "text":
+					pending, err = db.StatusContext(c.Context, quiet)
+				case "json":
+					pending, err = statusJSON(c.Context, db, quiet)
+				default:
+					err = fmt.Errorf("unsupported status format: %s", format)
+				}
 				if err != nil {
 					return err
 				}
@@ -215,25 +433,62 @@ func NewApp() *cli.App {
 				return nil
 			}),
 		},
+		{
+			Name:  "repair",
+			Usage: "Update recorded checksums to match modified migration files",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "list the migrations that would be repaired, without changing the database",
+				},
+			},
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				db.DryRun = c.Bool("dry-run")
+				return db.RepairContext(c.Context)
+			}),
+		},
 		{
 			Name:  "dump",
 			Usage: "Write the database schema to disk",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "check",
+					Usage: "don't write the schema file, fail if it is out of date",
+				},
+			},
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.DumpSchema()
+				if c.Bool("check") {
+					return db.CheckSchemaContext(c.Context)
+				}
+				return db.DumpSchemaContext(c.Context)
+			}),
+		},
+		{
+			Name:  "drift",
+			Usage: "Compare the database schema to the schema file, return 1 if they differ",
+			Action: action(func(db *dbmate.DB, c *cli.Context) error {
+				changes, err := db.DriftContext(c.Context)
+				if err != nil {
+					return err
+				}
+				if len(changes) > 0 {
+					return cli.Exit("", 1)
+				}
+				return nil
 			}),
 		},
 		{
 			Name:  "load",
 			Usage: "Load schema file to the database",
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.LoadSchema()
+				return db.LoadSchemaContext(c.Context)
 			}),
 		},
 		{
 			Name:  "wait",
 			Usage: "Wait for the database to become available",
 			Action: action(func(db *dbmate.DB, c *cli.Context) error {
-				return db.Wait()
+				return db.WaitContext(c.Context)
 			}),
 		},
 	}
@@ -286,15 +541,25 @@ func loadEnvFiles(args []string) error {
 // action wraps a cli.ActionFunc with dbmate initialization logic
 func action(f func(*dbmate.DB, *cli.Context) error) cli.ActionFunc {
 	return func(c *cli.Context) error {
+		if err := applyConfig(c); err != nil {
+			return err
+		}
+
 		u, err := getDatabaseURL(c)
 		if err != nil {
 			return err
 		}
 		db := dbmate.New(u)
 		db.AutoDumpSchema = !c.Bool("no-dump-schema")
+		db.NativeDump = c.Bool("native-dump")
 		db.MigrationsDir = c.StringSlice("migrations-dir")
 		db.MigrationsTableName = c.String("migrations-table")
 		db.SchemaFile = c.String("schema-file")
+		db.LockTimeout = c.Duration("lock-timeout")
+		db.TemplateVars, err = parseTemplateVars(c.StringSlice("template-var"))
+		if err != nil {
+			return err
+		}
 		db.WaitBefore = c.Bool("wait")
 		waitTimeout := c.Duration("wait-timeout")
 		if waitTimeout != 0 {
@@ -305,6 +570,42 @@ func action(f func(*dbmate.DB, *cli.Context) error) cli.ActionFunc {
 	}
 }
 
+// parseTemplateVars parses NAME=value pairs into template variables
+func parseTemplateVars(values []string) (map[string]string, error) {
+	vars := map[string]string{}
+	for _, value := range values {
+		name, v, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid template variable, expected NAME=value: %s", value)
+		}
+		vars[name] = v
+	}
+
+	return vars, nil
+}
+
+// statusJSON writes the status of all migrations to stdout as json
+func statusJSON(ctx context.Context, db *dbmate.DB, quiet bool) (int, error) {
+	report, err := db.StatusReportContext(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	if !quiet {
+		enc := json.NewEncoder(db.Log)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return -1, err
+		}
+	}
+
+	if report.Modified > 0 && db.StrictChecksums {
+		return report.Pending, dbmate.ErrMigrationModified
+	}
+
+	return report.Pending, nil
+}
+
 // getDatabaseURL returns the current database url from cli flag or environment variable
 func getDatabaseURL(c *cli.Context) (u *url.URL, err error) {
 	// check --url flag first
@@ -1,8 +0,0 @@
-//go:build cgo
-// +build cgo
-
-package main
-
-import (
-	_ "github.com/amacneil/dbmate/v2/pkg/driver/sqlite"
-)
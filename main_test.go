@@ -40,6 +40,22 @@ func TestGetDatabaseUrl(t *testing.T) {
 	require.Equal(t, "foo://example.org/three", u.String())
 }
 
+func TestParseTemplateVars(t *testing.T) {
+	vars, err := parseTemplateVars([]string{"tablespace=fast", "cluster=a=b", "empty="})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"tablespace": "fast", "cluster": "a=b", "empty": ""}, vars)
+
+	_, err = parseTemplateVars([]string{"tablespace"})
+	require.EqualError(t, err, "invalid template variable, expected NAME=value: tablespace")
+}
+
+func TestRollbackToAndSteps(t *testing.T) {
+	app := NewApp()
+	err := app.Run([]string{"dbmate", "--url", "sqlite:" + t.TempDir() + "/test.sqlite3",
+		"rollback", "--to", "20151129054053", "--steps", "2"})
+	require.EqualError(t, err, "--to and --steps can't be used together")
+}
+
 func TestRedactLogString(t *testing.T) {
 	examples := []struct {
 		in       string
@@ -1,6 +1,7 @@
 package dbmate
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -11,9 +12,12 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
+
+	"github.com/pmezard/go-difflib/difflib"
 )
 
 // Error codes
@@ -21,36 +25,81 @@ var (
 	ErrNoMigrationFiles      = errors.New("no migration files found")
 	ErrInvalidURL            = errors.New("invalid url, have you set your --url flag or DATABASE_URL environment variable?")
 	ErrNoRollback            = errors.New("can't rollback: no migrations have been applied")
+	ErrInvalidSteps          = errors.New("number of steps must be greater than zero")
 	ErrCantConnect           = errors.New("unable to connect to database")
 	ErrUnsupportedDriver     = errors.New("unsupported driver")
 	ErrNoMigrationName       = errors.New("please specify a name for the new migration")
+	ErrNoMigrationVersion    = errors.New("please specify a migration version")
 	ErrMigrationAlreadyExist = errors.New("file already exists")
 	ErrMigrationDirNotFound  = errors.New("could not find migrations directory")
 	ErrMigrationNotFound     = errors.New("can't find migration file")
 	ErrCreateDirectory       = errors.New("unable to create directory")
+	ErrMigrationModified     = errors.New("applied migration files have been modified")
+	ErrChecksumsUnsupported  = errors.New("driver does not record migration checksums")
+	ErrDryRunNoDatabase      = errors.New("can't dry run: database does not exist")
+	ErrAcquireLock           = errors.New("unable to acquire migration lock")
+	ErrExistingConnection    = errors.New("can't create or drop a database using an existing connection")
+	ErrSchemaOutOfDate       = errors.New("schema file is out of date")
+	ErrNoMigrationsTable     = errors.New("migrations table does not exist, has the database been migrated?")
+	ErrInvalidGoMigration    = errors.New("go migrations require a numeric version and an up function")
+	ErrDuplicateMigration    = errors.New("duplicate migration version")
+	ErrGoMigrationNoDown     = errors.New("go migration does not define a down function")
+	ErrMigrationApplied      = errors.New("migration is already applied")
+	ErrMigrationNotApplied   = errors.New("migration is not applied")
+	ErrSquashLaterApplied    = errors.New("can't squash: a later migration is applied")
+	ErrSquashGoMigration     = errors.New("can't squash go migrations")
+	ErrSquashEmbeddedFS      = errors.New("can't squash migrations in an embedded filesystem")
+	ErrSquashRollback        = errors.New("squash migrations can't be rolled back")
+	ErrSquashRepeatable      = errors.New("can't squash: a repeatable migration is applied")
+	ErrRollbackMismatch      = errors.New("rolling back the migration did not restore the previous schema")
+	ErrVerifyMigrated        = errors.New("can't verify rollbacks: the database already has migrations applied")
 )
 
 // migrationFileRegexp pattern for valid migration files
 var migrationFileRegexp = regexp.MustCompile(`^(\d+).*\.sql$`)
 
+// numericVersionRegexp pattern for valid Go migration versions
+var numericVersionRegexp = regexp.MustCompile(`^\d+$`)
+
+// repeatableMigrationFileRegexp pattern for valid repeatable migration files
+var repeatableMigrationFileRegexp = regexp.MustCompile(`^(R__.+)\.sql$`)
+
 // DB allows dbmate actions to be performed on a specified database
 type DB struct {
 	// AutoDumpSchema generates schema.sql after each action
 	AutoDumpSchema bool
+	// Connection is an existing database connection to use instead of opening one from
+	// DatabaseURL. It is never closed by dbmate.
+	Connection *sql.DB
 	// DatabaseURL is the database connection string
 	DatabaseURL *url.URL
+	// DryRun prints the statements migrate and rollback would execute, without executing them
+	DryRun bool
 	// FS specifies the filesystem, or nil for OS filesystem
 	FS fs.FS
+	// GoMigrations are migrations written in Go, which run in version order
+	// along with the migration files
+	GoMigrations []GoMigration
+	// LockTimeout specifies maximum time to wait for the migration lock, or zero to wait indefinitely
+	LockTimeout time.Duration
 	// Log is the interface to write stdout
 	Log io.Writer
 	// MigrationsDir specifies the directory or directories to find migration files
 	MigrationsDir []string
 	// MigrationsTableName specifies the database table to record migrations in
 	MigrationsTableName string
+	// NativeDump builds the schema file by querying the database, instead of
+	// running an external dump tool such as pg_dump
+	NativeDump bool
 	// SchemaFile specifies the location for schema.sql file
 	SchemaFile string
 	// Fail if migrations would be applied out of order
 	Strict bool
+	// StrictChecksums fails if applied migration files have been modified
+	StrictChecksums bool
+	// TemplateVars are substituted into migrations with the template:true option,
+	// taking precedence over environment variables of the same name
+	TemplateVars map[string]string
 	// Verbose prints the result of each statement execution
 	Verbose bool
 	// WaitBefore will wait for database to become available before running any actions
@@ -63,21 +112,41 @@ type DB struct {
 
 // StatusResult represents an available migration status
 type StatusResult struct {
-	Filename string
-	Applied  bool
+	Version    string     `json:"version"`
+	Filename   string     `json:"filename"`
+	Directory  string     `json:"directory"`
+	Applied    bool       `json:"applied"`
+	AppliedAt  *time.Time `json:"applied_at,omitempty"`
+	Modified   bool       `json:"modified"`
+	Repeatable bool       `json:"repeatable"`
+}
+
+// StatusReport represents the status of all available migrations
+type StatusReport struct {
+	Migrations []StatusResult `json:"migrations"`
+	Applied    int            `json:"applied"`
+	Pending    int            `json:"pending"`
+	Modified   int            `json:"modified"`
 }
 
 // New initializes a new dbmate database
 func New(databaseURL *url.URL) *DB {
 	return &DB{
 		AutoDumpSchema:      true,
+		Connection:          nil,
 		DatabaseURL:         databaseURL,
+		DryRun:              false,
 		FS:                  nil,
+		GoMigrations:        nil,
+		LockTimeout:         0,
 		Log:                 os.Stdout,
 		MigrationsDir:       []string{"./db/migrations"},
 		MigrationsTableName: "schema_migrations",
+		NativeDump:          false,
 		SchemaFile:          "./db/schema.sql",
 		Strict:              false,
+		StrictChecksums:     false,
+		TemplateVars:        nil,
 		Verbose:             false,
 		WaitBefore:          false,
 		WaitInterval:        time.Second,
@@ -85,8 +154,52 @@ func New(databaseURL *url.URL) *DB {
 	}
 }
 
+// NewWithConnection initializes a new dbmate database using an existing
+// connection. The driver name is a registered URL scheme such as "postgres".
+// The database can't be created or dropped, and dumping the schema requires
+// the full DatabaseURL, so AutoDumpSchema is disabled.
+func NewWithConnection(sqlDB *sql.DB, driverName string) *DB {
+	db := New(&url.URL{Scheme: driverName})
+	db.AutoDumpSchema = false
+	db.Connection = sqlDB
+
+	return db
+}
+
 // Driver initializes the appropriate database driver
 func (db *DB) Driver() (Driver, error) {
+	drv, err := db.newDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	if db.WaitBefore {
+		if err := db.wait(context.Background(), withContext(drv)); err != nil {
+			return nil, err
+		}
+	}
+
+	return drv, nil
+}
+
+// driver initializes the appropriate database driver, with context-aware methods
+func (db *DB) driver(ctx context.Context) (contextDriver, error) {
+	drv, err := db.newDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	cd := withContext(drv)
+	if db.WaitBefore {
+		if err := db.wait(ctx, cd); err != nil {
+			return nil, err
+		}
+	}
+
+	return cd, nil
+}
+
+func (db *DB) newDriver() (Driver, error) {
 	if db.DatabaseURL == nil || db.DatabaseURL.Scheme == "" {
 		return nil, ErrInvalidURL
 	}
@@ -97,24 +210,19 @@ func (db *DB) Driver() (Driver, error) {
 	}
 
 	config := DriverConfig{
+		Connection:          db.Connection,
 		DatabaseURL:         db.DatabaseURL,
 		Log:                 db.Log,
 		MigrationsTableName: db.MigrationsTableName,
-	}
-	drv := driverFunc(config)
-
-	if db.WaitBefore {
-		if err := db.wait(drv); err != nil {
-			return nil, err
-		}
+		NativeDump:          db.NativeDump,
 	}
 
-	return drv, nil
+	return driverFunc(config), nil
 }
 
-func (db *DB) wait(drv Driver) error {
+func (db *DB) wait(ctx context.Context, drv contextDriver) error {
 	// attempt connection to database server
-	err := drv.Ping()
+	err := drv.PingContext(ctx)
 	if err == nil {
 		// connection successful
 		return nil
@@ -123,10 +231,15 @@ func (db *DB) wait(drv Driver) error {
 	fmt.Fprint(db.Log, "Waiting for database")
 	for i := 0 * time.Second; i < db.WaitTimeout; i += db.WaitInterval {
 		fmt.Fprint(db.Log, ".")
-		time.Sleep(db.WaitInterval)
+		select {
+		case <-ctx.Done():
+			fmt.Fprint(db.Log, "\n")
+			return ctx.Err()
+		case <-time.After(db.WaitInterval):
+		}
 
 		// attempt connection to database server
-		err = drv.Ping()
+		err = drv.PingContext(ctx)
 		if err == nil {
 			// connection successful
 			fmt.Fprint(db.Log, "\n")
@@ -142,70 +255,106 @@ func (db *DB) wait(drv Driver) error {
 // Wait blocks until the database server is available. It does not verify that
 // the specified database exists, only that the host is ready to accept connections.
 func (db *DB) Wait() error {
-	drv, err := db.Driver()
+	return db.WaitContext(context.Background())
+}
+
+// WaitContext is like Wait, but stops waiting when the context is done
+func (db *DB) WaitContext(ctx context.Context) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
 	// if db.WaitBefore is true, wait() will get called twice, no harm
-	return db.wait(drv)
+	return db.wait(ctx, drv)
 }
 
 // CreateAndMigrate creates the database (if necessary) and runs migrations
 func (db *DB) CreateAndMigrate() error {
-	drv, err := db.Driver()
+	return db.CreateAndMigrateContext(context.Background())
+}
+
+// CreateAndMigrateContext is like CreateAndMigrate, but aborts when the context is done
+func (db *DB) CreateAndMigrateContext(ctx context.Context) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
 	// create database if it does not already exist
 	// skip this step if we cannot determine status
-	// (e.g. user does not have list database permission)
-	exists, err := drv.DatabaseExists()
-	if err == nil && !exists {
-		if err := drv.CreateDatabase(); err != nil {
-			return err
+	// (e.g. user does not have list database permission),
+	// or if we were given a connection to an existing database
+	if db.Connection == nil {
+		exists, err := drv.DatabaseExistsContext(ctx)
+		if err == nil && !exists && !db.DryRun {
+			if err := drv.CreateDatabaseContext(ctx); err != nil {
+				return err
+			}
 		}
 	}
 
 	// migrate
-	return db.Migrate()
+	return db.MigrateContext(ctx)
 }
 
 // Create creates the current database
 func (db *DB) Create() error {
-	drv, err := db.Driver()
+	return db.CreateContext(context.Background())
+}
+
+// CreateContext is like Create, but aborts when the context is done
+func (db *DB) CreateContext(ctx context.Context) error {
+	if db.Connection != nil {
+		return ErrExistingConnection
+	}
+
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
-	return drv.CreateDatabase()
+	return drv.CreateDatabaseContext(ctx)
 }
 
 // Drop drops the current database (if it exists)
 func (db *DB) Drop() error {
-	drv, err := db.Driver()
+	return db.DropContext(context.Background())
+}
+
+// DropContext is like Drop, but aborts when the context is done
+func (db *DB) DropContext(ctx context.Context) error {
+	if db.Connection != nil {
+		return ErrExistingConnection
+	}
+
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
-	return drv.DropDatabase()
+	return drv.DropDatabaseContext(ctx)
 }
 
 // DumpSchema writes the current database schema to a file
 func (db *DB) DumpSchema() error {
-	drv, err := db.Driver()
+	return db.DumpSchemaContext(context.Background())
+}
+
+// DumpSchemaContext is like DumpSchema, but aborts when the context is done
+func (db *DB) DumpSchemaContext(ctx context.Context) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
-	sqlDB, err := db.openDatabaseForMigration(drv)
+	sqlDB, err := db.openDatabaseForMigration(ctx, drv)
 	if err != nil {
 		return err
 	}
-	defer dbutil.MustClose(sqlDB)
+	defer db.closeDatabase(sqlDB)
 
-	schema, err := drv.DumpSchema(sqlDB)
+	schema, err := drv.DumpSchemaContext(ctx, sqlDB)
 	if err != nil {
 		return err
 	}
@@ -221,9 +370,120 @@ func (db *DB) DumpSchema() error {
 	return os.WriteFile(db.SchemaFile, schema, 0o644)
 }
 
+// CheckSchema compares the current database schema to the schema file, without
+// writing it. If they differ, a unified diff is printed and ErrSchemaOutOfDate
+// is returned.
+func (db *DB) CheckSchema() error {
+	return db.CheckSchemaContext(context.Background())
+}
+
+// CheckSchemaContext is like CheckSchema, but aborts when the context is done
+func (db *DB) CheckSchemaContext(ctx context.Context) error {
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return err
+	}
+
+	// checking the schema must not create or upgrade the migrations table
+	sqlDB, err := db.openMigratedDatabase(ctx, drv)
+	if err != nil {
+		return err
+	}
+	defer db.closeDatabase(sqlDB)
+
+	schema, err := drv.DumpSchemaContext(ctx, sqlDB)
+	if err != nil {
+		return err
+	}
+
+	// a missing schema file is treated as empty, so the diff shows everything
+	existing, err := os.ReadFile(db.SchemaFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if string(existing) == string(schema) {
+		fmt.Fprintf(db.Log, "Schema is up to date: %s\n", db.SchemaFile)
+		return nil
+	}
+
+	if err := db.printDiff(existing, schema, db.SchemaFile, "database"); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", ErrSchemaOutOfDate, db.SchemaFile)
+}
+
+// printDiff prints a unified diff between two schemas
+func (db *DB) printDiff(a, b []byte, fromFile, toFile string) error {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(a)),
+		B:        difflib.SplitLines(string(b)),
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(db.Log, diff)
+
+	return nil
+}
+
+// Drift compares the current database schema to the schema file, and reports
+// objects which were added, removed or changed outside of migrations
+func (db *DB) Drift() ([]SchemaChange, error) {
+	return db.DriftContext(context.Background())
+}
+
+// DriftContext is like Drift, but aborts when the context is done
+func (db *DB) DriftContext(ctx context.Context) ([]SchemaChange, error) {
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := os.ReadFile(db.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// reporting drift must not create or upgrade the migrations table
+	sqlDB, err := db.openMigratedDatabase(ctx, drv)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeDatabase(sqlDB)
+
+	schema, err := drv.DumpSchemaContext(ctx, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := diffSchemas(
+		parseSchema(string(existing), db.MigrationsTableName),
+		parseSchema(string(schema), db.MigrationsTableName),
+	)
+
+	if len(changes) == 0 {
+		fmt.Fprintf(db.Log, "No schema drift from %s\n", db.SchemaFile)
+	}
+	for _, change := range changes {
+		fmt.Fprintf(db.Log, "%s\n", change)
+	}
+
+	return changes, nil
+}
+
 // LoadSchema loads schema file to the current database
 func (db *DB) LoadSchema() error {
-	drv, err := db.Driver()
+	return db.LoadSchemaContext(context.Background())
+}
+
+// LoadSchemaContext is like LoadSchema, but aborts when the context is done
+func (db *DB) LoadSchemaContext(ctx context.Context) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
@@ -232,7 +492,7 @@ func (db *DB) LoadSchema() error {
 	if err != nil {
 		return err
 	}
-	defer dbutil.MustClose(sqlDB)
+	defer db.closeDatabase(sqlDB)
 
 	_, err = os.Stat(db.SchemaFile)
 	if err != nil {
@@ -246,7 +506,11 @@ func (db *DB) LoadSchema() error {
 		return err
 	}
 
-	result, err := sqlDB.Exec(string(bytes))
+	if loader, ok := unwrapDriver(drv).(SchemaLoader); ok {
+		return loader.LoadSchemaContext(ctx, sqlDB, string(bytes))
+	}
+
+	result, err := sqlDB.ExecContext(ctx, string(bytes))
 	if err != nil {
 		return err
 	} else if db.Verbose {
@@ -256,6 +520,16 @@ func (db *DB) LoadSchema() error {
 	return nil
 }
 
+// contextError wraps the error of a statement interrupted by the context, since
+// drivers don't all report the context error when a statement is interrupted
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %s", ctxErr, err)
+	}
+
+	return err
+}
+
 // ensureDir creates a directory if it does not already exist
 func ensureDir(dir string) error {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
@@ -300,14 +574,15 @@ func (db *DB) NewMigration(name string) error {
 	return err
 }
 
-func doTransaction(sqlDB *sql.DB, txFunc func(dbutil.Transaction) error) error {
-	tx, err := sqlDB.Begin()
+func doTransaction(ctx context.Context, sqlDB *sql.DB, txFunc func(dbutil.Transaction) error) error {
+	tx, err := sqlDB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
 	if err := txFunc(tx); err != nil {
-		if err1 := tx.Rollback(); err1 != nil {
+		// the transaction is rolled back automatically if the context is done
+		if err1 := tx.Rollback(); err1 != nil && !errors.Is(err1, sql.ErrTxDone) {
 			return err1
 		}
 
@@ -317,289 +592,1329 @@ func doTransaction(sqlDB *sql.DB, txFunc func(dbutil.Transaction) error) error {
 	return tx.Commit()
 }
 
-func (db *DB) openDatabaseForMigration(drv Driver) (*sql.DB, error) {
+// closeDatabase closes a connection opened by the driver, leaving an existing
+// connection open for the caller
+func (db *DB) closeDatabase(sqlDB *sql.DB) {
+	if sqlDB != db.Connection {
+		dbutil.MustClose(sqlDB)
+	}
+}
+
+func (db *DB) openDatabaseForMigration(ctx context.Context, drv contextDriver) (*sql.DB, error) {
 	sqlDB, err := drv.Open()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := drv.CreateMigrationsTable(sqlDB); err != nil {
-		dbutil.MustClose(sqlDB)
+	if err := db.createMigrationsTable(ctx, drv, sqlDB); err != nil {
+		db.closeDatabase(sqlDB)
 		return nil, err
 	}
 
 	return sqlDB, nil
 }
 
-// Migrate migrates database to the latest version
-func (db *DB) Migrate() error {
-	drv, err := db.Driver()
+// openMigratedDatabase opens the database without changing it, for commands
+// which only read the schema. The migrations table must already exist.
+func (db *DB) openMigratedDatabase(ctx context.Context, drv contextDriver) (*sql.DB, error) {
+	sqlDB, err := drv.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	migrations, err := db.FindMigrations()
+	exists, err := drv.MigrationsTableExistsContext(ctx, sqlDB)
+	if err == nil && !exists {
+		err = fmt.Errorf("%w: %s", ErrNoMigrationsTable, db.MigrationsTableName)
+	}
 	if err != nil {
-		return err
+		db.closeDatabase(sqlDB)
+		return nil, err
 	}
 
-	if len(migrations) == 0 {
-		return ErrNoMigrationFiles
-	}
+	return sqlDB, nil
+}
 
-	highestAppliedMigrationVersion := ""
-	pendingMigrations := []Migration{}
-	for _, migration := range migrations {
-		if migration.Applied {
-			if db.Strict && highestAppliedMigrationVersion <= migration.Version {
-				highestAppliedMigrationVersion = migration.Version
-			}
-		} else {
-			pendingMigrations = append(pendingMigrations, migration)
+// createMigrationsTable creates the migrations table if necessary
+func (db *DB) createMigrationsTable(ctx context.Context, drv contextDriver, sqlDB *sql.DB) error {
+	if db.DryRun {
+		// leave the database untouched, only report what would be created
+		exists, err := drv.MigrationsTableExistsContext(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			fmt.Fprintf(db.Log, "-- migrations table %s does not exist and would be created\n", db.MigrationsTableName)
 		}
-	}
 
-	if len(pendingMigrations) > 0 && db.Strict && pendingMigrations[0].Version <= highestAppliedMigrationVersion {
-		return fmt.Errorf("migration `%s` is out of order with already applied migrations, the version number has to be higher than the applied migration `%s` in --strict mode", pendingMigrations[0].Version, highestAppliedMigrationVersion)
+		return nil
 	}
 
-	sqlDB, err := db.openDatabaseForMigration(drv)
+	return drv.CreateMigrationsTableContext(ctx, sqlDB)
+}
+
+// withMigrationLock opens the database for migration, and holds the migration
+// lock while txFunc runs so that only one process migrates the database at a time
+func (db *DB) withMigrationLock(ctx context.Context, drv contextDriver, txFunc func(*sql.DB) error) error {
+	sqlDB, err := drv.Open()
 	if err != nil {
 		return err
 	}
-	defer dbutil.MustClose(sqlDB)
+	defer db.closeDatabase(sqlDB)
 
-	for _, migration := range pendingMigrations {
-		fmt.Fprintf(db.Log, "Applying: %s\n", migration.FileName)
+	unlock, err := db.lock(ctx, drv, sqlDB)
+	if err != nil {
+		return err
+	}
 
-		parsed, err := migration.Parse()
-		if err != nil {
-			return err
-		}
+	err = db.createMigrationsTable(ctx, drv, sqlDB)
+	if err == nil {
+		err = txFunc(sqlDB)
+	}
 
-		execMigration := func(tx dbutil.Transaction) error {
-			// run actual migration
-			result, err := tx.Exec(parsed.Up)
-			if err != nil {
-				return drv.QueryError(parsed.Up, err)
-			} else if db.Verbose {
-				db.printVerbose(result)
-			}
+	if unlockErr := unlock(); err == nil {
+		err = unlockErr
+	}
 
-			// record migration
-			return drv.InsertMigration(tx, migration.Version)
-		}
+	return err
+}
 
-		if parsed.UpOptions.Transaction() {
-			// begin transaction
-			err = doTransaction(sqlDB, execMigration)
-		} else {
-			// run outside of transaction
-			err = execMigration(sqlDB)
-		}
+// lock acquires the migration lock, if supported by the driver
+func (db *DB) lock(ctx context.Context, drv contextDriver, sqlDB *sql.DB) (func() error, error) {
+	locker, ok := unwrapDriver(drv).(Locker)
+	if !ok || db.DryRun {
+		return func() error { return nil }, nil
+	}
 
-		if err != nil {
-			return err
-		}
+	if db.LockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.LockTimeout)
+		defer cancel()
 	}
 
-	// automatically update schema file, silence errors
-	if db.AutoDumpSchema {
-		_ = db.DumpSchema()
+	unlock, err := locker.Lock(ctx, sqlDB)
+	if err != nil {
+		// wrap both errors, so that callers can detect cancellation
+		return nil, fmt.Errorf("%w: %w", ErrAcquireLock, err)
 	}
 
-	return nil
+	return unlock, nil
 }
 
-func (db *DB) printVerbose(result sql.Result) {
-	lastInsertID, err := result.LastInsertId()
-	if err == nil {
-		fmt.Fprintf(db.Log, "Last insert ID: %d\n", lastInsertID)
-	}
-	rowsAffected, err := result.RowsAffected()
-	if err == nil {
-		fmt.Fprintf(db.Log, "Rows affected: %d\n", rowsAffected)
-	}
+// Migrate migrates database to the latest version
+func (db *DB) Migrate() error {
+	return db.MigrateContext(context.Background())
 }
 
-func (db *DB) readMigrationsDir(dir string) ([]fs.DirEntry, error) {
-	path := filepath.Clean(dir)
-
-	// We use nil instead of os.DirFS() because DirFS cannot support both relative and absolute
-	// directory paths - it must be anchored at either "." or "/", which we do not know in advance.
-	// See: https://github.com/amacneil/dbmate/issues/403
-	if db.FS == nil {
-		return os.ReadDir(path)
-	}
+// MigrateContext is like Migrate, but aborts when the context is done.
+// Migrations which were not fully applied are rolled back if they run in a transaction.
+func (db *DB) MigrateContext(ctx context.Context) error {
+	return db.migrate(ctx, "")
+}
 
-	return fs.ReadDir(db.FS, path)
+// MigrateTo migrates database up to and including the specified version
+func (db *DB) MigrateTo(version string) error {
+	return db.MigrateToContext(context.Background(), version)
 }
 
-// FindMigrations lists all available migrations
-func (db *DB) FindMigrations() ([]Migration, error) {
-	drv, err := db.Driver()
-	if err != nil {
-		return nil, err
+// MigrateToContext is like MigrateTo, but aborts when the context is done
+func (db *DB) MigrateToContext(ctx context.Context, version string) error {
+	if version == "" {
+		return ErrNoMigrationVersion
 	}
 
-	sqlDB, err := drv.Open()
+	return db.migrate(ctx, version)
+}
+
+// migrate applies pending migrations, stopping after the target version
+// if one is specified
+func (db *DB) migrate(ctx context.Context, target string) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer dbutil.MustClose(sqlDB)
 
-	// find applied migrations
-	appliedMigrations := map[string]bool{}
-	migrationsTableExists, err := drv.MigrationsTableExists(sqlDB)
-	if err != nil {
-		return nil, err
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
 	}
 
-	if migrationsTableExists {
-		appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
+	err = db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		migrations, err := db.FindMigrationsContext(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	}
 
-	migrations := []Migration{}
-	for _, dir := range db.MigrationsDir {
-		// find filesystem migrations
-		files, err := db.readMigrationsDir(dir)
-		if err != nil {
-			return nil, fmt.Errorf("%w `%s`", ErrMigrationDirNotFound, dir)
+		if len(migrations) == 0 {
+			return ErrNoMigrationFiles
 		}
 
-		for _, file := range files {
-			if file.IsDir() {
-				continue
+		// repeatable migrations may depend on later versions, so they are
+		// only applied when migrating to the latest version
+		if target != "" {
+			migrations, err = migrationsUpTo(migrations, target)
+			if err != nil {
+				return err
 			}
+		}
 
-			matches := migrationFileRegexp.FindStringSubmatch(file.Name())
-			if len(matches) < 2 {
-				continue
-			}
+		pendingMigrations, err := db.pendingMigrations(migrations)
+		if err != nil {
+			return err
+		}
 
-			migration := Migration{
-				Applied:  false,
-				FileName: matches[0],
-				FilePath: filepath.Join(dir, matches[0]),
-				FS:       db.FS,
-				Version:  matches[1],
-			}
-			if ok := appliedMigrations[migration.Version]; ok {
-				migration.Applied = true
+		for _, migration := range pendingMigrations {
+			if err := db.applyMigration(ctx, drv, sqlDB, migration); err != nil {
+				return err
 			}
-
-			migrations = append(migrations, migration)
 		}
-	}
 
-	sort.Slice(migrations, func(i, j int) bool {
-		return migrations[i].FileName < migrations[j].FileName
+		return nil
 	})
-
-	return migrations, nil
-}
-
-// Rollback rolls back the most recent migration
-func (db *DB) Rollback() error {
-	drv, err := db.Driver()
 	if err != nil {
 		return err
 	}
 
-	sqlDB, err := db.openDatabaseForMigration(drv)
-	if err != nil {
-		return err
+	// automatically update schema file, silence errors
+	if db.AutoDumpSchema && !db.DryRun {
+		_ = db.DumpSchemaContext(ctx)
 	}
-	defer dbutil.MustClose(sqlDB)
 
-	// find last applied migration
-	var latest *Migration
-	migrations, err := db.FindMigrations()
+	return nil
+}
+
+// pendingMigrations returns the migrations which are not applied yet. Applied
+// migrations are checked for modifications, and in strict mode pending
+// migrations must have a higher version than all applied migrations.
+func (db *DB) pendingMigrations(migrations []Migration) ([]Migration, error) {
+	if err := db.checkModified(migrations); err != nil {
+		return nil, err
+	}
+
+	highestAppliedMigrationVersion := ""
+	pendingMigrations := []Migration{}
+	for _, migration := range migrations {
+		if migration.Applied {
+			if db.Strict && !migration.Repeatable && highestAppliedMigrationVersion <= migration.Version {
+				highestAppliedMigrationVersion = migration.Version
+			}
+		} else {
+			pendingMigrations = append(pendingMigrations, migration)
+		}
+	}
+
+	if len(pendingMigrations) > 0 && db.Strict && !pendingMigrations[0].Repeatable &&
+		pendingMigrations[0].Version <= highestAppliedMigrationVersion {
+		return nil, fmt.Errorf("migration `%s` is out of order with already applied migrations, the version number has to be higher than the applied migration `%s` in --strict mode", pendingMigrations[0].Version, highestAppliedMigrationVersion)
+	}
+
+	return pendingMigrations, nil
+}
+
+// applyMigration runs the up block of a single migration and records it
+func (db *DB) applyMigration(ctx context.Context, drv contextDriver, sqlDB *sql.DB, migration Migration) error {
+	fmt.Fprintf(db.Log, "Applying: %s\n", migration.FileName)
+
+	parsed, err := migration.Parse()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := migration.Checksum()
+	if err != nil {
+		return err
+	}
+
+	execMigration := func(tx dbutil.Transaction) error {
+		// run actual migration
+		start := time.Now()
+		if migration.goMigration != nil {
+			if err := migration.goMigration.Up(ctx, tx); err != nil {
+				return err
+			}
+		} else {
+			result, err := tx.ExecContext(ctx, parsed.Up)
+			if err != nil {
+				return drv.QueryError(parsed.Up, contextError(ctx, err))
+			} else if db.Verbose {
+				db.printVerbose(result)
+			}
+		}
+
+		// repeatable migrations replace the record of their previous run, if any
+		if migration.Repeatable {
+			if err := drv.DeleteMigrationContext(ctx, tx, migration.Version); err != nil {
+				return err
+			}
+		}
+
+		// record migration
+		return drv.InsertMigrationRecordContext(ctx, tx, MigrationRecord{
+			Version:       migration.Version,
+			AppliedAt:     start.UTC(),
+			Duration:      time.Since(start),
+			Checksum:      checksum,
+			DbmateVersion: Version,
+		})
+	}
+
+	if db.DryRun {
+		return db.dryRun(sqlDB, parsed.UpOptions.Transaction(), execMigration)
+	}
+
+	if parsed.UpOptions.Transaction() {
+		// begin transaction
+		return doTransaction(ctx, sqlDB, execMigration)
+	}
+
+	// run outside of transaction
+	return execMigration(sqlDB)
+}
+
+// Baseline records all migrations up to and including the specified version
+// as applied, without running them. This is used to start managing an existing
+// database with dbmate. If loadSchema is true, the schema file is loaded first.
+func (db *DB) Baseline(version string, loadSchema bool) error {
+	return db.BaselineContext(context.Background(), version, loadSchema)
+}
+
+// BaselineContext is like Baseline, but aborts when the context is done
+func (db *DB) BaselineContext(ctx context.Context, version string, loadSchema bool) error {
+	if version == "" {
+		return ErrNoMigrationVersion
+	}
+
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
+	}
+
+	if loadSchema {
+		if db.DryRun {
+			fmt.Fprintf(db.Log, "-- schema file %s would be loaded\n", db.SchemaFile)
+		} else if err := db.LoadSchemaContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	recorded := 0
+	err = db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		migrations, err := db.FindMigrationsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		migrations, err = migrationsUpTo(migrations, version)
+		if err != nil {
+			return err
+		}
+
+		// migrations recorded by the schema file are skipped
+		pendingMigrations := []Migration{}
+		for _, migration := range migrations {
+			if !migration.Applied {
+				pendingMigrations = append(pendingMigrations, migration)
+			}
+		}
+
+		recordMigrations := func(tx dbutil.Transaction) error {
+			appliedAt := time.Now().UTC()
+			for _, migration := range pendingMigrations {
+				fmt.Fprintf(db.Log, "Baselining: %s\n", migration.FileName)
+
+				checksum, err := migration.Checksum()
+				if err != nil {
+					return err
+				}
+
+				err = drv.InsertMigrationRecordContext(ctx, tx, MigrationRecord{
+					Version:       migration.Version,
+					AppliedAt:     appliedAt,
+					Checksum:      checksum,
+					DbmateVersion: Version,
+				})
+				if err != nil {
+					return err
+				}
+				recorded++
+			}
+
+			return nil
+		}
+
+		if db.DryRun {
+			return db.dryRun(sqlDB, true, recordMigrations)
+		}
+
+		return doTransaction(ctx, sqlDB, recordMigrations)
+	})
+	if err != nil {
+		return err
+	}
+
+	// automatically update schema file, silence errors
+	if db.AutoDumpSchema && !db.DryRun && (recorded > 0 || loadSchema) {
+		_ = db.DumpSchemaContext(ctx)
+	}
+
+	return nil
+}
+
+// MarkApplied records a migration as applied, without running it
+func (db *DB) MarkApplied(version string) error {
+	return db.MarkAppliedContext(context.Background(), version)
+}
+
+// MarkAppliedContext is like MarkApplied, but aborts when the context is done
+func (db *DB) MarkAppliedContext(ctx context.Context, version string) error {
+	return db.mark(ctx, version, true)
+}
+
+// MarkPending removes the record of an applied migration, without rolling it back
+func (db *DB) MarkPending(version string) error {
+	return db.MarkPendingContext(context.Background(), version)
+}
+
+// MarkPendingContext is like MarkPending, but aborts when the context is done
+func (db *DB) MarkPendingContext(ctx context.Context, version string) error {
+	return db.mark(ctx, version, false)
+}
+
+// mark inserts or deletes the record of a single migration
+func (db *DB) mark(ctx context.Context, version string, applied bool) error {
+	if version == "" {
+		return ErrNoMigrationVersion
+	}
+
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
+	}
+
+	err = db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		migrations, err := db.FindMigrationsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		var migration *Migration
+		for i := range migrations {
+			if migrations[i].Version == version {
+				migration = &migrations[i]
+				break
+			}
+		}
+		if migration == nil {
+			return fmt.Errorf("%w: %s", ErrMigrationNotFound, version)
+		}
+
+		records, err := drv.SelectMigrationRecordsContext(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		_, recorded := records[version]
+
+		var execMark func(dbutil.Transaction) error
+		if applied {
+			if migration.Applied {
+				return fmt.Errorf("%w: %s", ErrMigrationApplied, migration.FileName)
+			}
+
+			checksum, err := migration.Checksum()
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(db.Log, "Marking as applied: %s\n", migration.FileName)
+			execMark = func(tx dbutil.Transaction) error {
+				// modified repeatable migrations replace their previous record
+				if recorded {
+					if err := drv.DeleteMigrationContext(ctx, tx, version); err != nil {
+						return err
+					}
+				}
+
+				return drv.InsertMigrationRecordContext(ctx, tx, MigrationRecord{
+					Version:       version,
+					AppliedAt:     time.Now().UTC(),
+					Checksum:      checksum,
+					DbmateVersion: Version,
+				})
+			}
+		} else {
+			if !recorded {
+				return fmt.Errorf("%w: %s", ErrMigrationNotApplied, migration.FileName)
+			}
+
+			fmt.Fprintf(db.Log, "Marking as pending: %s\n", migration.FileName)
+			execMark = func(tx dbutil.Transaction) error {
+				return drv.DeleteMigrationContext(ctx, tx, version)
+			}
+		}
+
+		if db.DryRun {
+			return db.dryRun(sqlDB, true, execMark)
+		}
+
+		return doTransaction(ctx, sqlDB, execMark)
+	})
+	if err != nil {
+		return err
+	}
+
+	// automatically update schema file, silence errors
+	if db.AutoDumpSchema && !db.DryRun {
+		_ = db.DumpSchemaContext(ctx)
+	}
+
+	return nil
+}
+
+// squashArchiveDir is the directory, next to the squashed migration files,
+// which they are moved to
+const squashArchiveDir = "archive"
+
+// Squash replaces the migration files before the specified version with a
+// single migration, generated from the current database schema. The database
+// must have exactly the squashed migrations applied. The squash migration takes
+// the version of the last squashed migration, so that databases which applied
+// the squashed migrations treat it as applied, and the squashed files are moved
+// to an archive directory.
+func (db *DB) Squash(before string) error {
+	return db.SquashContext(context.Background(), before)
+}
+
+// SquashContext is like Squash, but aborts when the context is done
+func (db *DB) SquashContext(ctx context.Context, before string) error {
+	if before == "" {
+		return ErrNoMigrationVersion
+	}
+	if db.FS != nil {
+		return ErrSquashEmbeddedFS
+	}
+
+	migrations, err := db.FindMigrationsContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	squashed := []Migration{}
+	for _, migration := range migrations {
+		switch {
+		case migration.Repeatable:
+			// objects created by repeatable migrations would be in both the
+			// schema dump and their own files
+			if migration.Applied {
+				return fmt.Errorf("%w: %s", ErrSquashRepeatable, migration.FileName)
+			}
+		case migration.Version >= before:
+			if migration.Applied {
+				return fmt.Errorf("%w: %s", ErrSquashLaterApplied, migration.FileName)
+			}
+		case migration.goMigration != nil:
+			return fmt.Errorf("%w: %s", ErrSquashGoMigration, migration.FileName)
+		case !migration.Applied:
+			return fmt.Errorf("%w: %s", ErrMigrationNotApplied, migration.FileName)
+		default:
+			squashed = append(squashed, migration)
+		}
+	}
+	if len(squashed) == 0 {
+		return fmt.Errorf("%w before %s", ErrNoMigrationFiles, before)
+	}
+
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.openDatabaseForMigration(ctx, drv)
+	if err != nil {
+		return err
+	}
+	defer db.closeDatabase(sqlDB)
+
+	schema, err := drv.DumpSchemaContext(ctx, sqlDB)
+	if err != nil {
+		return err
+	}
+
+	// databases which applied the last squashed migration recorded its checksum
+	last := squashed[len(squashed)-1]
+	checksum, err := last.Checksum()
+	if err != nil {
+		return err
+	}
+	contents := fmt.Sprintf("-- migrate:up squash:%s\n%s-- migrate:down\n"+
+		"-- squash migrations can't be rolled back\n",
+		checksum, squashSchema(string(schema), db.MigrationsTableName))
+	path := filepath.Join(filepath.Dir(last.FilePath), last.Version+"_squash.sql")
+
+	// check nothing will be overwritten before moving any files
+	if _, err := os.Stat(path); !os.IsNotExist(err) && path != last.FilePath {
+		return fmt.Errorf("%w: %s", ErrMigrationAlreadyExist, path)
+	}
+	for _, migration := range squashed {
+		archivePath := filepath.Join(filepath.Dir(migration.FilePath), squashArchiveDir, migration.FileName)
+		if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrMigrationAlreadyExist, archivePath)
+		}
+	}
+
+	// the schema dump doesn't include data, such as seed data inserted by migrations
+	for _, migration := range squashed {
+		parsed, err := migration.Parse()
+		if err != nil {
+			return err
+		}
+		if modifiesData(parsed.Up) {
+			fmt.Fprintf(db.Log, "Warning: %s modifies data, which is not included in the squash migration\n",
+				migration.FileName)
+		}
+	}
+
+	for _, migration := range squashed {
+		archiveDir := filepath.Join(filepath.Dir(migration.FilePath), squashArchiveDir)
+		if err := ensureDir(archiveDir); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(db.Log, "Archiving: %s\n", migration.FilePath)
+		if err := os.Rename(migration.FilePath, filepath.Join(archiveDir, migration.FileName)); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(db.Log, "Creating migration: %s\n", path)
+	return os.WriteFile(path, []byte(contents), 0o644)
+}
+
+// checkModified warns about applied migrations whose files have changed since
+// they were applied, and returns an error in strict checksums mode
+func (db *DB) checkModified(migrations []Migration) error {
+	modified := []string{}
+	for _, migration := range migrations {
+		if migration.Modified {
+			fmt.Fprintf(db.Log, "Warning: %s has been modified since it was applied\n", migration.FileName)
+			modified = append(modified, migration.FileName)
+		}
+	}
+
+	if len(modified) > 0 && db.StrictChecksums {
+		return fmt.Errorf("%w: %s", ErrMigrationModified, strings.Join(modified, ", "))
+	}
+
+	return nil
+}
+
+// migrationsUpTo returns the versioned migrations up to and including the specified version
+func migrationsUpTo(migrations []Migration, version string) ([]Migration, error) {
+	for i, migration := range migrations {
+		if migration.Version == version && !migration.Repeatable {
+			return migrations[:i+1], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrMigrationNotFound, version)
+}
+
+func (db *DB) printVerbose(result sql.Result) {
+	lastInsertID, err := result.LastInsertId()
+	if err == nil {
+		fmt.Fprintf(db.Log, "Last insert ID: %d\n", lastInsertID)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err == nil {
+		fmt.Fprintf(db.Log, "Rows affected: %d\n", rowsAffected)
+	}
+}
+
+func (db *DB) readMigrationsDir(dir string) ([]fs.DirEntry, error) {
+	path := filepath.Clean(dir)
+
+	// We use nil instead of os.DirFS() because DirFS cannot support both relative and absolute
+	// directory paths - it must be anchored at either "." or "/", which we do not know in advance.
+	// See: https://github.com/amacneil/dbmate/issues/403
+	if db.FS == nil {
+		return os.ReadDir(path)
+	}
+
+	return fs.ReadDir(db.FS, path)
+}
+
+// FindMigrations lists all available migrations
+func (db *DB) FindMigrations() ([]Migration, error) {
+	return db.FindMigrationsContext(context.Background())
+}
+
+// FindMigrationsContext is like FindMigrations, but aborts when the context is done
+func (db *DB) FindMigrationsContext(ctx context.Context) ([]Migration, error) {
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlDB, err := drv.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeDatabase(sqlDB)
+
+	// find applied migrations
+	appliedMigrations := map[string]MigrationRecord{}
+	migrationsTableExists, err := drv.MigrationsTableExistsContext(ctx, sqlDB)
+	if err != nil {
+		return nil, err
+	}
+
+	if migrationsTableExists {
+		appliedMigrations, err = drv.SelectMigrationRecordsContext(ctx, sqlDB)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	migrations := []Migration{}
+	for _, dir := range db.MigrationsDir {
+		// find filesystem migrations
+		files, err := db.readMigrationsDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%w `%s`", ErrMigrationDirNotFound, dir)
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+
+			matches := migrationFileRegexp.FindStringSubmatch(file.Name())
+			repeatable := false
+			if len(matches) < 2 {
+				matches = repeatableMigrationFileRegexp.FindStringSubmatch(file.Name())
+				repeatable = true
+			}
+			if len(matches) < 2 {
+				continue
+			}
+
+			migration := Migration{
+				Applied:      false,
+				FileName:     matches[0],
+				FilePath:     filepath.Join(dir, matches[0]),
+				FS:           db.FS,
+				Repeatable:   repeatable,
+				Version:      matches[1],
+				templateVars: db.TemplateVars,
+			}
+			if record, ok := appliedMigrations[migration.Version]; ok && repeatable {
+				// repeatable migrations are pending again whenever their checksum changes
+				checksum, err := migration.Checksum()
+				if err != nil {
+					return nil, err
+				}
+				migration.Applied = checksum == record.Checksum
+				migration.AppliedAt = record.AppliedAt
+			} else if ok {
+				migration.Applied = true
+				migration.AppliedAt = record.AppliedAt
+
+				// migrations applied before checksums were recorded can't be verified
+				if record.Checksum != "" {
+					checksum, err := migration.Checksum()
+					if err != nil {
+						return nil, err
+					}
+					migration.Modified = checksum != record.Checksum
+				}
+				if migration.Modified {
+					// a squash migration replaces the file which was applied
+					squashed, err := migration.squashedChecksum()
+					if err != nil {
+						return nil, err
+					}
+					migration.Modified = squashed != record.Checksum
+				}
+			}
+
+			migrations = append(migrations, migration)
+		}
+	}
+
+	goMigrations, err := db.findGoMigrations(migrations, appliedMigrations)
+	if err != nil {
+		return nil, err
+	}
+	migrations = append(migrations, goMigrations...)
+
+	// repeatable migrations always run after versioned migrations
+	sort.Slice(migrations, func(i, j int) bool {
+		if migrations[i].Repeatable != migrations[j].Repeatable {
+			return migrations[j].Repeatable
+		}
+		return migrations[i].FileName < migrations[j].FileName
+	})
+
+	return migrations, nil
+}
+
+// findGoMigrations lists the Go migrations, which must not share a version
+// with each other or with the migration files
+func (db *DB) findGoMigrations(files []Migration, appliedMigrations map[string]MigrationRecord) ([]Migration, error) {
+	versions := map[string]bool{}
+	for _, migration := range files {
+		versions[migration.Version] = true
+	}
+
+	migrations := []Migration{}
+	for i := range db.GoMigrations {
+		goMigration := &db.GoMigrations[i]
+		if !numericVersionRegexp.MatchString(goMigration.Version) || goMigration.Up == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidGoMigration, goMigration.fileName())
+		}
+		if versions[goMigration.Version] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateMigration, goMigration.Version)
+		}
+		versions[goMigration.Version] = true
+
+		migration := Migration{
+			Applied:     false,
+			FileName:    goMigration.fileName(),
+			Version:     goMigration.Version,
+			goMigration: goMigration,
+		}
+		if record, ok := appliedMigrations[migration.Version]; ok {
+			migration.Applied = true
+			migration.AppliedAt = record.AppliedAt
+		}
+
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, nil
+}
+
+// Rollback rolls back the most recent migration
+func (db *DB) Rollback() error {
+	return db.RollbackContext(context.Background())
+}
+
+// RollbackContext is like Rollback, but aborts when the context is done
+func (db *DB) RollbackContext(ctx context.Context) error {
+	return db.RollbackStepsContext(ctx, 1)
+}
+
+// RollbackSteps rolls back the specified number of most recent migrations
+func (db *DB) RollbackSteps(steps int) error {
+	return db.RollbackStepsContext(context.Background(), steps)
+}
+
+// RollbackStepsContext is like RollbackSteps, but aborts when the context is done
+func (db *DB) RollbackStepsContext(ctx context.Context, steps int) error {
+	if steps < 1 {
+		return ErrInvalidSteps
+	}
+
+	return db.rollback(ctx, func(migrations []Migration) ([]Migration, error) {
+		return latestApplied(migrations, steps)
+	})
+}
+
+// latestApplied returns the specified number of most recently applied
+// versioned migrations, most recent first
+func latestApplied(migrations []Migration, steps int) ([]Migration, error) {
+	applied := appliedInReverse(migrations)
+	if len(applied) == 0 {
+		return nil, ErrNoRollback
+	}
+	if steps > len(applied) {
+		return nil, fmt.Errorf("can't rollback %d migrations: only %d have been applied", steps, len(applied))
+	}
+
+	return applied[:steps], nil
+}
+
+// RollbackTo rolls back all migrations applied after the specified version.
+// The specified version itself remains applied.
+func (db *DB) RollbackTo(version string) error {
+	return db.RollbackToContext(context.Background(), version)
+}
+
+// RollbackToContext is like RollbackTo, but aborts when the context is done
+func (db *DB) RollbackToContext(ctx context.Context, version string) error {
+	if version == "" {
+		return ErrNoMigrationVersion
+	}
+
+	return db.rollback(ctx, func(migrations []Migration) ([]Migration, error) {
+		keep, err := migrationsUpTo(migrations, version)
+		if err != nil {
+			return nil, err
+		}
+
+		return appliedInReverse(migrations[len(keep):]), nil
+	})
+}
+
+// appliedInReverse returns the applied versioned migrations, most recent first.
+// Repeatable migrations can't be rolled back.
+func appliedInReverse(migrations []Migration) []Migration {
+	applied := []Migration{}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if migrations[i].Applied && !migrations[i].Repeatable {
+			applied = append(applied, migrations[i])
+		}
+	}
+
+	return applied
+}
+
+// rollback rolls back the migrations chosen by selectMigrations, in the order returned
+func (db *DB) rollback(ctx context.Context, selectMigrations func([]Migration) ([]Migration, error)) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
-	for i, migration := range migrations {
-		if migration.Applied {
-			latest = &migrations[i]
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
+	}
+
+	rolledBack := 0
+	err = db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		migrations, err := db.FindMigrationsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		rollbackMigrations, err := selectMigrations(migrations)
+		if err != nil {
+			return err
+		}
+
+		for i, migration := range rollbackMigrations {
+			if err := db.rollbackMigration(ctx, drv, sqlDB, migration); err != nil {
+				if len(rollbackMigrations) == 1 {
+					return err
+				}
+
+				return fmt.Errorf("rolled back %d of %d migrations, failed on `%s`: %w",
+					i, len(rollbackMigrations), migration.FileName, err)
+			}
+			rolledBack++
 		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	if latest == nil {
-		return ErrNoRollback
+	// automatically update schema file, silence errors
+	if db.AutoDumpSchema && !db.DryRun && rolledBack > 0 {
+		_ = db.DumpSchemaContext(ctx)
 	}
 
-	fmt.Fprintf(db.Log, "Rolling back: %s\n", latest.FileName)
+	return nil
+}
+
+// VerifyRollbacks checks that the down block of each pending migration is the
+// inverse of its up block. Each migration is applied, rolled back and applied
+// again, and the schema after rolling back must match the schema before the
+// migration was applied. Verification stops at the first migration which
+// doesn't restore the schema, leaving it rolled back: the difference is printed
+// and ErrRollbackMismatch is returned. This should be run on a scratch database,
+// so databases with migrations already applied are refused unless allowApplied is set.
+func (db *DB) VerifyRollbacks(allowApplied bool) error {
+	return db.VerifyRollbacksContext(context.Background(), allowApplied)
+}
 
-	parsed, err := latest.Parse()
+// VerifyRollbacksContext is like VerifyRollbacks, but aborts when the context is done
+func (db *DB) VerifyRollbacksContext(ctx context.Context, allowApplied bool) error {
+	drv, err := db.driver(ctx)
 	if err != nil {
 		return err
 	}
 
-	execMigration := func(tx dbutil.Transaction) error {
-		// rollback migration
-		result, err := tx.Exec(parsed.Down)
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
+	}
+
+	verified := 0
+	changed := false
+	err = db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		migrations, err := db.FindMigrationsContext(ctx)
 		if err != nil {
-			return drv.QueryError(parsed.Down, err)
-		} else if db.Verbose {
-			db.printVerbose(result)
+			return err
 		}
 
-		// remove migration record
-		return drv.DeleteMigration(tx, latest.Version)
+		if len(migrations) == 0 {
+			return ErrNoMigrationFiles
+		}
+
+		if !allowApplied {
+			for _, migration := range migrations {
+				if migration.Applied && !migration.Repeatable {
+					return fmt.Errorf("%w: %s", ErrVerifyMigrated, migration.FileName)
+				}
+			}
+		}
+
+		pendingMigrations, err := db.pendingMigrations(migrations)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range pendingMigrations {
+			// repeatable migrations can't be rolled back
+			if migration.Repeatable {
+				continue
+			}
+
+			if db.DryRun {
+				fmt.Fprintf(db.Log, "-- %s would be applied, rolled back and applied again\n", migration.FileName)
+				continue
+			}
+
+			// squash migrations can't be rolled back, but later migrations depend on them
+			squashed, err := migration.squashedChecksum()
+			if err != nil {
+				return err
+			}
+			if squashed != "" {
+				if err := db.applyMigration(ctx, drv, sqlDB, migration); err != nil {
+					return err
+				}
+				changed = true
+				continue
+			}
+
+			before, err := drv.DumpSchemaContext(ctx, sqlDB)
+			if err != nil {
+				return err
+			}
+
+			if err := db.applyMigration(ctx, drv, sqlDB, migration); err != nil {
+				return err
+			}
+			changed = true
+			if err := db.rollbackMigration(ctx, drv, sqlDB, migration); err != nil {
+				return err
+			}
+
+			after, err := drv.DumpSchemaContext(ctx, sqlDB)
+			if err != nil {
+				return err
+			}
+
+			// objects left behind would usually prevent applying the migration again
+			if string(before) != string(after) {
+				err := db.printDiff(before, after, "before "+migration.FileName, "after rolling back")
+				if err != nil {
+					return err
+				}
+				return fmt.Errorf("%w: %s", ErrRollbackMismatch, migration.FileName)
+			}
+
+			if err := db.applyMigration(ctx, drv, sqlDB, migration); err != nil {
+				return err
+			}
+			verified++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	if parsed.DownOptions.Transaction() {
-		// begin transaction
-		err = doTransaction(sqlDB, execMigration)
-	} else {
-		// run outside of transaction
-		err = execMigration(sqlDB)
+	// automatically update schema file, silence errors
+	if db.AutoDumpSchema && changed {
+		_ = db.DumpSchemaContext(ctx)
+	}
+
+	if !db.DryRun {
+		fmt.Fprintf(db.Log, "Verified rollbacks of %d migrations\n", verified)
+	}
+
+	return nil
+}
+
+// Redo rolls back the most recent migration and applies it again
+func (db *DB) Redo() error {
+	return db.RedoContext(context.Background())
+}
+
+// RedoContext is like Redo, but aborts when the context is done
+func (db *DB) RedoContext(ctx context.Context) error {
+	return db.RedoStepsContext(ctx, 1)
+}
+
+// RedoSteps rolls back the specified number of most recent migrations, and
+// applies them again. The schema file is only written once, at the end.
+func (db *DB) RedoSteps(steps int) error {
+	return db.RedoStepsContext(context.Background(), steps)
+}
+
+// RedoStepsContext is like RedoSteps, but aborts when the context is done
+func (db *DB) RedoStepsContext(ctx context.Context, steps int) error {
+	if steps < 1 {
+		return ErrInvalidSteps
+	}
+
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
 	}
 
+	err = db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		migrations, err := db.FindMigrationsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		redoMigrations, err := latestApplied(migrations, steps)
+		if err != nil {
+			return err
+		}
+
+		for i, migration := range redoMigrations {
+			if err := db.rollbackMigration(ctx, drv, sqlDB, migration); err != nil {
+				if len(redoMigrations) == 1 {
+					return err
+				}
+
+				return fmt.Errorf("rolled back %d of %d migrations, failed on `%s`: %w",
+					i, len(redoMigrations), migration.FileName, err)
+			}
+		}
+
+		// apply again in the original order
+		for i := len(redoMigrations) - 1; i >= 0; i-- {
+			if err := db.applyMigration(ctx, drv, sqlDB, redoMigrations[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
 	// automatically update schema file, silence errors
-	if db.AutoDumpSchema {
-		_ = db.DumpSchema()
+	if db.AutoDumpSchema && !db.DryRun {
+		_ = db.DumpSchemaContext(ctx)
 	}
 
 	return nil
 }
 
+// rollbackMigration runs the down block of a single migration and removes its record
+func (db *DB) rollbackMigration(ctx context.Context, drv contextDriver, sqlDB *sql.DB, migration Migration) error {
+	fmt.Fprintf(db.Log, "Rolling back: %s\n", migration.FileName)
+
+	if migration.goMigration != nil && migration.goMigration.Down == nil {
+		return fmt.Errorf("%w: %s", ErrGoMigrationNoDown, migration.FileName)
+	}
+
+	squashed, err := migration.squashedChecksum()
+	if err != nil {
+		return err
+	}
+	if squashed != "" {
+		return fmt.Errorf("%w: %s", ErrSquashRollback, migration.FileName)
+	}
+
+	parsed, err := migration.Parse()
+	if err != nil {
+		return err
+	}
+
+	execMigration := func(tx dbutil.Transaction) error {
+		// rollback migration
+		if migration.goMigration != nil {
+			if err := migration.goMigration.Down(ctx, tx); err != nil {
+				return err
+			}
+		} else {
+			result, err := tx.ExecContext(ctx, parsed.Down)
+			if err != nil {
+				return drv.QueryError(parsed.Down, contextError(ctx, err))
+			} else if db.Verbose {
+				db.printVerbose(result)
+			}
+		}
+
+		// remove migration record
+		return drv.DeleteMigrationContext(ctx, tx, migration.Version)
+	}
+
+	if db.DryRun {
+		return db.dryRun(sqlDB, parsed.DownOptions.Transaction(), execMigration)
+	}
+
+	if parsed.DownOptions.Transaction() {
+		// begin transaction
+		return doTransaction(ctx, sqlDB, execMigration)
+	}
+
+	// run outside of transaction
+	return execMigration(sqlDB)
+}
+
 // Status shows the status of all migrations
 func (db *DB) Status(quiet bool) (int, error) {
-	results, err := db.FindMigrations()
+	return db.StatusContext(context.Background(), quiet)
+}
+
+// StatusContext is like Status, but aborts when the context is done
+func (db *DB) StatusContext(ctx context.Context, quiet bool) (int, error) {
+	report, err := db.StatusReportContext(ctx)
 	if err != nil {
 		return -1, err
 	}
 
-	var totalApplied int
-	var line string
+	if !quiet {
+		for _, res := range report.Migrations {
+			line := fmt.Sprintf("[ ] %s", res.Filename)
+			if res.Applied {
+				line = fmt.Sprintf("[X] %s", res.Filename)
+			}
+			if res.Modified {
+				line += " (modified)"
+			}
+			fmt.Fprintln(db.Log, line)
+		}
+
+		fmt.Fprintln(db.Log)
+		fmt.Fprintf(db.Log, "Applied: %d\n", report.Applied)
+		fmt.Fprintf(db.Log, "Pending: %d\n", report.Pending)
+		if report.Modified > 0 {
+			fmt.Fprintf(db.Log, "Modified: %d\n", report.Modified)
+		}
+	}
+
+	if report.Modified > 0 && db.StrictChecksums {
+		return report.Pending, ErrMigrationModified
+	}
+
+	return report.Pending, nil
+}
+
+// StatusReport returns the status of all migrations
+func (db *DB) StatusReport() (*StatusReport, error) {
+	return db.StatusReportContext(context.Background())
+}
+
+// StatusReportContext is like StatusReport, but aborts when the context is done
+func (db *DB) StatusReportContext(ctx context.Context) (*StatusReport, error) {
+	migrations, err := db.FindMigrationsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &StatusReport{Migrations: []StatusResult{}}
+	for _, migration := range migrations {
+		res := StatusResult{
+			Version:    migration.Version,
+			Filename:   migration.FileName,
+			Directory:  migrationDir(migration),
+			Applied:    migration.Applied,
+			Modified:   migration.Modified,
+			Repeatable: migration.Repeatable,
+		}
+		if !migration.AppliedAt.IsZero() {
+			appliedAt := migration.AppliedAt
+			res.AppliedAt = &appliedAt
+		}
 
-	for _, res := range results {
 		if res.Applied {
-			line = fmt.Sprintf("[X] %s", res.FileName)
-			totalApplied++
+			report.Applied++
 		} else {
-			line = fmt.Sprintf("[ ] %s", res.FileName)
+			report.Pending++
 		}
-		if !quiet {
-			fmt.Fprintln(db.Log, line)
+		if res.Modified {
+			report.Modified++
 		}
+
+		report.Migrations = append(report.Migrations, res)
 	}
 
-	totalPending := len(results) - totalApplied
-	if !quiet {
-		fmt.Fprintln(db.Log)
-		fmt.Fprintf(db.Log, "Applied: %d\n", totalApplied)
-		fmt.Fprintf(db.Log, "Pending: %d\n", totalPending)
+	return report, nil
+}
+
+// migrationDir returns the directory of a migration file, or an empty string
+// for Go migrations
+func migrationDir(migration Migration) string {
+	if migration.goMigration != nil {
+		return ""
+	}
+
+	return filepath.Dir(migration.FilePath)
+}
+
+// Repair updates the recorded checksums of applied migrations to match the
+// current migration files, after they have been intentionally modified
+func (db *DB) Repair() error {
+	return db.RepairContext(context.Background())
+}
+
+// RepairContext is like Repair, but aborts when the context is done
+func (db *DB) RepairContext(ctx context.Context) error {
+	drv, err := db.driver(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := db.checkDryRunDatabase(ctx, drv); err != nil {
+		return err
 	}
 
-	return totalPending, nil
+	return db.withMigrationLock(ctx, drv, func(sqlDB *sql.DB) error {
+		records, err := drv.SelectMigrationRecordsContext(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+
+		migrations, err := db.FindMigrationsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			// modified repeatable migrations are applied again instead
+			record, ok := records[migration.Version]
+			if !ok || migration.Repeatable {
+				continue
+			}
+
+			checksum, err := migration.Checksum()
+			if err != nil {
+				return err
+			}
+			if checksum == record.Checksum {
+				continue
+			}
+
+			fmt.Fprintf(db.Log, "Repairing: %s\n", migration.FileName)
+			if db.DryRun {
+				continue
+			}
+			if err := drv.UpdateMigrationChecksumContext(ctx, sqlDB, migration.Version, checksum); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
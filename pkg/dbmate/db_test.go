@@ -1,6 +1,10 @@
 package dbmate_test
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -12,7 +16,7 @@ import (
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/mysql"
 	_ "github.com/amacneil/dbmate/v2/pkg/driver/postgres"
-	_ "github.com/amacneil/dbmate/v2/pkg/driver/sqlite"
+	"github.com/amacneil/dbmate/v2/pkg/driver/sqlite"
 
 	"github.com/stretchr/testify/require"
 	"github.com/zenizh/go-capturer"
@@ -38,6 +42,16 @@ func newTestDB(t *testing.T, u *url.URL) *dbmate.DB {
 	return db
 }
 
+// selectMigrationRecords returns the migration records of a driver which records them
+func selectMigrationRecords(t *testing.T, drv dbmate.Driver, sqlDB *sql.DB) map[string]dbmate.MigrationRecord {
+	recorder, ok := drv.(dbmate.MigrationRecorder)
+	require.True(t, ok)
+	records, err := recorder.SelectMigrationRecordsContext(context.Background(), sqlDB)
+	require.NoError(t, err)
+
+	return records
+}
+
 func TestNew(t *testing.T) {
 	db := dbmate.New(dbutil.MustParseURL("foo:test"))
 	require.True(t, db.AutoDumpSchema)
@@ -175,6 +189,140 @@ func TestAutoDumpSchema(t *testing.T) {
 	require.Contains(t, string(schema), "-- PostgreSQL database dump")
 }
 
+func TestCheckSchema(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+
+			dir, err := os.MkdirTemp("", "dbmate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			db.SchemaFile = filepath.Join(dir, "schema.sql")
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// checking an unmigrated database doesn't create the migrations table
+			err = db.CheckSchema()
+			require.ErrorIs(t, err, dbmate.ErrNoMigrationsTable)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+			exists, err := drv.MigrationsTableExists(sqlDB)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			// missing schema file is out of date
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.CheckSchema()
+			require.ErrorIs(t, err, dbmate.ErrSchemaOutOfDate)
+			require.Contains(t, out.String(), "--- "+db.SchemaFile+"\n+++ database\n")
+			_, err = os.Stat(db.SchemaFile)
+			require.True(t, os.IsNotExist(err))
+
+			// freshly dumped schema is up to date
+			err = db.DumpSchema()
+			require.NoError(t, err)
+			out.Reset()
+			err = db.CheckSchema()
+			require.NoError(t, err)
+			require.Contains(t, out.String(), "Schema is up to date")
+
+			// modified schema file is reported as a diff, and left untouched
+			schema, err := os.ReadFile(db.SchemaFile)
+			require.NoError(t, err)
+			modified := append([]byte("-- stale\n"), schema...)
+			err = os.WriteFile(db.SchemaFile, modified, 0o644)
+			require.NoError(t, err)
+			out.Reset()
+			err = db.CheckSchema()
+			require.ErrorIs(t, err, dbmate.ErrSchemaOutOfDate)
+			require.Contains(t, out.String(), "\n--- stale\n")
+			contents, err := os.ReadFile(db.SchemaFile)
+			require.NoError(t, err)
+			require.Equal(t, modified, contents)
+		})
+	}
+}
+func TestDrift(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			dir, err := os.MkdirTemp("", "dbmate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			db.SchemaFile = filepath.Join(dir, "schema.sql")
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// drift of an unmigrated database doesn't create the migrations table
+			err = os.WriteFile(db.SchemaFile, []byte{}, 0o644)
+			require.NoError(t, err)
+			_, err = db.Drift()
+			require.ErrorIs(t, err, dbmate.ErrNoMigrationsTable)
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+			exists, err := drv.MigrationsTableExists(sqlDB)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			// migrate database, then dump schema
+			err = db.Migrate()
+			require.NoError(t, err)
+			err = db.DumpSchema()
+			require.NoError(t, err)
+
+			// no drift
+			var out bytes.Buffer
+			db.Log = &out
+			changes, err := db.Drift()
+			require.NoError(t, err)
+			require.Empty(t, changes)
+			require.Contains(t, out.String(), "No schema drift")
+
+			// applying a migration only changes the migrations data, which is ignored
+			schema, err := os.ReadFile(db.SchemaFile)
+			require.NoError(t, err)
+			schema = bytes.Replace(schema, []byte("20200227231541"), []byte("20200227231542"), 1)
+			err = os.WriteFile(db.SchemaFile, schema, 0o644)
+			require.NoError(t, err)
+			changes, err = db.Drift()
+			require.NoError(t, err)
+			require.Empty(t, changes)
+
+			// a table created by hand is reported
+			_, err = sqlDB.Exec("create table hotfix (id int primary key)")
+			require.NoError(t, err)
+
+			out.Reset()
+			changes, err = db.Drift()
+			require.NoError(t, err)
+			require.Len(t, changes, 1)
+			require.Equal(t, "added", changes[0].Change)
+			require.Equal(t, "table", changes[0].Kind)
+			require.Contains(t, changes[0].Name, "hotfix")
+			require.Contains(t, out.String(), "added table ")
+		})
+	}
+}
+
 func TestLoadSchema(t *testing.T) {
 	u := dbutil.MustParseURL(os.Getenv("POSTGRES_TEST_URL"))
 	db := newTestDB(t, u)
@@ -240,6 +388,34 @@ func TestLoadSchema(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// schemaLoaderDriver loads schema files itself, like the mysql driver
+type schemaLoaderDriver struct {
+	dbmate.Driver
+	loaded *string
+}
+
+func (drv schemaLoaderDriver) LoadSchemaContext(_ context.Context, _ *sql.DB, schema string) error {
+	*drv.loaded = schema
+	return nil
+}
+
+func TestLoadSchemaLoader(t *testing.T) {
+	var loaded string
+	dbmate.RegisterDriver(func(config dbmate.DriverConfig) dbmate.Driver {
+		return schemaLoaderDriver{sqlite.NewDriver(config), &loaded}
+	}, "loadersqlite")
+
+	db := newTestDB(t, dbutil.MustParseURL("loadersqlite:"+filepath.Join(t.TempDir(), "loader.sqlite3")))
+	db.SchemaFile = filepath.Join(t.TempDir(), "schema.sql")
+	err := os.WriteFile(db.SchemaFile, []byte("DELIMITER ;;\nselect 1 ;;\nDELIMITER ;\n"), 0o644)
+	require.NoError(t, err)
+
+	// the schema file is passed to the driver rather than executed
+	err = db.LoadSchema()
+	require.NoError(t, err)
+	require.Equal(t, "DELIMITER ;;\nselect 1 ;;\nDELIMITER ;\n", loaded)
+}
+
 func checkWaitCalled(t *testing.T, u *url.URL, command func() error) {
 	oldHost := u.Host
 	u.Host = "postgres:404"
@@ -301,6 +477,122 @@ func testWaitBefore(t *testing.T, verbose bool) {
 	checkWaitCalled(t, u, db.LoadSchema)
 }
 
+// unreachableDriver is a driver which never becomes available, and does not
+// implement dbmate.DriverContext
+type unreachableDriver struct {
+	dbmate.Driver
+}
+
+func (drv unreachableDriver) Ping() error {
+	return errors.New("connection refused")
+}
+
+func TestWaitContext(t *testing.T) {
+	dbmate.RegisterDriver(func(dbmate.DriverConfig) dbmate.Driver {
+		return unreachableDriver{}
+	}, "unreachable")
+
+	db := dbmate.New(dbutil.MustParseURL("unreachable://host/db"))
+	db.Log = &bytes.Buffer{}
+	db.WaitInterval = time.Millisecond
+	db.WaitTimeout = time.Hour
+
+	// waiting stops when the context is done, rather than at the wait timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := db.WaitContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDriverContext(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			_, ok := drv.(dbmate.DriverContext)
+			require.True(t, ok)
+			_, ok = drv.(dbmate.MigrationRecorder)
+			require.True(t, ok)
+		})
+	}
+}
+
+func TestMigrateContextCanceled(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// nothing is applied with a canceled context
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err = db.MigrateContext(ctx)
+			require.ErrorIs(t, err, context.Canceled)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			exists, err := drv.MigrationsTableExists(sqlDB)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			err = db.Baseline("123", false)
+			require.ErrorIs(t, err, dbmate.ErrMigrationNotFound)
+		})
+	}
+}
+
+func TestMigrateContextAbortsStatement(t *testing.T) {
+	u := dbutil.MustParseURL(os.Getenv("SQLITE_TEST_URL"))
+	db := newTestDB(t, u)
+	drv, err := db.Driver()
+	require.NoError(t, err)
+
+	// drop and recreate database
+	err = db.Drop()
+	require.NoError(t, err)
+	err = db.Create()
+	require.NoError(t, err)
+
+	db.FS = fstest.MapFS{
+		"db/migrations/001_slow.sql": {
+			Data: []byte("-- migrate:up\n" +
+				"create table slow as with recursive c(x) as (select 1 union all select x + 1 from c) " +
+				"select x from c limit 100000000000;\n" +
+				"-- migrate:down\n"),
+		},
+	}
+
+	// deadline interrupts the running statement
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = db.MigrateContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	var queryErr *dbmate.QueryError
+	require.ErrorAs(t, err, &queryErr)
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	// migration was rolled back
+	sqlDB, err := drv.Open()
+	require.NoError(t, err)
+	defer dbutil.MustClose(sqlDB)
+
+	appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+	require.NoError(t, err)
+	require.Empty(t, appliedMigrations)
+}
+
 func TestWaitBefore(t *testing.T) {
 	testWaitBefore(t, false)
 }
@@ -359,45 +651,975 @@ func TestMigrate(t *testing.T) {
 			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
 			require.NoError(t, err)
 			require.Equal(t, 1, count)
+
+			// migration details were recorded
+			var checksum, dbmateVersion string
+			err = sqlDB.QueryRow("select checksum, dbmate_version from schema_migrations where version = '20151129054053'").
+				Scan(&checksum, &dbmateVersion)
+			require.NoError(t, err)
+			require.Len(t, checksum, 64)
+			require.Equal(t, dbmate.Version, dbmateVersion)
+		})
+	}
+}
+
+func TestMigrateWithConnection(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			connDB := dbmate.NewWithConnection(sqlDB, u.Scheme)
+			require.False(t, connDB.AutoDumpSchema)
+			require.Same(t, sqlDB, connDB.Connection)
+
+			// creating or dropping the database requires a url
+			require.ErrorIs(t, connDB.Create(), dbmate.ErrExistingConnection)
+			require.ErrorIs(t, connDB.Drop(), dbmate.ErrExistingConnection)
+
+			// migrate
+			err = connDB.CreateAndMigrate()
+			require.NoError(t, err)
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+
+			// status
+			connDB.Log = &bytes.Buffer{}
+			pending, err := connDB.Status(false)
+			require.NoError(t, err)
+			require.Equal(t, 0, pending)
+
+			// rollback
+			err = connDB.Rollback()
+			require.NoError(t, err)
+
+			appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20151129054053": true}, appliedMigrations)
+
+			// the connection is left open for the caller
+			err = sqlDB.Ping()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestMigrateTo(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// unknown version should return error
+			err = db.MigrateTo("20000101000000")
+			require.EqualError(t, err, "can't find migration file: 20000101000000")
+
+			// migrate to first version
+			err = db.MigrateTo("20151129054053")
+			require.NoError(t, err)
+
+			// verify results
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			// only first migration applied
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20151129054053": true}, appliedMigrations)
+
+			// migrating to an applied version is a no-op
+			err = db.MigrateTo("20151129054053")
+			require.NoError(t, err)
+
+			// migrate to second version
+			err = db.MigrateTo("20200227231541")
+			require.NoError(t, err)
+
+			appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+		})
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// version is required
+			err = db.Baseline("", false)
+			require.ErrorIs(t, err, dbmate.ErrNoMigrationVersion)
+
+			// dry run records nothing
+			var out bytes.Buffer
+			db.Log = &out
+			db.DryRun = true
+			err = db.Baseline("20151129054053", false)
+			require.NoError(t, err)
+			require.Contains(t, out.String(), "BEGIN;\nBaselining: 20151129054053_test_migration.sql\ninsert into ")
+			db.DryRun = false
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			exists, err := drv.MigrationsTableExists(sqlDB)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			// baseline records migrations without running them
+			out.Reset()
+			err = db.Baseline("20151129054053", false)
+			require.NoError(t, err)
+			require.Equal(t, "Baselining: 20151129054053_test_migration.sql\n", out.String())
+
+			records := selectMigrationRecords(t, drv, sqlDB)
+			require.Len(t, records, 1)
+			require.Len(t, records["20151129054053"].Checksum, 64)
+
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.Error(t, err)
+
+			// migrate runs the remaining migrations
+			out.Reset()
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Equal(t, "Applying: 20200227231541_test_posts.sql\n", out.String())
+		})
+	}
+}
+
+func TestBaselineLoadSchema(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			dir, err := os.MkdirTemp("", "dbmate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			db.SchemaFile = filepath.Join(dir, "schema.sql")
+
+			// schema of an existing database, without migrations data
+			err = os.WriteFile(db.SchemaFile, []byte("create table users (id int, name varchar(255));\n"), 0o644)
+			require.NoError(t, err)
+
+			// baseline a new database from the schema file
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+			err = db.Baseline("20151129054053", true)
+			require.NoError(t, err)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+
+			records := selectMigrationRecords(t, drv, sqlDB)
+			require.Len(t, records, 1)
+			require.Contains(t, records, "20151129054053")
+
+			// migrations recorded by the schema file are not recorded again
+			err = db.DumpSchema()
+			require.NoError(t, err)
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.Baseline("20200227231541", true)
+			require.NoError(t, err)
+			require.NotContains(t, out.String(), "Baselining: 20151129054053_test_migration.sql")
+			require.Contains(t, out.String(), "Baselining: 20200227231541_test_posts.sql")
+		})
+	}
+}
+
+func TestMarkAppliedPending(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// version must exist on disk
+			err = db.MarkApplied("")
+			require.ErrorIs(t, err, dbmate.ErrNoMigrationVersion)
+			err = db.MarkApplied("123")
+			require.ErrorIs(t, err, dbmate.ErrMigrationNotFound)
+			err = db.MarkPending("123")
+			require.ErrorIs(t, err, dbmate.ErrMigrationNotFound)
+
+			// mark applied records the migration without running it
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.MarkApplied("20151129054053")
+			require.NoError(t, err)
+			require.Equal(t, "Marking as applied: 20151129054053_test_migration.sql\n", out.String())
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20151129054053": true}, appliedMigrations)
+
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.Error(t, err)
+
+			err = db.MarkApplied("20151129054053")
+			require.ErrorIs(t, err, dbmate.ErrMigrationApplied)
+
+			// mark pending removes the record without rolling back
+			out.Reset()
+			err = db.MarkPending("20151129054053")
+			require.NoError(t, err)
+			require.Equal(t, "Marking as pending: 20151129054053_test_migration.sql\n", out.String())
+
+			appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Empty(t, appliedMigrations)
+
+			err = db.MarkPending("20151129054053")
+			require.ErrorIs(t, err, dbmate.ErrMigrationNotApplied)
+		})
+	}
+}
+
+func TestSquash(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// copy the migrations, since squashing moves them
+			dir, err := os.MkdirTemp("", "dbmate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			for _, name := range []string{"20151129054053_test_migration.sql", "20200227231541_test_posts.sql"} {
+				contents, err := os.ReadFile(filepath.Join("db/migrations", name))
+				require.NoError(t, err)
+				err = os.WriteFile(filepath.Join(dir, name), contents, 0o644)
+				require.NoError(t, err)
+			}
+			db.MigrationsDir = []string{dir}
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// the database must have exactly the squashed migrations applied
+			err = db.Squash("")
+			require.ErrorIs(t, err, dbmate.ErrNoMigrationVersion)
+			err = db.Squash("20151129054053")
+			require.ErrorIs(t, err, dbmate.ErrNoMigrationFiles)
+			err = db.Squash("20200227231542")
+			require.ErrorIs(t, err, dbmate.ErrMigrationNotApplied)
+			err = db.Migrate()
+			require.NoError(t, err)
+			err = db.Squash("20200227231541")
+			require.ErrorIs(t, err, dbmate.ErrSquashLaterApplied)
+
+			// objects created by repeatable migrations can't be squashed
+			repeatable := filepath.Join(dir, "R__post_ids.sql")
+			err = os.WriteFile(repeatable, []byte("create view post_ids as select id from posts;\n"), 0o644)
+			require.NoError(t, err)
+			err = db.Migrate()
+			require.NoError(t, err)
+			err = db.Squash("20200227231542")
+			require.ErrorIs(t, err, dbmate.ErrSquashRepeatable)
+			require.EqualError(t, err, "can't squash: a repeatable migration is applied: R__post_ids.sql")
+
+			// repeatable migrations which are not applied are left alone
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+			err = db.MigrateTo("20200227231541")
+			require.NoError(t, err)
+
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.Squash("20200227231542")
+			require.NoError(t, err)
+			require.Equal(t, "Warning: 20151129054053_test_migration.sql modifies data, "+
+				"which is not included in the squash migration\n"+
+				"Archiving: "+filepath.Join(dir, "20151129054053_test_migration.sql")+"\n"+
+				"Archiving: "+filepath.Join(dir, "20200227231541_test_posts.sql")+"\n"+
+				"Creating migration: "+filepath.Join(dir, "20200227231541_squash.sql")+"\n", out.String())
+
+			_, err = os.Stat(filepath.Join(dir, "archive", "20151129054053_test_migration.sql"))
+			require.NoError(t, err)
+			_, err = os.Stat(filepath.Join(dir, "archive", "20200227231541_test_posts.sql"))
+			require.NoError(t, err)
+
+			// the database which applied the squashed migrations treats the squash as applied
+			migrations, err := db.FindMigrations()
+			require.NoError(t, err)
+			require.Len(t, migrations, 2)
+			require.Equal(t, "20200227231541_squash.sql", migrations[0].FileName)
+			require.True(t, migrations[0].Applied)
+			require.False(t, migrations[0].Modified)
+			require.Equal(t, "R__post_ids.sql", migrations[1].FileName)
+			require.False(t, migrations[1].Applied)
+
+			// the squash migration can't be rolled back
+			err = db.Rollback()
+			require.ErrorIs(t, err, dbmate.ErrSquashRollback)
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.True(t, migrations[0].Applied)
+
+			// a new database is created from the squash migration, followed by
+			// the repeatable migrations
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			var count int
+			err = sqlDB.QueryRow("select count(*) from post_ids").Scan(&count)
+			require.NoError(t, err)
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "R__post_ids": true}, appliedMigrations)
+		})
+	}
+}
+
+// legacyDriver only implements the Driver interface, like drivers written
+// before the optional interfaces were added
+type legacyDriver struct {
+	dbmate.Driver
+}
+
+func TestMigrateLegacyDriver(t *testing.T) {
+	dbmate.RegisterDriver(func(config dbmate.DriverConfig) dbmate.Driver {
+		return legacyDriver{sqlite.NewDriver(config)}
+	}, "legacysqlite")
+
+	db := newTestDB(t, dbutil.MustParseURL("legacysqlite:"+filepath.Join(t.TempDir(), "legacy.sqlite3")))
+	drv, err := db.Driver()
+	require.NoError(t, err)
+	_, ok := drv.(dbmate.MigrationRecorder)
+	require.False(t, ok)
+
+	// migrations are recorded by version only
+	err = db.CreateAndMigrate()
+	require.NoError(t, err)
+
+	migrations, err := db.FindMigrations()
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	for _, migration := range migrations {
+		require.True(t, migration.Applied)
+		require.False(t, migration.Modified)
+	}
+
+	// checksums can't be repaired
+	err = db.Repair()
+	require.ErrorIs(t, err, dbmate.ErrChecksumsUnsupported)
+
+	err = db.Rollback()
+	require.NoError(t, err)
+
+	sqlDB, err := drv.Open()
+	require.NoError(t, err)
+	defer dbutil.MustClose(sqlDB)
+
+	appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"20151129054053": true}, appliedMigrations)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// dry run prints statements
+			var buf bytes.Buffer
+			db.Log = &buf
+			db.DryRun = true
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			output := buf.String()
+			require.Contains(t, output, "-- migrations table schema_migrations does not exist and would be created\n")
+			require.Contains(t, output, "Applying: 20151129054053_test_migration.sql\nBEGIN;\n-- migrate:up\ncreate table users (")
+			require.Contains(t, output, "insert into users (id, name) values (1, 'alice');\n")
+			require.Contains(t, output, "Applying: 20200227231541_test_posts.sql\nBEGIN;\n-- migrate:up\ncreate table posts (")
+			require.Regexp(t, "insert into .*schema_migrations.* -- args: '20200227231541', '[^']+', 0, '[0-9a-f]{64}', '"+dbmate.Version+"'\nCOMMIT;\n", output)
+
+			// nothing was applied
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			exists, err := drv.MigrationsTableExists(sqlDB)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NotNil(t, err)
+			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+		})
+	}
+}
+
+func TestMigrateDryRunTemplate(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			db.FS = fstest.MapFS{
+				"db/migrations/001_create_users.sql": {
+					Data: []byte("-- migrate:up template:true\ncreate table ${table} (id int);\n" +
+						"-- migrate:down\ndrop table ${table};\n"),
+				},
+			}
+			db.TemplateVars = map[string]string{"table": "accounts"}
+
+			// drop and recreate database
+			err := db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// dry run prints the substituted statements
+			var buf bytes.Buffer
+			db.Log = &buf
+			db.DryRun = true
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Contains(t, buf.String(), "create table accounts (id int);")
+
+			// undefined variables fail before anything is applied
+			db.TemplateVars = nil
+			err = db.Migrate()
+			require.ErrorIs(t, err, dbmate.ErrTemplateUndefined)
+		})
+	}
+}
+
+func TestMigrateDryRunMissingDatabase(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			err = db.Drop()
+			require.NoError(t, err)
+
+			db.DryRun = true
+			err = db.CreateAndMigrate()
+			require.ErrorIs(t, err, dbmate.ErrDryRunNoDatabase)
+
+			// database was not created
+			exists, err := drv.DatabaseExists()
+			require.NoError(t, err)
+			require.False(t, exists)
+		})
+	}
+}
+
+func TestMigrateLock(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			// hold the migration lock from another connection
+			locker, ok := drv.(dbmate.Locker)
+			require.True(t, ok)
+			unlock, err := locker.Lock(context.Background(), sqlDB)
+			require.NoError(t, err)
+
+			// migrate times out waiting for the lock
+			db.LockTimeout = 200 * time.Millisecond
+			err = db.Migrate()
+			require.ErrorIs(t, err, dbmate.ErrAcquireLock)
+
+			exists, err := drv.MigrationsTableExists(sqlDB)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			// migrate succeeds once the lock is released
+			err = unlock()
+			require.NoError(t, err)
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+
+			// rollback waits for the lock too
+			unlock, err = locker.Lock(context.Background(), sqlDB)
+			require.NoError(t, err)
+			err = db.Rollback()
+			require.ErrorIs(t, err, dbmate.ErrAcquireLock)
+			err = unlock()
+			require.NoError(t, err)
+			err = db.Rollback()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestUp(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop database
+			err = db.Drop()
+			require.NoError(t, err)
+
+			// create and migrate
+			err = db.CreateAndMigrate()
+			require.NoError(t, err)
+
+			// verify results
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			// check applied migrations
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+
+			// users table have records
+			count := 0
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and create database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// rollback should return error
+			err = db.Rollback()
+			require.Error(t, err)
+			require.ErrorContains(t, err, "can't rollback: no migrations have been applied")
+
+			// migrate database
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			// verify migration
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			// check applied migrations
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+
+			// users and posts tables have been created
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+			err = sqlDB.QueryRow("select count(*) from posts").Scan(&count)
+			require.NoError(t, err)
+
+			// rollback second migration
+			err = db.Rollback()
+			require.NoError(t, err)
+
+			// one migration remaining
+			err = sqlDB.QueryRow("select count(*) from schema_migrations").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+
+			// posts table was deleted
+			err = sqlDB.QueryRow("select count(*) from posts").Scan(&count)
+			require.NotNil(t, err)
+			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+
+			// users table still exists
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.Nil(t, err)
+
+			// rollback first migration
+			err = db.Rollback()
+			require.NoError(t, err)
+
+			// no migrations remaining
+			err = sqlDB.QueryRow("select count(*) from schema_migrations").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 0, count)
+
+			// posts table was deleted
+			err = sqlDB.QueryRow("select count(*) from posts").Scan(&count)
+			require.NotNil(t, err)
+			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+
+			// users table was deleted
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NotNil(t, err)
+			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+		})
+	}
+}
+
+func TestRollbackDryRun(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop, recreate and migrate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			// dry run prints statements
+			var buf bytes.Buffer
+			db.Log = &buf
+			db.DryRun = true
+			err = db.RollbackSteps(2)
+			require.NoError(t, err)
+
+			output := buf.String()
+			require.Contains(t, output, "Rolling back: 20200227231541_test_posts.sql\nBEGIN;\n-- migrate:down\ndrop table posts;\n")
+			require.Contains(t, output, "Rolling back: 20151129054053_test_migration.sql\nBEGIN;\n-- migrate:down\ndrop table users;\n")
+			require.Regexp(t, "(delete from|insert into) .*schema_migrations.* -- args: '20151129054053'.*\nCOMMIT;\n", output)
+
+			// nothing was rolled back
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+		})
+	}
+}
+
+func TestRollbackSteps(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and create database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// migrate database
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			// invalid steps should return error
+			err = db.RollbackSteps(0)
+			require.EqualError(t, err, "number of steps must be greater than zero")
+
+			// too many steps should return error without rolling back
+			err = db.RollbackSteps(3)
+			require.EqualError(t, err, "can't rollback 3 migrations: only 2 have been applied")
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Len(t, appliedMigrations, 2)
+
+			// rollback both migrations
+			err = db.RollbackSteps(2)
+			require.NoError(t, err)
+
+			appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Len(t, appliedMigrations, 0)
+
+			// users table was deleted
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NotNil(t, err)
+			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+		})
+	}
+}
+
+func TestRedo(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			dir, err := os.MkdirTemp("", "dbmate")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			db.SchemaFile = filepath.Join(dir, "schema.sql")
+
+			// drop and create database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// nothing to redo
+			err = db.Redo()
+			require.ErrorIs(t, err, dbmate.ErrNoRollback)
+
+			// migrate database
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			// invalid steps should return error
+			err = db.RedoSteps(0)
+			require.EqualError(t, err, "number of steps must be greater than zero")
+			err = db.RedoSteps(3)
+			require.EqualError(t, err, "can't rollback 3 migrations: only 2 have been applied")
+
+			_, err = sqlDB.Exec("insert into users (id, name) values (2, 'bob')")
+			require.NoError(t, err)
+
+			// redo both migrations, dumping the schema once
+			db.AutoDumpSchema = true
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.RedoSteps(2)
+			require.NoError(t, err)
+			require.Equal(t, "Rolling back: 20200227231541_test_posts.sql\n"+
+				"Rolling back: 20151129054053_test_migration.sql\n"+
+				"Applying: 20151129054053_test_migration.sql\n"+
+				"Applying: 20200227231541_test_posts.sql\n"+
+				"Writing: "+db.SchemaFile+"\n", out.String())
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Len(t, appliedMigrations, 2)
+
+			// users table was recreated
+			var count int
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
 		})
 	}
 }
 
-func TestUp(t *testing.T) {
+func TestVerifyRollbacks(t *testing.T) {
 	for _, u := range testURLs() {
 		t.Run(u.Scheme, func(t *testing.T) {
 			db := newTestDB(t, u)
 			drv, err := db.Driver()
 			require.NoError(t, err)
 
-			// drop database
-			err = db.Drop()
+			dir, err := os.MkdirTemp("", "dbmate")
 			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			db.MigrationsDir = []string{dir}
 
-			// create and migrate
-			err = db.CreateAndMigrate()
+			err = os.WriteFile(filepath.Join(dir, "001_create_users.sql"), []byte(
+				"-- migrate:up\ncreate table users (id integer);\n-- migrate:down\ndrop table users;\n"), 0o644)
+			require.NoError(t, err)
+			err = os.WriteFile(filepath.Join(dir, "002_create_posts.sql"), []byte(
+				"-- migrate:up\ncreate table posts (id integer);\ncreate table comments (id integer);\n"+
+					"-- migrate:down\ndrop table posts;\n"), 0o644)
 			require.NoError(t, err)
 
-			// verify results
+			// drop and create database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// dry run only lists the migrations which would be verified
+			var out bytes.Buffer
+			db.Log = &out
+			db.DryRun = true
+			err = db.VerifyRollbacks(false)
+			require.NoError(t, err)
+			require.Equal(t, "-- migrations table schema_migrations does not exist and would be created\n"+
+				"-- 001_create_users.sql would be applied, rolled back and applied again\n"+
+				"-- 002_create_posts.sql would be applied, rolled back and applied again\n", out.String())
+			db.DryRun = false
+
+			// the down block of the second migration doesn't drop comments
+			db.AutoDumpSchema = true
+			db.SchemaFile = filepath.Join(dir, "schema.sql")
+			out.Reset()
+			err = db.VerifyRollbacks(false)
+			require.ErrorIs(t, err, dbmate.ErrRollbackMismatch)
+			require.EqualError(t, err, dbmate.ErrRollbackMismatch.Error()+": 002_create_posts.sql")
+			require.Contains(t, out.String(), "--- before 002_create_posts.sql\n+++ after rolling back\n")
+			require.Regexp(t, `(?m)^\+.*comments`, out.String())
+			require.NotRegexp(t, `(?m)^[+-].*users`, out.String())
+
+			// the schema file is not written when verification fails
+			_, err = os.Stat(db.SchemaFile)
+			require.True(t, os.IsNotExist(err))
+
+			// verification stops with the migration rolled back
 			sqlDB, err := drv.Open()
 			require.NoError(t, err)
 			defer dbutil.MustClose(sqlDB)
 
-			// check applied migrations
 			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
 			require.NoError(t, err)
-			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+			require.Equal(t, map[string]bool{"001": true}, appliedMigrations)
 
-			// users table have records
-			count := 0
-			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			// fix the down block, and remove the table it left behind
+			err = os.WriteFile(filepath.Join(dir, "002_create_posts.sql"), []byte(
+				"-- migrate:up\ncreate table posts (id integer);\ncreate table comments (id integer);\n"+
+					"-- migrate:down\ndrop table posts;\ndrop table comments;\n"), 0o644)
 			require.NoError(t, err)
-			require.Equal(t, 1, count)
+			_, err = sqlDB.Exec("drop table comments")
+			require.NoError(t, err)
+
+			// migrations are applied, so verifying requires opting in
+			err = db.VerifyRollbacks(false)
+			require.ErrorIs(t, err, dbmate.ErrVerifyMigrated)
+			require.EqualError(t, err, dbmate.ErrVerifyMigrated.Error()+": 001_create_users.sql")
+
+			// applied migrations are checked like migrate does
+			contents, err := os.ReadFile(filepath.Join(dir, "001_create_users.sql"))
+			require.NoError(t, err)
+			err = os.WriteFile(filepath.Join(dir, "001_create_users.sql"), append(contents, '\n'), 0o644)
+			require.NoError(t, err)
+			db.StrictChecksums = true
+			err = db.VerifyRollbacks(true)
+			require.ErrorIs(t, err, dbmate.ErrMigrationModified)
+			db.StrictChecksums = false
+			err = os.WriteFile(filepath.Join(dir, "001_create_users.sql"), contents, 0o644)
+			require.NoError(t, err)
+
+			out.Reset()
+			err = db.VerifyRollbacks(true)
+			require.NoError(t, err)
+			require.Equal(t, "Applying: 002_create_posts.sql\n"+
+				"Rolling back: 002_create_posts.sql\n"+
+				"Applying: 002_create_posts.sql\n"+
+				"Writing: "+db.SchemaFile+"\n"+
+				"Verified rollbacks of 1 migrations\n", out.String())
+
+			appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
+			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"001": true, "002": true}, appliedMigrations)
+			_, err = os.Stat(db.SchemaFile)
+			require.NoError(t, err)
+
+			// applied migrations are not verified again
+			out.Reset()
+			err = db.VerifyRollbacks(true)
+			require.NoError(t, err)
+			require.Equal(t, "Verified rollbacks of 0 migrations\n", out.String())
 		})
 	}
 }
 
-func TestRollback(t *testing.T) {
+func TestRollbackTo(t *testing.T) {
 	for _, u := range testURLs() {
 		t.Run(u.Scheme, func(t *testing.T) {
 			db := newTestDB(t, u)
@@ -410,70 +1632,67 @@ func TestRollback(t *testing.T) {
 			err = db.Create()
 			require.NoError(t, err)
 
-			// rollback should return error
-			err = db.Rollback()
-			require.Error(t, err)
-			require.ErrorContains(t, err, "can't rollback: no migrations have been applied")
-
 			// migrate database
 			err = db.Migrate()
 			require.NoError(t, err)
 
-			// verify migration
 			sqlDB, err := drv.Open()
 			require.NoError(t, err)
 			defer dbutil.MustClose(sqlDB)
 
-			// check applied migrations
-			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
-			require.NoError(t, err)
-			require.Equal(t, map[string]bool{"20200227231541": true, "20151129054053": true}, appliedMigrations)
+			// unknown version should return error
+			err = db.RollbackTo("20000101000000")
+			require.EqualError(t, err, "can't find migration file: 20000101000000")
 
-			// users and posts tables have been created
-			var count int
-			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			// rollback to first migration
+			err = db.RollbackTo("20151129054053")
 			require.NoError(t, err)
-			err = sqlDB.QueryRow("select count(*) from posts").Scan(&count)
+
+			appliedMigrations, err := drv.SelectMigrations(sqlDB, -1)
 			require.NoError(t, err)
+			require.Equal(t, map[string]bool{"20151129054053": true}, appliedMigrations)
 
-			// rollback second migration
-			err = db.Rollback()
+			// rolling back to the latest applied version is a no-op
+			err = db.RollbackTo("20151129054053")
 			require.NoError(t, err)
 
-			// one migration remaining
-			err = sqlDB.QueryRow("select count(*) from schema_migrations").Scan(&count)
+			appliedMigrations, err = drv.SelectMigrations(sqlDB, -1)
 			require.NoError(t, err)
-			require.Equal(t, 1, count)
+			require.Equal(t, map[string]bool{"20151129054053": true}, appliedMigrations)
+		})
+	}
+}
 
-			// posts table was deleted
-			err = sqlDB.QueryRow("select count(*) from posts").Scan(&count)
-			require.NotNil(t, err)
-			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+func TestRollbackStepsPartialFailure(t *testing.T) {
+	u := dbutil.MustParseURL(os.Getenv("POSTGRES_TEST_URL"))
+	db := newTestDB(t, u)
 
-			// users table still exists
-			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
-			require.Nil(t, err)
+	err := db.Drop()
+	require.NoError(t, err)
+	err = db.Create()
+	require.NoError(t, err)
 
-			// rollback first migration
-			err = db.Rollback()
-			require.NoError(t, err)
+	db.FS = fstest.MapFS{
+		"db/migrations/001_invalid_down.sql": {
+			Data: []byte("-- migrate:up\n-- migrate:down\nnot_valid_sql;"),
+		},
+		"db/migrations/002_valid_down.sql": {
+			Data: []byte("-- migrate:up\n-- migrate:down\n"),
+		},
+	}
 
-			// no migrations remaining
-			err = sqlDB.QueryRow("select count(*) from schema_migrations").Scan(&count)
-			require.NoError(t, err)
-			require.Equal(t, 0, count)
+	err = db.Migrate()
+	require.NoError(t, err)
 
-			// posts table was deleted
-			err = sqlDB.QueryRow("select count(*) from posts").Scan(&count)
-			require.NotNil(t, err)
-			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
+	err = db.RollbackSteps(2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rolled back 1 of 2 migrations, failed on `001_invalid_down.sql`: line: 2, column: 1")
 
-			// users table was deleted
-			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
-			require.NotNil(t, err)
-			require.Regexp(t, "(does not exist|doesn't exist|no such table)", err.Error())
-		})
-	}
+	// first migration remains applied
+	migrations, err := db.FindMigrations()
+	require.NoError(t, err)
+	require.True(t, migrations[0].Applied)
+	require.False(t, migrations[1].Applied)
 }
 
 func TestFindMigrations(t *testing.T) {
@@ -622,6 +1841,238 @@ drop table users;
 	require.True(t, parsed.DownOptions.Transaction())
 }
 
+func TestMigrateRepeatable(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			mapFS := fstest.MapFS{
+				"db/migrations/001_create_users.sql": {
+					Data: []byte("-- migrate:up\ncreate table users (id int, name varchar(50));\n" +
+						"-- migrate:down\ndrop view if exists user_names;\ndrop table users;\n"),
+				},
+				"db/migrations/R__user_names.sql": {
+					Data: []byte("drop view if exists user_names;\ncreate view user_names as select name from users;\n"),
+				},
+			}
+
+			db := newTestDB(t, u)
+			db.FS = mapFS
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// repeatable migrations are pending, and sorted after versioned migrations
+			migrations, err := db.FindMigrations()
+			require.NoError(t, err)
+			require.Len(t, migrations, 2)
+			require.Equal(t, "R__user_names.sql", migrations[1].FileName)
+			require.Equal(t, "R__user_names", migrations[1].Version)
+			require.True(t, migrations[1].Repeatable)
+			require.False(t, migrations[1].Applied)
+
+			// migrate applies them after versioned migrations
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Equal(t, "Applying: 001_create_users.sql\nApplying: R__user_names.sql\n", out.String())
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			records := selectMigrationRecords(t, drv, sqlDB)
+			require.Contains(t, records, "001")
+			require.Contains(t, records, "R__user_names")
+
+			// unchanged repeatable migrations are not applied again
+			out.Reset()
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Equal(t, "", out.String())
+
+			// changed repeatable migrations are applied again
+			mapFS["db/migrations/R__user_names.sql"].Data = []byte("drop view if exists user_names;\n" +
+				"create view user_names as select id, name from users;\n")
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.False(t, migrations[1].Applied)
+			require.False(t, migrations[1].Modified)
+
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Equal(t, "Applying: R__user_names.sql\n", out.String())
+
+			_, err = sqlDB.Exec("select id, name from user_names")
+			require.NoError(t, err)
+			records = selectMigrationRecords(t, drv, sqlDB)
+			require.Len(t, records, 2)
+
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.True(t, migrations[1].Applied)
+
+			// rollback skips repeatable migrations
+			out.Reset()
+			err = db.Rollback()
+			require.NoError(t, err)
+			require.Equal(t, "Rolling back: 001_create_users.sql\n", out.String())
+		})
+	}
+}
+
+func TestMigrateToSkipsRepeatable(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			db.FS = fstest.MapFS{
+				"db/migrations/001_create_users.sql": {
+					Data: []byte("-- migrate:up\ncreate table users (id int);\n-- migrate:down\ndrop table users;\n"),
+				},
+				"db/migrations/002_create_posts.sql": {
+					Data: []byte("-- migrate:up\ncreate table posts (id int);\n-- migrate:down\ndrop table posts;\n"),
+				},
+				"db/migrations/R__post_ids.sql": {
+					Data: []byte("drop view if exists post_ids;\ncreate view post_ids as select id from posts;\n"),
+				},
+			}
+
+			// drop and recreate database
+			err := db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// repeatable migrations may depend on later versions, so they are
+			// not applied when migrating to an earlier version
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.MigrateTo("001")
+			require.NoError(t, err)
+			require.Equal(t, "Applying: 001_create_users.sql\n", out.String())
+
+			// they are applied when migrating to the latest version
+			out.Reset()
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Equal(t, "Applying: 002_create_posts.sql\nApplying: R__post_ids.sql\n", out.String())
+		})
+	}
+}
+
+func TestMigrateGo(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+			db.FS = fstest.MapFS{
+				"db/migrations/001_create_users.sql": {
+					Data: []byte("-- migrate:up\ncreate table users (id int, name varchar(50));\n" +
+						"-- migrate:down\ndrop table users;\n"),
+				},
+				"db/migrations/003_create_posts.sql": {
+					Data: []byte("-- migrate:up\ncreate table posts (id int);\n-- migrate:down\ndrop table posts;\n"),
+				},
+			}
+			db.GoMigrations = []dbmate.GoMigration{{
+				Version: "002",
+				Name:    "seed_users",
+				Up: func(ctx context.Context, tx dbutil.Transaction) error {
+					for _, name := range []string{"alice", "bob"} {
+						if _, err := tx.ExecContext(ctx, "insert into users (id, name) values (1, '"+name+"')"); err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				Down: func(ctx context.Context, tx dbutil.Transaction) error {
+					_, err := tx.ExecContext(ctx, "delete from users")
+					return err
+				},
+			}}
+			drv, err := db.Driver()
+			require.NoError(t, err)
+
+			// drop and recreate database
+			err = db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// go migrations are listed in version order
+			migrations, err := db.FindMigrations()
+			require.NoError(t, err)
+			require.Len(t, migrations, 3)
+			require.Equal(t, "002_seed_users.go", migrations[1].FileName)
+			require.Equal(t, "002", migrations[1].Version)
+
+			// migrate
+			var out bytes.Buffer
+			db.Log = &out
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Equal(t, "Applying: 001_create_users.sql\nApplying: 002_seed_users.go\n"+
+				"Applying: 003_create_posts.sql\n", out.String())
+
+			sqlDB, err := drv.Open()
+			require.NoError(t, err)
+			defer dbutil.MustClose(sqlDB)
+
+			count := 0
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 2, count)
+
+			status, err := db.StatusReport()
+			require.NoError(t, err)
+			require.True(t, status.Migrations[1].Applied)
+			require.Equal(t, "", status.Migrations[1].Directory)
+
+			// rollback
+			err = db.RollbackSteps(2)
+			require.NoError(t, err)
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 0, count)
+
+			// a failed go migration is rolled back with its transaction
+			db.GoMigrations[0].Up = func(ctx context.Context, tx dbutil.Transaction) error {
+				if _, err := tx.ExecContext(ctx, "insert into users (id, name) values (1, 'alice')"); err != nil {
+					return err
+				}
+				return errors.New("backfill failed")
+			}
+			err = db.Migrate()
+			require.EqualError(t, err, "backfill failed")
+			err = sqlDB.QueryRow("select count(*) from users").Scan(&count)
+			require.NoError(t, err)
+			require.Equal(t, 0, count)
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.False(t, migrations[1].Applied)
+
+			// go migrations without a down function can't be rolled back
+			db.GoMigrations[0].Up = func(context.Context, dbutil.Transaction) error { return nil }
+			db.GoMigrations[0].Down = nil
+			err = db.MigrateTo("002")
+			require.NoError(t, err)
+			err = db.Rollback()
+			require.ErrorIs(t, err, dbmate.ErrGoMigrationNoDown)
+
+			// versions must be numeric and unique
+			db.GoMigrations = append(db.GoMigrations, dbmate.GoMigration{Version: "003", Up: db.GoMigrations[0].Up})
+			_, err = db.FindMigrations()
+			require.ErrorIs(t, err, dbmate.ErrDuplicateMigration)
+			db.GoMigrations[1].Version = "v4"
+			_, err = db.FindMigrations()
+			require.ErrorIs(t, err, dbmate.ErrInvalidGoMigration)
+		})
+	}
+}
+
 func TestFindMigrationsFSMultipleDirs(t *testing.T) {
 	mapFS := fstest.MapFS{
 		"db/migrations_a/001_test_migration_a.sql": {},
@@ -847,3 +2298,130 @@ func TestMigrationContents(t *testing.T) {
 		})
 	}
 }
+
+func TestStatusReport(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+
+			// drop and recreate database
+			err := db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			// migrate to first version
+			before := time.Now().Add(-time.Second)
+			err = db.MigrateTo("20151129054053")
+			require.NoError(t, err)
+
+			report, err := db.StatusReport()
+			require.NoError(t, err)
+			require.Equal(t, 1, report.Applied)
+			require.Equal(t, 1, report.Pending)
+			require.Equal(t, 0, report.Modified)
+			require.Len(t, report.Migrations, 2)
+
+			applied := report.Migrations[0]
+			require.Equal(t, "20151129054053", applied.Version)
+			require.Equal(t, "20151129054053_test_migration.sql", applied.Filename)
+			require.Equal(t, "db/migrations", applied.Directory)
+			require.True(t, applied.Applied)
+			require.NotNil(t, applied.AppliedAt)
+			require.True(t, applied.AppliedAt.After(before))
+
+			pending := report.Migrations[1]
+			require.Equal(t, "20200227231541", pending.Version)
+			require.False(t, pending.Applied)
+			require.Nil(t, pending.AppliedAt)
+
+			// pending count matches text status
+			db.Log = &bytes.Buffer{}
+			count, err := db.Status(false)
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+		})
+	}
+}
+
+func TestMigrationModified(t *testing.T) {
+	for _, u := range testURLs() {
+		t.Run(u.Scheme, func(t *testing.T) {
+			db := newTestDB(t, u)
+
+			err := db.Drop()
+			require.NoError(t, err)
+			err = db.Create()
+			require.NoError(t, err)
+
+			mapFS := fstest.MapFS{
+				"db/migrations/001_test_modified.sql": {
+					Data: []byte("-- migrate:up\n-- migrate:down\n"),
+				},
+			}
+			db.FS = mapFS
+
+			err = db.Migrate()
+			require.NoError(t, err)
+
+			// unmodified migrations are not reported
+			migrations, err := db.FindMigrations()
+			require.NoError(t, err)
+			require.True(t, migrations[0].Applied)
+			require.False(t, migrations[0].Modified)
+
+			// edit applied migration
+			mapFS["db/migrations/001_test_modified.sql"].Data = []byte("-- migrate:up\n-- edited\n-- migrate:down\n")
+
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.True(t, migrations[0].Applied)
+			require.True(t, migrations[0].Modified)
+
+			// migrate and status report modified migrations
+			var buf bytes.Buffer
+			db.Log = &buf
+			err = db.Migrate()
+			require.NoError(t, err)
+			require.Contains(t, buf.String(), "Warning: 001_test_modified.sql has been modified since it was applied")
+
+			buf.Reset()
+			_, err = db.Status(false)
+			require.NoError(t, err)
+			require.Contains(t, buf.String(), "[X] 001_test_modified.sql (modified)")
+			require.Contains(t, buf.String(), "Modified: 1")
+
+			// strict checksums mode fails
+			db.StrictChecksums = true
+			err = db.Migrate()
+			require.EqualError(t, err, "applied migration files have been modified: 001_test_modified.sql")
+			_, err = db.Status(true)
+			require.EqualError(t, err, "applied migration files have been modified")
+
+			// dry run reports the repair without updating the checksum
+			buf.Reset()
+			db.DryRun = true
+			err = db.Repair()
+			require.NoError(t, err)
+			require.Contains(t, buf.String(), "Repairing: 001_test_modified.sql")
+			db.DryRun = false
+
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.True(t, migrations[0].Modified)
+
+			// repair updates recorded checksum
+			buf.Reset()
+			err = db.Repair()
+			require.NoError(t, err)
+			require.Contains(t, buf.String(), "Repairing: 001_test_modified.sql")
+
+			migrations, err = db.FindMigrations()
+			require.NoError(t, err)
+			require.False(t, migrations[0].Modified)
+
+			err = db.Migrate()
+			require.NoError(t, err)
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package dbmate
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"net/url"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
 )
@@ -25,11 +27,230 @@ type Driver interface {
 	QueryError(string, error) error
 }
 
+// DriverContext is an optional interface implemented by drivers which support
+// cancellation. Each method is like the Driver method of the same name, but
+// aborts any in-flight operation when the context is done.
+type DriverContext interface {
+	DatabaseExistsContext(context.Context) (bool, error)
+	CreateDatabaseContext(context.Context) error
+	DropDatabaseContext(context.Context) error
+	DumpSchemaContext(context.Context, *sql.DB) ([]byte, error)
+	MigrationsTableExistsContext(context.Context, *sql.DB) (bool, error)
+	CreateMigrationsTableContext(context.Context, *sql.DB) error
+	SelectMigrationsContext(context.Context, *sql.DB, int) (map[string]bool, error)
+	InsertMigrationContext(context.Context, dbutil.Transaction, string) error
+	DeleteMigrationContext(context.Context, dbutil.Transaction, string) error
+	PingContext(context.Context) error
+}
+
+// MigrationRecorder is an optional interface implemented by drivers which
+// record the details of each applied migration, such as its checksum. Drivers
+// which do not implement it only record migration versions, so modified
+// migration files can't be detected, and repeatable migrations are applied
+// again by every migrate.
+type MigrationRecorder interface {
+	SelectMigrationRecordsContext(context.Context, *sql.DB) (map[string]MigrationRecord, error)
+	InsertMigrationRecordContext(context.Context, dbutil.Transaction, MigrationRecord) error
+	UpdateMigrationChecksumContext(context.Context, dbutil.Transaction, string, string) error
+}
+
+// driverWithContext is a driver with context-aware methods
+type driverWithContext interface {
+	Driver
+	DriverContext
+}
+
+// contextDriver is a driver with context-aware methods, which records the
+// details of each applied migration
+type contextDriver interface {
+	driverWithContext
+	MigrationRecorder
+}
+
+// withContext returns the context-aware methods of a driver. Drivers which do
+// not implement DriverContext can't be interrupted, so the context is only
+// checked before each operation.
+func withContext(drv Driver) contextDriver {
+	if cd, ok := drv.(contextDriver); ok {
+		return cd
+	}
+
+	var base driverWithContext = driverContextAdapter{drv}
+	if dc, ok := drv.(driverWithContext); ok {
+		base = dc
+	}
+
+	if recorder, ok := drv.(MigrationRecorder); ok {
+		return recordingDriver{base, recorder}
+	}
+
+	return migrationRecorderAdapter{base}
+}
+
+// unwrapDriver returns the driver wrapped by withContext
+func unwrapDriver(drv Driver) Driver {
+	switch d := drv.(type) {
+	case driverContextAdapter:
+		return d.Driver
+	case recordingDriver:
+		return unwrapDriver(d.driverWithContext)
+	case migrationRecorderAdapter:
+		return unwrapDriver(d.driverWithContext)
+	}
+
+	return drv
+}
+
+// recordingDriver combines a driver with its MigrationRecorder methods
+type recordingDriver struct {
+	driverWithContext
+	MigrationRecorder
+}
+
+// migrationRecorderAdapter implements MigrationRecorder for drivers which only
+// record migration versions
+type migrationRecorderAdapter struct {
+	driverWithContext
+}
+
+func (d migrationRecorderAdapter) SelectMigrationRecordsContext(ctx context.Context, db *sql.DB) (map[string]MigrationRecord, error) {
+	versions, err := d.SelectMigrationsContext(ctx, db, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]MigrationRecord, len(versions))
+	for version := range versions {
+		records[version] = MigrationRecord{Version: version}
+	}
+
+	return records, nil
+}
+
+func (d migrationRecorderAdapter) InsertMigrationRecordContext(ctx context.Context, db dbutil.Transaction, record MigrationRecord) error {
+	return d.InsertMigrationContext(ctx, db, record.Version)
+}
+
+func (d migrationRecorderAdapter) UpdateMigrationChecksumContext(context.Context, dbutil.Transaction, string, string) error {
+	return ErrChecksumsUnsupported
+}
+
+// driverContextAdapter implements DriverContext for drivers which do not support it
+type driverContextAdapter struct {
+	Driver
+}
+
+func (d driverContextAdapter) DatabaseExistsContext(ctx context.Context) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return d.DatabaseExists()
+}
+
+func (d driverContextAdapter) CreateDatabaseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.CreateDatabase()
+}
+
+func (d driverContextAdapter) DropDatabaseContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.DropDatabase()
+}
+
+func (d driverContextAdapter) DumpSchemaContext(ctx context.Context, db *sql.DB) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return d.DumpSchema(db)
+}
+
+func (d driverContextAdapter) MigrationsTableExistsContext(ctx context.Context, db *sql.DB) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return d.MigrationsTableExists(db)
+}
+
+func (d driverContextAdapter) CreateMigrationsTableContext(ctx context.Context, db *sql.DB) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.CreateMigrationsTable(db)
+}
+
+func (d driverContextAdapter) SelectMigrationsContext(ctx context.Context, db *sql.DB, limit int) (map[string]bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return d.SelectMigrations(db, limit)
+}
+
+func (d driverContextAdapter) InsertMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.InsertMigration(db, version)
+}
+
+func (d driverContextAdapter) DeleteMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.DeleteMigration(db, version)
+}
+
+func (d driverContextAdapter) PingContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.Ping()
+}
+
+// Locker is an optional interface implemented by drivers which can prevent
+// multiple processes from migrating the same database at once
+type Locker interface {
+	// Lock blocks until the migration lock is acquired, or the context is done.
+	// The returned function releases the lock.
+	Lock(ctx context.Context, db *sql.DB) (unlock func() error, err error)
+}
+
+// SchemaLoader is an optional interface implemented by drivers whose schema
+// files can't be executed as a single batch of statements
+type SchemaLoader interface {
+	LoadSchemaContext(ctx context.Context, db *sql.DB, schema string) error
+}
+
+// MigrationRecord holds the details recorded in the migrations table
+// when a migration is applied
+type MigrationRecord struct {
+	Version       string
+	AppliedAt     time.Time
+	Duration      time.Duration
+	Checksum      string
+	DbmateVersion string
+}
+
 // DriverConfig holds configuration passed to driver constructors
 type DriverConfig struct {
+	Connection          *sql.DB
 	DatabaseURL         *url.URL
 	Log                 io.Writer
 	MigrationsTableName string
+	NativeDump          bool
 }
 
 // DriverFunc represents a driver constructor
@@ -41,6 +262,10 @@ type QueryError struct {
 	Position int
 }
 
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
 func (e *QueryError) Error() string {
 	if e.Position > 0 {
 		line := 1
@@ -0,0 +1,146 @@
+package dbmate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/amacneil/dbmate/v2/pkg/dbutil"
+)
+
+var errDryRunResult = errors.New("no result in dry run mode")
+
+// dryRunTransaction prints statements instead of executing them. Queries are
+// passed through to the database, so drivers can still look up the information
+// they need to build their statements.
+type dryRunTransaction struct {
+	db  dbutil.Transaction
+	log io.Writer
+}
+
+// Exec prints the statement and its arguments
+func (tx *dryRunTransaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext prints the statement and its arguments
+func (tx *dryRunTransaction) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return dryRunResult{}, nil
+	}
+	if !strings.HasSuffix(query, ";") {
+		query += ";"
+	}
+
+	if len(args) > 0 {
+		values := make([]string, len(args))
+		for i, arg := range args {
+			values[i] = formatDryRunArg(arg)
+		}
+		query = fmt.Sprintf("%s -- args: %s", query, strings.Join(values, ", "))
+	}
+
+	fmt.Fprintln(tx.log, query)
+
+	return dryRunResult{}, nil
+}
+
+// Query runs a read query against the database
+func (tx *dryRunTransaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.db.Query(query, args...)
+}
+
+// QueryContext runs a read query against the database
+func (tx *dryRunTransaction) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.db.QueryContext(ctx, query, args...)
+}
+
+// QueryRow runs a read query against the database
+func (tx *dryRunTransaction) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.db.QueryRow(query, args...)
+}
+
+// QueryRowContext runs a read query against the database
+func (tx *dryRunTransaction) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.db.QueryRowContext(ctx, query, args...)
+}
+
+// dryRunResult is returned for statements which were not executed
+type dryRunResult struct{}
+
+func (dryRunResult) LastInsertId() (int64, error) {
+	return 0, errDryRunResult
+}
+
+func (dryRunResult) RowsAffected() (int64, error) {
+	return 0, errDryRunResult
+}
+
+// formatDryRunArg formats a statement argument as a sql literal
+func formatDryRunArg(arg interface{}) string {
+	if valuer, ok := arg.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return fmt.Sprintf("%v", arg)
+		}
+		arg = value
+	}
+
+	switch v := arg.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// checkDryRunDatabase ensures the database exists before a dry run, since
+// connecting to a missing database would create it for some drivers
+func (db *DB) checkDryRunDatabase(ctx context.Context, drv contextDriver) error {
+	if !db.DryRun || db.Connection != nil {
+		return nil
+	}
+
+	// skip this check if we cannot determine status
+	// (e.g. user does not have list database permission)
+	exists, err := drv.DatabaseExistsContext(ctx)
+	if err == nil && !exists {
+		return ErrDryRunNoDatabase
+	}
+
+	return nil
+}
+
+// dryRun prints the statements txFunc would execute, wrapped in transaction
+// boundaries if requested
+func (db *DB) dryRun(sqlDB *sql.DB, transaction bool, txFunc func(dbutil.Transaction) error) error {
+	tx := &dryRunTransaction{db: sqlDB, log: db.Log}
+
+	if transaction {
+		fmt.Fprintln(db.Log, "BEGIN;")
+	}
+
+	if err := txFunc(tx); err != nil {
+		return err
+	}
+
+	if transaction {
+		fmt.Fprintln(db.Log, "COMMIT;")
+	}
+
+	return nil
+}
@@ -1,20 +1,68 @@
 package dbmate
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/amacneil/dbmate/v2/pkg/dbutil"
 )
 
 // Migration represents an available migration and status
 type Migration struct {
-	Applied  bool
-	FileName string
-	FilePath string
-	FS       fs.FS
-	Version  string
+	Applied   bool
+	AppliedAt time.Time
+	FileName  string
+	FilePath  string
+	FS        fs.FS
+	Modified  bool
+	// Repeatable migrations (R__name.sql) are applied again whenever their
+	// checksum changes, after all versioned migrations. Their version is the
+	// file name without the .sql extension.
+	Repeatable bool
+	Version    string
+
+	// goMigration is set for migrations written in Go, which have no file
+	goMigration *GoMigration
+	// templateVars are the values substituted into templated migrations,
+	// before environment variables
+	templateVars map[string]string
+}
+
+// GoMigrationFunc is the up or down step of a Go migration. Statements should
+// run through tx, so that they are part of the migration transaction.
+type GoMigrationFunc func(ctx context.Context, tx dbutil.Transaction) error
+
+// GoMigration is a migration written in Go. It is ordered among migration
+// files by its version, and recorded in the migrations table the same way.
+type GoMigration struct {
+	// Version is the numeric version, e.g. "20230101120000"
+	Version string
+	// Name describes the migration, e.g. "backfill_user_names"
+	Name string
+	// Up applies the migration
+	Up GoMigrationFunc
+	// Down rolls back the migration, or nil if it can't be rolled back
+	Down GoMigrationFunc
+	// NoTransaction runs the migration outside of a transaction
+	NoTransaction bool
+}
+
+// fileName returns the name a Go migration is listed under
+func (m *GoMigration) fileName() string {
+	if m.Name == "" {
+		return m.Version + ".go"
+	}
+
+	return m.Version + "_" + m.Name + ".go"
 }
 
 func (m *Migration) readFile() (string, error) {
@@ -29,12 +77,75 @@ func (m *Migration) readFile() (string, error) {
 
 // Parse a migration
 func (m *Migration) Parse() (*ParsedMigration, error) {
+	if m.goMigration != nil {
+		// Go migrations have no statements, only options
+		options := migrationOptions{"transaction": strconv.FormatBool(!m.goMigration.NoTransaction)}
+		return &ParsedMigration{UpOptions: options, DownOptions: options}, nil
+	}
+
 	contents, err := m.readFile()
 	if err != nil {
 		return nil, err
 	}
 
-	return parseMigrationContents(contents)
+	var parsed *ParsedMigration
+	if m.Repeatable {
+		parsed, err = parseRepeatableMigrationContents(contents)
+	} else {
+		parsed, err = parseMigrationContents(contents)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// templating is enabled for the whole file by either block
+	if templateEnabled(parsed.UpOptions) || templateEnabled(parsed.DownOptions) {
+		if parsed.Up, err = expandTemplate(parsed.Up, m.templateVars); err != nil {
+			return nil, err
+		}
+		if parsed.Down, err = expandTemplate(parsed.Down, m.templateVars); err != nil {
+			return nil, err
+		}
+	}
+
+	return parsed, nil
+}
+
+// Checksum returns the SHA-256 checksum of the migration file contents.
+// Go migrations have no checksum, since their code can't be read.
+func (m *Migration) Checksum() (string, error) {
+	if m.goMigration != nil {
+		return "", nil
+	}
+
+	contents, err := m.readFile()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// squashedChecksum returns the checksum of the migration file replaced by a
+// squash migration, or an empty string. Only the options of the up directive
+// are read, so that the migration doesn't need to be valid.
+func (m *Migration) squashedChecksum() (string, error) {
+	if m.goMigration != nil {
+		return "", nil
+	}
+
+	contents, err := m.readFile()
+	if err != nil {
+		return "", err
+	}
+
+	upDirectiveStart, hasDefinedUpBlock := getMatchPosition(contents, upRegExp)
+	if !hasDefinedUpBlock {
+		return "", nil
+	}
+
+	return parseMigrationOptions(contents[upDirectiveStart:]).Squash(), nil
 }
 
 // ParsedMigration contains the migration contents and options
@@ -58,6 +169,28 @@ func (m migrationOptions) Transaction() bool {
 	return m["transaction"] != "false"
 }
 
+// Template returns whether ${VAR} references in this migration should be
+// replaced with template variables or environment variables.
+// Defaults to false.
+func (m migrationOptions) Template() bool {
+	return m["template"] == "true"
+}
+
+// Squash returns the checksum of the migration file replaced by a squash
+// migration, which databases that applied the squashed migrations recorded.
+// Defaults to an empty string.
+func (m migrationOptions) Squash() string {
+	return m["squash"]
+}
+
+// templateEnabled reports whether options enable templating. Options which
+// are not part of ParsedMigrationOptions are only read from parsed files, so
+// that the interface keeps its method set.
+func templateEnabled(options ParsedMigrationOptions) bool {
+	m, ok := options.(migrationOptions)
+	return ok && m.Template()
+}
+
 var (
 	upRegExp              = regexp.MustCompile(`(?m)^--\s*migrate:up(\s*$|\s+\S+)`)
 	downRegExp            = regexp.MustCompile(`(?m)^--\s*migrate:down(\s*$|\s+\S+)`)
@@ -66,6 +199,9 @@ var (
 	whitespaceRegExp      = regexp.MustCompile(`\s+`)
 	optionSeparatorRegExp = regexp.MustCompile(`:`)
 	blockDirectiveRegExp  = regexp.MustCompile(`^--\s*migrate:(up|down)`)
+	templateVarRegExp     = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	dataStatementRegExp   = regexp.MustCompile(`(?i)^(insert|update|delete|merge|replace|copy)\b`)
+	dollarQuoteRegExp     = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
 )
 
 // Error codes
@@ -74,6 +210,8 @@ var (
 	ErrParseMissingDown    = errors.New("dbmate requires each migration to define a down block with '-- migrate:down'")
 	ErrParseWrongOrder     = errors.New("dbmate requires '-- migrate:up' to appear before '-- migrate:down'")
 	ErrParseUnexpectedStmt = errors.New("dbmate does not support statements preceding the '-- migrate:up' block")
+	ErrParseRepeatableDown = errors.New("repeatable migrations can't define a '-- migrate:down' block")
+	ErrTemplateUndefined   = errors.New("undefined template variable")
 )
 
 // parseMigrationContents parses the string contents of a migration.
@@ -110,6 +248,110 @@ func parseMigrationContents(contents string) (*ParsedMigration, error) {
 	return &parsed, nil
 }
 
+// parseRepeatableMigrationContents parses the string contents of a repeatable
+// migration. The '-- migrate:up' directive is optional, and only needed to
+// set options, since repeatable migrations have no down block.
+func parseRepeatableMigrationContents(contents string) (*ParsedMigration, error) {
+	if _, hasDefinedDownBlock := getMatchPosition(contents, downRegExp); hasDefinedDownBlock {
+		return nil, ErrParseRepeatableDown
+	}
+
+	upDirectiveStart, hasDefinedUpBlock := getMatchPosition(contents, upRegExp)
+	if !hasDefinedUpBlock {
+		return &ParsedMigration{
+			Up:          contents,
+			UpOptions:   make(migrationOptions),
+			DownOptions: make(migrationOptions),
+		}, nil
+	}
+	if statementsPrecedeMigrateBlocks(contents, upDirectiveStart) {
+		return nil, ErrParseUnexpectedStmt
+	}
+
+	upBlock := substring(contents, upDirectiveStart, len(contents))
+
+	parsed := ParsedMigration{
+		Up:          upBlock,
+		UpOptions:   parseMigrationOptions(upBlock),
+		DownOptions: make(migrationOptions),
+	}
+	return &parsed, nil
+}
+
+// expandTemplate replaces ${VAR} references with the value from vars, or from
+// the environment. All undefined variables are reported at once.
+func expandTemplate(contents string, vars map[string]string) (string, error) {
+	undefined := []string{}
+	expanded := templateVarRegExp.ReplaceAllStringFunc(contents, func(ref string) string {
+		name := templateVarRegExp.FindStringSubmatch(ref)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+
+		for _, seen := range undefined {
+			if seen == name {
+				return ref
+			}
+		}
+		undefined = append(undefined, name)
+		return ref
+	})
+
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrTemplateUndefined, strings.Join(undefined, ", "))
+	}
+
+	return expanded, nil
+}
+
+// modifiesData reports whether any statement in a migration block inserts,
+// updates or deletes data. Comments and quoted strings are skipped, so that
+// statements inside function bodies are not mistaken for top level statements.
+func modifiesData(contents string) bool {
+	statementStart := true
+	for i := 0; i < len(contents); {
+		switch c := contents[i]; {
+		case strings.HasPrefix(contents[i:], "--"):
+			i = skipPast(contents, i+2, "\n")
+		case strings.HasPrefix(contents[i:], "/*"):
+			i = skipPast(contents, i+2, "*/")
+		case c == '\'' || c == '"' || c == '`':
+			statementStart = false
+			i = skipPast(contents, i+1, string(c))
+		case c == '$' && dollarQuoteRegExp.MatchString(contents[i:]):
+			tag := dollarQuoteRegExp.FindString(contents[i:])
+			statementStart = false
+			i = skipPast(contents, i+len(tag), tag)
+		case c == ';':
+			statementStart = true
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		default:
+			if statementStart && dataStatementRegExp.MatchString(contents[i:]) {
+				return true
+			}
+			statementStart = false
+			i++
+		}
+	}
+
+	return false
+}
+
+// skipPast returns the position after the next occurrence of end, starting
+// from position i, or the length of contents if there is none
+func skipPast(contents string, i int, end string) int {
+	if pos := strings.Index(contents[i:], end); pos >= 0 {
+		return i + pos + len(end)
+	}
+
+	return len(contents)
+}
+
 // parseMigrationOptions parses the migration options out of a block
 // directive into an object that implements the MigrationOptions interface.
 //
@@ -117,7 +359,7 @@ func parseMigrationContents(contents string) (*ParsedMigration, error) {
 //
 //	fmt.Printf("%#v", parseMigrationOptions("-- migrate:up transaction:false"))
 //	// migrationOptions{"transaction": "false"}
-func parseMigrationOptions(contents string) ParsedMigrationOptions {
+func parseMigrationOptions(contents string) migrationOptions {
 	options := make(migrationOptions)
 
 	// remove everything after first newline
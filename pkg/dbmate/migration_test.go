@@ -34,6 +34,127 @@ drop table users;
 	require.True(t, parsed.DownOptions.Transaction())
 }
 
+func TestChecksum(t *testing.T) {
+	fs := fstest.MapFS{
+		"bar/123_foo.sql": {
+			Data: []byte("-- migrate:up\n-- migrate:down\n"),
+		},
+	}
+
+	migration := &Migration{
+		FileName: "123_foo.sql",
+		FilePath: "bar/123_foo.sql",
+		FS:       fs,
+		Version:  "123",
+	}
+
+	checksum, err := migration.Checksum()
+	require.NoError(t, err)
+	require.Equal(t, "977d3c152ca363a8cff9f63519c570a5fda51f0b2cfd559e1e414fb84978fe5a", checksum)
+
+	// checksum changes with file contents
+	fs["bar/123_foo.sql"].Data = []byte("-- migrate:up\ncreate table users (id serial);\n-- migrate:down\n")
+	changed, err := migration.Checksum()
+	require.NoError(t, err)
+	require.NotEqual(t, checksum, changed)
+}
+
+func TestParseRepeatableMigrationContents(t *testing.T) {
+	t.Run("plain sql", func(t *testing.T) {
+		parsed, err := parseRepeatableMigrationContents("create view v as select 1;\n")
+		require.NoError(t, err)
+		require.Equal(t, "create view v as select 1;\n", parsed.Up)
+		require.True(t, parsed.UpOptions.Transaction())
+		require.Equal(t, "", parsed.Down)
+	})
+
+	t.Run("up block with options", func(t *testing.T) {
+		parsed, err := parseRepeatableMigrationContents("-- comment\n-- migrate:up transaction:false\ncreate view v as select 1;\n")
+		require.NoError(t, err)
+		require.Equal(t, "-- migrate:up transaction:false\ncreate view v as select 1;\n", parsed.Up)
+		require.False(t, parsed.UpOptions.Transaction())
+	})
+
+	t.Run("statements before up block", func(t *testing.T) {
+		_, err := parseRepeatableMigrationContents("select 1;\n-- migrate:up\nselect 2;\n")
+		require.ErrorIs(t, err, ErrParseUnexpectedStmt)
+	})
+
+	t.Run("down block", func(t *testing.T) {
+		_, err := parseRepeatableMigrationContents("-- migrate:up\nselect 1;\n-- migrate:down\nselect 2;\n")
+		require.ErrorIs(t, err, ErrParseRepeatableDown)
+	})
+}
+
+func TestModifiesData(t *testing.T) {
+	cases := map[string]bool{
+		"create table users (id integer);\n":                              false,
+		"create table users (id integer);\ninsert into users values (1);": true,
+		"-- seed\nINSERT INTO users VALUES (1);":                          true,
+		"update users set id = 2;":                                        true,
+		"create table t (id int); delete from t;":                         true,
+		"copy users from stdin;":                                          true,
+		"create or replace view v as select 1;":                           false,
+		"-- insert into users values (1);\nselect 1;":                     false,
+		"/* delete from users; */ select 1;":                              false,
+		"comment on table users is 'a; insert';":                          false,
+		"create function f() returns trigger as $$ begin insert into log values (1); return new; end $$ language plpgsql;": false,
+		"create function f() returns int as $body$ select 1; $body$ language sql;\nupdate users set id = 1;":               true,
+	}
+
+	for contents, expected := range cases {
+		require.Equal(t, expected, modifiesData(contents), contents)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	t.Setenv("DBMATE_TEST_ROLE", "app_rw")
+
+	fs := fstest.MapFS{
+		"bar/123_foo.sql": {
+			Data: []byte(`-- migrate:up template:true
+create table users (id serial) tablespace ${tablespace};
+grant select on users to ${DBMATE_TEST_ROLE};
+-- migrate:down
+drop table users;
+`),
+		},
+	}
+
+	migration := &Migration{
+		FileName:     "123_foo.sql",
+		FilePath:     "bar/123_foo.sql",
+		FS:           fs,
+		Version:      "123",
+		templateVars: map[string]string{"tablespace": "fast"},
+	}
+
+	parsed, err := migration.Parse()
+	require.NoError(t, err)
+	require.Equal(t, "-- migrate:up template:true\ncreate table users (id serial) tablespace fast;\n"+
+		"grant select on users to app_rw;\n", parsed.Up)
+	require.True(t, templateEnabled(parsed.UpOptions))
+	require.False(t, templateEnabled(parsed.DownOptions))
+
+	// template variables take precedence over environment variables
+	migration.templateVars["DBMATE_TEST_ROLE"] = "app_ro"
+	parsed, err = migration.Parse()
+	require.NoError(t, err)
+	require.Contains(t, parsed.Up, "to app_ro;")
+
+	// undefined variables are an error
+	migration.templateVars = nil
+	_, err = migration.Parse()
+	require.ErrorIs(t, err, ErrTemplateUndefined)
+	require.EqualError(t, err, "undefined template variable: tablespace")
+
+	// files without the template option are unchanged
+	fs["bar/123_foo.sql"].Data = []byte("-- migrate:up\nselect '${tablespace}';\n-- migrate:down\n")
+	parsed, err = migration.Parse()
+	require.NoError(t, err)
+	require.Equal(t, "-- migrate:up\nselect '${tablespace}';\n", parsed.Up)
+}
+
 func TestParseMigrationContents(t *testing.T) {
 	t.Run("support the typical use case", func(t *testing.T) {
 		migration := `-- migrate:up
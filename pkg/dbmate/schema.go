@@ -0,0 +1,310 @@
+package dbmate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// schemaObject is a database object in a schema file, along with the
+// statements that define it
+type schemaObject struct {
+	kind       string
+	name       string
+	definition string
+}
+
+const (
+	// identifierPartPattern matches an optionally quoted identifier
+	identifierPartPattern = `(?:"(?:[^"]|"")*"|` + "`(?:[^`]|``)*`" + `|\[[^\]]*\]|[\w$]+)`
+	// identifierPattern matches an optionally quoted and qualified identifier
+	identifierPattern = identifierPartPattern + `(?:\.` + identifierPartPattern + `)*`
+)
+
+var (
+	// createPattern matches the kind and name of the object created by a statement
+	createPattern = regexp.MustCompile(`(?i)^CREATE\s+(?:OR\s+REPLACE\s+)?` +
+		`(?:(?:UNIQUE|TEMP|TEMPORARY|UNLOGGED|GLOBAL|LOCAL|RECURSIVE|CONSTRAINT|VIRTUAL|ALGORITHM=\w+|SQL\s+SECURITY\s+\w+)\s+)*` +
+		`(MATERIALIZED\s+VIEW|TABLE|VIEW|INDEX|SEQUENCE|FUNCTION|PROCEDURE|AGGREGATE|TRIGGER|TYPE|DOMAIN|SCHEMA|EXTENSION|` +
+		`DICTIONARY|DATABASE|COLLATION|EVENT|POLICY|RULE|STATISTICS)\s+` +
+		`(?:IF\s+NOT\s+EXISTS\s+)?(?:CONCURRENTLY\s+)?(` + identifierPattern + `)`)
+	// alterPattern matches the kind and name of the object changed by a statement
+	alterPattern = regexp.MustCompile(`(?i)^ALTER\s+(MATERIALIZED\s+VIEW|TABLE|VIEW|INDEX|SEQUENCE|TYPE|DOMAIN)\s+` +
+		`(?:IF\s+EXISTS\s+)?(?:ONLY\s+)?(` + identifierPattern + `)`)
+	// insertPattern matches the table name of an insert statement
+	insertPattern = regexp.MustCompile(`(?i)^INSERT\s+INTO\s+(` + identifierPattern + `)`)
+	// identifierPartRegexp matches each part of a qualified identifier
+	identifierPartRegexp = regexp.MustCompile(identifierPartPattern)
+	// ignoredStatementPattern matches session settings written by dump tools
+	ignoredStatementPattern = regexp.MustCompile(`(?i)^(?:SET|LOCK|UNLOCK|USE)\s|^SELECT\s+pg_catalog\.set_config\(`)
+	// versionedCommentPattern matches the start of a MySQL /*!50001 ... */ comment
+	versionedCommentPattern = regexp.MustCompile(`/\*!\d*\s?`)
+	// dollarQuotePattern matches the opening tag of a PostgreSQL dollar-quoted string
+	dollarQuotePattern = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z_0-9]*)?\$`)
+	// definerClausePattern matches the DEFINER clause of MySQL objects
+	definerClausePattern = regexp.MustCompile(`(?i)\s+DEFINER\s*=\s*(?:` + "`[^`]*`" + `|'[^']*'|[^\s@]+)@(?:` +
+		"`[^`]*`" + `|'[^']*'|\S+)`)
+)
+
+// parseSchema splits a schema file into the objects it defines. Statements
+// which change an existing object (such as ALTER TABLE) are added to the
+// definition of that object. Session settings and the schema migrations data
+// are ignored.
+func parseSchema(schema, migrationsTable string) []schemaObject {
+	var objects []schemaObject
+	index := map[string]int{}
+	migrationsTable = unquoteIdentifier(lastIdentifierPart(migrationsTable))
+
+	for _, stmt := range splitSchemaStatements(schema) {
+		stmt = normalizeSchemaStatement(stmt)
+		if stmt == "" || ignoredStatementPattern.MatchString(stmt) {
+			continue
+		}
+
+		if m := insertPattern.FindStringSubmatch(stmt); m != nil {
+			if unquoteIdentifier(lastIdentifierPart(m[1])) == migrationsTable {
+				continue
+			}
+		}
+
+		kind, name := "statement", stmt
+		if m := createPattern.FindStringSubmatch(stmt); m != nil {
+			kind, name = m[1], m[2]
+		} else if m := alterPattern.FindStringSubmatch(stmt); m != nil {
+			kind, name = m[1], m[2]
+		}
+		kind = strings.ToLower(strings.Join(strings.Fields(kind), " "))
+
+		key := kind + " " + name
+		if i, ok := index[key]; ok {
+			objects[i].definition += "\n" + stmt
+			continue
+		}
+		index[key] = len(objects)
+		objects = append(objects, schemaObject{kind: kind, name: name, definition: stmt})
+	}
+
+	return objects
+}
+
+// squashSchema returns the statements of a schema file which recreate the
+// database objects, for use as a squash migration. Session settings, psql
+// meta-commands, and the schema migrations table and its data are removed,
+// since the migrations table is managed by dbmate.
+func squashSchema(schema, migrationsTable string) string {
+	var b strings.Builder
+	migrationsTable = unquoteIdentifier(lastIdentifierPart(migrationsTable))
+
+	for _, stmt := range splitSchemaStatements(schema) {
+		normalized := normalizeSchemaStatement(stmt)
+		if normalized == "" || ignoredStatementPattern.MatchString(normalized) ||
+			isMigrationsTableStatement(normalized, migrationsTable) {
+			continue
+		}
+
+		b.WriteString(stmt)
+		b.WriteString(";\n\n")
+	}
+
+	return b.String()
+}
+
+// isMigrationsTableStatement reports whether a normalized statement creates,
+// changes or inserts into the (unquoted) schema migrations table
+func isMigrationsTableStatement(stmt, migrationsTable string) bool {
+	name := ""
+	if m := createPattern.FindStringSubmatch(stmt); m != nil && strings.EqualFold(m[1], "table") {
+		name = m[2]
+	} else if m := alterPattern.FindStringSubmatch(stmt); m != nil && strings.EqualFold(m[1], "table") {
+		name = m[2]
+	} else if m := insertPattern.FindStringSubmatch(stmt); m != nil {
+		name = m[1]
+	}
+
+	return name != "" && unquoteIdentifier(lastIdentifierPart(name)) == migrationsTable
+}
+
+// splitSchemaStatements splits a schema file into statements, removing
+// comments. MySQL DELIMITER commands and psql meta-commands are handled
+// line by line, so mysqldump and pg_dump output can both be parsed.
+func splitSchemaStatements(schema string) []string {
+	var statements []string
+	var stmt strings.Builder
+	delimiter := ";"
+
+	flush := func() {
+		if s := strings.TrimSpace(stmt.String()); s != "" {
+			statements = append(statements, s)
+		}
+		stmt.Reset()
+	}
+
+	var quote, dollarTag string
+	blockComment := false
+	lineStart := true
+
+	for i := 0; i < len(schema); i++ {
+		if lineStart && quote == "" && dollarTag == "" && !blockComment {
+			end := strings.IndexByte(schema[i:], '\n')
+			if end < 0 {
+				end = len(schema) - i
+			}
+			line := strings.TrimSpace(schema[i : i+end])
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.EqualFold(fields[0], "DELIMITER") {
+				flush()
+				delimiter = fields[1]
+				i += end
+				continue
+			}
+			if strings.HasPrefix(line, `\`) && strings.TrimSpace(stmt.String()) == "" {
+				i += end
+				continue
+			}
+		}
+		lineStart = schema[i] == '\n'
+
+		rest := schema[i:]
+		switch {
+		case blockComment:
+			if strings.HasPrefix(rest, "*/") {
+				blockComment = false
+				i++
+			}
+			continue
+		case dollarTag != "":
+			if strings.HasPrefix(rest, dollarTag) {
+				stmt.WriteString(dollarTag)
+				i += len(dollarTag) - 1
+				dollarTag = ""
+				continue
+			}
+		case quote != "":
+			if strings.HasPrefix(rest, quote) {
+				quote = ""
+			}
+		case strings.HasPrefix(rest, "--"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			i += end - 1
+			continue
+		case strings.HasPrefix(rest, "/*") && !strings.HasPrefix(rest, "/*!"):
+			blockComment = true
+			i++
+			continue
+		case strings.HasPrefix(rest, delimiter):
+			flush()
+			i += len(delimiter) - 1
+			continue
+		case rest[0] == '\'' || rest[0] == '"' || rest[0] == '`':
+			quote = rest[:1]
+		case rest[0] == '$':
+			if m := dollarQuotePattern.FindString(rest); m != "" {
+				dollarTag = m
+				stmt.WriteString(m)
+				i += len(m) - 1
+				continue
+			}
+		}
+
+		stmt.WriteByte(schema[i])
+	}
+	flush()
+
+	return statements
+}
+
+// normalizeSchemaStatement removes formatting which doesn't change the meaning
+// of a statement: MySQL versioned comments, DEFINER clauses and whitespace
+func normalizeSchemaStatement(stmt string) string {
+	if strings.Contains(stmt, "/*!") {
+		stmt = versionedCommentPattern.ReplaceAllString(stmt, "")
+		stmt = strings.ReplaceAll(stmt, "*/", "")
+	}
+	stmt = definerClausePattern.ReplaceAllString(stmt, "")
+
+	return strings.Join(strings.Fields(stmt), " ")
+}
+
+// lastIdentifierPart returns the unqualified name of an identifier
+func lastIdentifierPart(name string) string {
+	parts := identifierPartRegexp.FindAllString(name, -1)
+	if len(parts) == 0 {
+		return name
+	}
+
+	return parts[len(parts)-1]
+}
+
+// unquoteIdentifier removes the quotes from an identifier
+func unquoteIdentifier(name string) string {
+	if len(name) < 2 {
+		return name
+	}
+
+	switch first, last := name[0], name[len(name)-1]; {
+	case first == '"' && last == '"':
+		return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+	case first == '`' && last == '`':
+		return strings.ReplaceAll(name[1:len(name)-1], "``", "`")
+	case first == '[' && last == ']':
+		return name[1 : len(name)-1]
+	}
+
+	return name
+}
+
+// SchemaChange describes an object which differs between the schema file and
+// the database
+type SchemaChange struct {
+	// Change is "added" (only in the database), "removed" (only in the schema
+	// file) or "changed"
+	Change string `json:"change"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+}
+
+// String returns a description of the change, e.g. "added table users"
+func (c SchemaChange) String() string {
+	name := c.Name
+	if len(name) > 60 {
+		name = name[:57] + "..."
+	}
+
+	return fmt.Sprintf("%s %s %s", c.Change, c.Kind, name)
+}
+
+// diffSchemas compares the objects in a schema file with the objects in the
+// database. Removed and changed objects are listed in schema file order,
+// followed by added objects in database order.
+func diffSchemas(file, database []schemaObject) []SchemaChange {
+	definitions := map[string]string{}
+	for _, obj := range database {
+		definitions[obj.kind+" "+obj.name] = obj.definition
+	}
+
+	var changes []SchemaChange
+	seen := map[string]bool{}
+	for _, obj := range file {
+		key := obj.kind + " " + obj.name
+		seen[key] = true
+
+		definition, ok := definitions[key]
+		switch {
+		case !ok:
+			changes = append(changes, SchemaChange{Change: "removed", Kind: obj.kind, Name: obj.name})
+		case definition != obj.definition:
+			changes = append(changes, SchemaChange{Change: "changed", Kind: obj.kind, Name: obj.name})
+		}
+	}
+
+	for _, obj := range database {
+		if !seen[obj.kind+" "+obj.name] {
+			changes = append(changes, SchemaChange{Change: "added", Kind: obj.kind, Name: obj.name})
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,129 @@
+package dbmate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchemaPostgres(t *testing.T) {
+	schema := `--
+-- PostgreSQL database dump
+--
+
+\restrict abc123
+
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+CREATE FUNCTION public.touch() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+begin
+  new.updated_at := now(); -- not a comment terminator;
+  return new;
+end;
+$$;
+
+CREATE TABLE public.users (
+    id integer NOT NULL,
+    name text DEFAULT 'a;b'::text
+);
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+/* block; comment */
+CREATE UNIQUE INDEX users_name ON public.users USING btree (name);
+
+--
+-- Dbmate schema migrations
+--
+
+INSERT INTO public.schema_migrations (version) VALUES
+    ('20200101000000');
+`
+
+	objects := parseSchema(schema, "schema_migrations")
+	require.Equal(t, []schemaObject{
+		{kind: "function", name: "public.touch", definition: "CREATE FUNCTION public.touch() RETURNS trigger " +
+			"LANGUAGE plpgsql AS $$ begin new.updated_at := now(); -- not a comment terminator; return new; end; $$"},
+		{kind: "table", name: "public.users", definition: "CREATE TABLE public.users ( id integer NOT NULL, " +
+			"name text DEFAULT 'a;b'::text )\nALTER TABLE ONLY public.users ADD CONSTRAINT users_pkey PRIMARY KEY (id)"},
+		{kind: "index", name: "users_name", definition: "CREATE UNIQUE INDEX users_name ON public.users USING btree (name)"},
+	}, objects)
+}
+
+func TestParseSchemaMySQL(t *testing.T) {
+	schema := "/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n" +
+		"/*!40101 SET character_set_client = utf8 */;\n" +
+		"CREATE TABLE `users` (\n  `id` int NOT NULL\n) ENGINE=InnoDB;\n" +
+		"DELIMITER ;;\n" +
+		"CREATE DEFINER=`root`@`%` FUNCTION `one`() RETURNS int\nBEGIN\n  RETURN 1;\nEND ;;\n" +
+		"DELIMITER ;\n" +
+		"/*!50001 CREATE ALGORITHM=UNDEFINED */\n/*!50013 DEFINER=`root`@`localhost` SQL SECURITY DEFINER */\n" +
+		"/*!50001 VIEW `user_ids` AS select `users`.`id` AS `id` from `users` */;\n" +
+		"LOCK TABLES `schema_migrations` WRITE;\n" +
+		"INSERT INTO `schema_migrations` (version) VALUES\n  ('20200101000000');\n" +
+		"UNLOCK TABLES;\n"
+
+	objects := parseSchema(schema, "schema_migrations")
+	require.Equal(t, []schemaObject{
+		{kind: "table", name: "`users`", definition: "CREATE TABLE `users` ( `id` int NOT NULL ) ENGINE=InnoDB"},
+		{kind: "function", name: "`one`", definition: "CREATE FUNCTION `one`() RETURNS int BEGIN RETURN 1; END"},
+		{kind: "view", name: "`user_ids`", definition: "CREATE ALGORITHM=UNDEFINED SQL SECURITY DEFINER " +
+			"VIEW `user_ids` AS select `users`.`id` AS `id` from `users`"},
+	}, objects)
+}
+
+func TestDiffSchemas(t *testing.T) {
+	file := parseSchema(`
+CREATE TABLE users (id integer);
+CREATE INDEX users_id ON users (id);
+CREATE TABLE posts (id integer);
+INSERT INTO "schema_migrations" (version) VALUES ('1');
+`, "schema_migrations")
+	database := parseSchema(`
+CREATE TABLE users (id integer);
+CREATE INDEX users_id ON users (id, name);
+CREATE TABLE audit_log (id integer);
+INSERT INTO "schema_migrations" (version) VALUES ('1'), ('2');
+`, "schema_migrations")
+
+	changes := diffSchemas(file, database)
+	require.Equal(t, []SchemaChange{
+		{Change: "changed", Kind: "index", Name: "users_id"},
+		{Change: "removed", Kind: "table", Name: "posts"},
+		{Change: "added", Kind: "table", Name: "audit_log"},
+	}, changes)
+	require.Equal(t, "added table audit_log", changes[2].String())
+
+	require.Empty(t, diffSchemas(file, file))
+}
+
+func TestSquashSchema(t *testing.T) {
+	schema := `SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+CREATE TABLE public.schema_migrations (
+    version character varying NOT NULL
+);
+
+CREATE TABLE public.users (
+    id integer NOT NULL
+);
+
+-- index on users
+CREATE INDEX users_id ON public.users USING btree (id);
+
+ALTER TABLE ONLY public.schema_migrations
+    ADD CONSTRAINT schema_migrations_pkey PRIMARY KEY (version);
+
+INSERT INTO public.schema_migrations (version) VALUES
+    ('20200101000000');
+`
+
+	require.Equal(t, "CREATE TABLE public.users (\n    id integer NOT NULL\n);\n\n"+
+		"CREATE INDEX users_id ON public.users USING btree (id);\n\n",
+		squashSchema(schema, "schema_migrations"))
+}
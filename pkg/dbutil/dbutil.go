@@ -3,20 +3,26 @@ package dbutil
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"os/exec"
 	"strings"
+	"time"
 	"unicode"
 )
 
 // Transaction can represent a database or open transaction
 type Transaction interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 // DatabaseName returns the database name from a URL
@@ -38,8 +44,14 @@ func MustClose(c io.Closer) {
 
 // RunCommand runs a command and returns the stdout if successful
 func RunCommand(name string, args ...string) ([]byte, error) {
+	return RunCommandContext(context.Background(), name, args...)
+}
+
+// RunCommandContext runs a command and returns the stdout if successful.
+// The command is killed if the context is done before it completes.
+func RunCommandContext(ctx context.Context, name string, args ...string) ([]byte, error) {
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
+	cmd := exec.CommandContext(ctx, name, args...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
@@ -101,7 +113,12 @@ func TrimLeadingSQLComments(data []byte) ([]byte, error) {
 // it is assumed that the statement returns only one column
 // e.g. schema_migrations table
 func QueryColumn(db Transaction, query string, args ...interface{}) ([]string, error) {
-	rows, err := db.Query(query, args...)
+	return QueryColumnContext(context.Background(), db, query, args...)
+}
+
+// QueryColumnContext is like QueryColumn, but runs the statement with a context
+func QueryColumnContext(ctx context.Context, db Transaction, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -128,8 +145,13 @@ func QueryColumn(db Transaction, query string, args ...interface{}) ([]string, e
 // it is assumed that the statement returns only one row and one column
 // sql NULL is returned as empty string
 func QueryValue(db Transaction, query string, args ...interface{}) (string, error) {
+	return QueryValueContext(context.Background(), db, query, args...)
+}
+
+// QueryValueContext is like QueryValue, but runs the statement with a context
+func QueryValueContext(ctx context.Context, db Transaction, query string, args ...interface{}) (string, error) {
 	var result sql.NullString
-	err := db.QueryRow(query, args...).Scan(&result)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&result)
 	if err != nil || !result.Valid {
 		return "", err
 	}
@@ -137,6 +159,31 @@ func QueryValue(db Transaction, query string, args ...interface{}) (string, erro
 	return result.String, nil
 }
 
+// ErrPoolTooSmall is returned by SessionConn when the connection pool can't
+// spare a connection for the session
+var ErrPoolTooSmall = errors.New("connection pool must allow at least 2 open connections")
+
+// SessionConn reserves a connection from the pool for session level state,
+// such as a lock. The pool must allow at least one other open connection,
+// otherwise any other statement would wait for the session to end.
+func SessionConn(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	if max := db.Stats().MaxOpenConnections; max > 0 && max < 2 {
+		return nil, fmt.Errorf("%w, but is limited to %d", ErrPoolTooSmall, max)
+	}
+
+	return db.Conn(ctx)
+}
+
+// NullString converts an empty string to sql NULL
+func NullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// NullTime converts a zero time to sql NULL
+func NullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
 // MustParseURL parses a URL from string, and panics if it fails.
 // It is used during testing and in cases where we are parsing a generated URL.
 func MustParseURL(s string) *url.URL {
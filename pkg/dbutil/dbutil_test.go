@@ -1,6 +1,7 @@
 package dbutil_test
 
 import (
+	"context"
 	"database/sql"
 	"testing"
 
@@ -56,3 +57,38 @@ func TestQueryValue(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "7", val)
 }
+
+func TestQueryColumnContextCanceled(t *testing.T) {
+	db, err := sql.Open("sqlite3", sqliteMemoryDB)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = dbutil.QueryColumnContext(ctx, db, "select 1")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSessionConn(t *testing.T) {
+	db, err := sql.Open("sqlite3", sqliteMemoryDB)
+	require.NoError(t, err)
+	defer dbutil.MustClose(db)
+
+	conn, err := dbutil.SessionConn(context.Background(), db)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// a session connection would leave no connections for other statements
+	db.SetMaxOpenConns(1)
+	_, err = dbutil.SessionConn(context.Background(), db)
+	require.ErrorIs(t, err, dbutil.ErrPoolTooSmall)
+	require.EqualError(t, err, "connection pool must allow at least 2 open connections, but is limited to 1")
+}
+
+func TestRunCommandContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := dbutil.RunCommandContext(ctx, "sleep", "10")
+	require.Error(t, err)
+}
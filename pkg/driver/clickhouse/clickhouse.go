@@ -2,13 +2,17 @@ package clickhouse
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/url"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
@@ -24,6 +28,7 @@ func init() {
 type Driver struct {
 	migrationsTableName string
 	databaseURL         *url.URL
+	connection          *sql.DB
 	log                 io.Writer
 	clusterParameters   *ClusterParameters
 }
@@ -33,6 +38,7 @@ func NewDriver(config dbmate.DriverConfig) dbmate.Driver {
 	return &Driver{
 		migrationsTableName: config.MigrationsTableName,
 		databaseURL:         config.DatabaseURL,
+		connection:          config.Connection,
 		log:                 config.Log,
 		clusterParameters:   ExtractClusterParametersFromURL(config.DatabaseURL),
 	}
@@ -81,8 +87,13 @@ func connectionString(initialURL *url.URL) string {
 	return u.String()
 }
 
-// Open creates a new database connection
+// Open creates a new database connection, or returns the existing connection
+// the driver was configured with
 func (drv *Driver) Open() (*sql.DB, error) {
+	if drv.connection != nil {
+		return drv.connection, nil
+	}
+
 	return sql.Open("clickhouse", connectionString(drv.databaseURL))
 }
 
@@ -136,6 +147,11 @@ func (drv *Driver) escapeString(str string) string {
 
 // CreateDatabase creates the specified database
 func (drv *Driver) CreateDatabase() error {
+	return drv.CreateDatabaseContext(context.Background())
+}
+
+// CreateDatabaseContext is like CreateDatabase, but aborts when the context is done
+func (drv *Driver) CreateDatabaseContext(ctx context.Context) error {
 	name := drv.databaseName()
 	fmt.Fprintf(drv.log, "Creating: %s\n", name)
 
@@ -147,13 +163,18 @@ func (drv *Driver) CreateDatabase() error {
 
 	q := fmt.Sprintf("CREATE DATABASE %s%s", drv.quoteIdentifier(name), drv.onClusterClause())
 
-	_, err = db.Exec(q)
+	_, err = db.ExecContext(ctx, q)
 
 	return err
 }
 
 // DropDatabase drops the specified database (if it exists)
 func (drv *Driver) DropDatabase() error {
+	return drv.DropDatabaseContext(context.Background())
+}
+
+// DropDatabaseContext is like DropDatabase, but aborts when the context is done
+func (drv *Driver) DropDatabaseContext(ctx context.Context) error {
 	name := drv.databaseName()
 	fmt.Fprintf(drv.log, "Dropping: %s\n", name)
 
@@ -165,37 +186,150 @@ func (drv *Driver) DropDatabase() error {
 
 	q := fmt.Sprintf("DROP DATABASE IF EXISTS %s%s", drv.quoteIdentifier(name), drv.onClusterClause())
 
-	_, err = db.Exec(q)
+	_, err = db.ExecContext(ctx, q)
 
 	return err
 }
 
-func (drv *Driver) schemaDump(db *sql.DB, buf *bytes.Buffer, databaseName string) error {
+// schemaObject is a table, view or dictionary in the schema dump
+type schemaObject struct {
+	name       string
+	rank       int
+	dictionary bool
+	create     string
+}
+
+// schemaObjectRanks orders the kinds of objects in the schema dump (tables
+// first, then dictionaries), before dependencies between them are taken into
+// account
+var schemaObjectRanks = map[string]int{
+	"Dictionary":       1,
+	"View":             2,
+	"LiveView":         2,
+	"WindowView":       2,
+	"MaterializedView": 3,
+}
+
+func (drv *Driver) schemaDump(ctx context.Context, db *sql.DB, buf *bytes.Buffer, databaseName string) error {
 	buf.WriteString("\n--\n-- Database schema\n--\n\n")
 	buf.WriteString(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s;\n\n", drv.quoteIdentifier(databaseName), drv.onClusterClause()))
 
-	tables, err := dbutil.QueryColumn(db, "show tables")
+	var objects []schemaObject
+
+	// inner tables of materialized views are created along with the view
+	rows, err := db.QueryContext(ctx, "select name, engine from system.tables "+
+		"where database = currentDatabase() and not is_temporary and engine != 'Dictionary' "+
+		"and not startsWith(name, '.inner')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, engine string
+		if err := rows.Scan(&name, &engine); err != nil {
+			return err
+		}
+		if name == drv.lockTableName() {
+			continue
+		}
+		objects = append(objects, schemaObject{name: name, rank: schemaObjectRanks[engine]})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	dictionaries, err := dbutil.QueryColumnContext(ctx, db,
+		"select name from system.dictionaries where database = currentDatabase()")
 	if err != nil {
 		return err
 	}
-	sort.Strings(tables)
+	for _, name := range dictionaries {
+		objects = append(objects, schemaObject{name: name, rank: schemaObjectRanks["Dictionary"], dictionary: true})
+	}
 
-	for _, table := range tables {
-		var clause string
-		err = db.QueryRow("show create table " + drv.quoteIdentifier(table)).Scan(&clause)
+	for i := range objects {
+		query := "show create table "
+		if objects[i].dictionary {
+			query = "show create dictionary "
+		}
+		err = db.QueryRowContext(ctx, query+drv.quoteIdentifier(objects[i].name)).Scan(&objects[i].create)
 		if err != nil {
 			return err
 		}
-		buf.WriteString(clause + ";\n\n")
+	}
+
+	for _, obj := range sortSchemaObjects(objects, databaseName) {
+		buf.WriteString(obj.create + ";\n\n")
 	}
 	return nil
 }
 
-func (drv *Driver) schemaMigrationsDump(db *sql.DB, buf *bytes.Buffer) error {
+// sortSchemaObjects orders tables, dictionaries, views and materialized views
+// so that each object follows the objects it references. Objects are otherwise
+// sorted by kind and then by name, so the dump is stable.
+func sortSchemaObjects(objects []schemaObject, databaseName string) []schemaObject {
+	objects = append([]schemaObject(nil), objects...)
+	sort.SliceStable(objects, func(i, j int) bool {
+		if objects[i].rank != objects[j].rank {
+			return objects[i].rank < objects[j].rank
+		}
+		return objects[i].name < objects[j].name
+	})
+
+	patterns := make([]*regexp.Regexp, len(objects))
+	for i, obj := range objects {
+		patterns[i] = referencePattern(databaseName, obj.name)
+	}
+
+	sorted := make([]schemaObject, 0, len(objects))
+	done := make([]bool, len(objects))
+	visiting := make([]bool, len(objects))
+
+	var visit func(int)
+	visit = func(i int) {
+		if done[i] || visiting[i] {
+			return
+		}
+		visiting[i] = true
+
+		for j := range objects {
+			if j != i && patterns[j].MatchString(objects[i].create) {
+				visit(j)
+			}
+		}
+
+		visiting[i] = false
+		done[i] = true
+		sorted = append(sorted, objects[i])
+	}
+
+	for i := range objects {
+		visit(i)
+	}
+
+	return sorted
+}
+
+// referencePattern matches a reference to a table or dictionary, either as an
+// (optionally qualified and quoted) identifier, or as a string such as the
+// table of a dictionary source or the first argument to dictGet()
+func referencePattern(databaseName, name string) *regexp.Regexp {
+	ident := func(s string) string {
+		s = regexp.QuoteMeta(s)
+		return "(?:" + s + "|`" + s + "`|\"" + s + "\")"
+	}
+
+	return regexp.MustCompile(
+		"(?:^|[^\\w.`\"])(?:" + ident(databaseName) + "\\.)?" + ident(name) + "(?:[^\\w`\"]|$)" +
+			"|'(?:" + regexp.QuoteMeta(databaseName) + "\\.)?" + regexp.QuoteMeta(name) + "'")
+}
+
+func (drv *Driver) schemaMigrationsDump(ctx context.Context, db *sql.DB, buf *bytes.Buffer) error {
 	migrationsTable := drv.quotedMigrationsTableName()
 
 	// load applied migrations
-	migrations, err := dbutil.QueryColumn(db,
+	migrations, err := dbutil.QueryColumnContext(ctx, db,
 		fmt.Sprintf("select version from %s final ", migrationsTable)+
 			"where applied order by version asc",
 	)
@@ -223,15 +357,20 @@ func (drv *Driver) schemaMigrationsDump(db *sql.DB, buf *bytes.Buffer) error {
 
 // DumpSchema returns the current database schema
 func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
+	return drv.DumpSchemaContext(context.Background(), db)
+}
+
+// DumpSchemaContext is like DumpSchema, but aborts when the context is done
+func (drv *Driver) DumpSchemaContext(ctx context.Context, db *sql.DB) ([]byte, error) {
 	var buf bytes.Buffer
 	var err error
 
-	err = drv.schemaDump(db, &buf, drv.databaseName())
+	err = drv.schemaDump(ctx, db, &buf, drv.databaseName())
 	if err != nil {
 		return nil, err
 	}
 
-	err = drv.schemaMigrationsDump(db, &buf)
+	err = drv.schemaMigrationsDump(ctx, db, &buf)
 	if err != nil {
 		return nil, err
 	}
@@ -239,8 +378,89 @@ func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// LoadSchemaContext loads a schema file one statement at a time, since
+// ClickHouse doesn't execute multiple statements in a single query
+func (drv *Driver) LoadSchemaContext(ctx context.Context, db *sql.DB, schema string) error {
+	for _, stmt := range splitStatements(schema) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return drv.QueryError(stmt, err)
+		}
+	}
+
+	return nil
+}
+
+// splitStatements splits a schema file into statements at each semicolon
+// which is not part of a quoted string, identifier or comment. Comments are
+// removed, and empty statements are skipped.
+func splitStatements(schema string) []string {
+	statements := []string{}
+	var stmt strings.Builder
+
+	flush := func() {
+		if trimmed := strings.TrimSpace(stmt.String()); trimmed != "" {
+			statements = append(statements, trimmed)
+		}
+		stmt.Reset()
+	}
+
+	for i := 0; i < len(schema); i++ {
+		ch := schema[i]
+		switch {
+		case ch == ';':
+			flush()
+		case ch == '-' && strings.HasPrefix(schema[i:], "--"):
+			end := strings.IndexByte(schema[i:], '\n')
+			if end == -1 {
+				i = len(schema)
+			} else {
+				i += end - 1
+			}
+		case ch == '/' && strings.HasPrefix(schema[i:], "/*"):
+			end := strings.Index(schema[i+2:], "*/")
+			if end == -1 {
+				i = len(schema)
+			} else {
+				i += end + 3
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			// quotes are escaped with a backslash or by doubling them
+			j := i + 1
+			for j < len(schema) {
+				if schema[j] == '\\' {
+					j += 2
+					continue
+				}
+				if schema[j] == ch {
+					if j+1 < len(schema) && schema[j+1] == ch {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j >= len(schema) {
+				j = len(schema) - 1
+			}
+			stmt.WriteString(schema[i : j+1])
+			i = j
+		default:
+			stmt.WriteByte(ch)
+		}
+	}
+	flush()
+
+	return statements
+}
+
 // DatabaseExists determines whether the database exists
 func (drv *Driver) DatabaseExists() (bool, error) {
+	return drv.DatabaseExistsContext(context.Background())
+}
+
+// DatabaseExistsContext is like DatabaseExists, but aborts when the context is done
+func (drv *Driver) DatabaseExistsContext(ctx context.Context) (bool, error) {
 	name := drv.databaseName()
 
 	db, err := drv.openClickHouseDB()
@@ -250,7 +470,7 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 	defer dbutil.MustClose(db)
 
 	exists := false
-	err = db.QueryRow("SELECT 1 FROM system.databases where name = ?", name).
+	err = db.QueryRowContext(ctx, "SELECT 1 FROM system.databases where name = ?", name).
 		Scan(&exists)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -261,8 +481,13 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 
 // MigrationsTableExists checks if the schema_migrations table exists
 func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
+	return drv.MigrationsTableExistsContext(context.Background(), db)
+}
+
+// MigrationsTableExistsContext is like MigrationsTableExists, but aborts when the context is done
+func (drv *Driver) MigrationsTableExistsContext(ctx context.Context, db *sql.DB) (bool, error) {
 	exists := false
-	err := db.QueryRow(fmt.Sprintf("EXISTS TABLE %s", drv.quotedMigrationsTableName())).
+	err := db.QueryRowContext(ctx, fmt.Sprintf("EXISTS TABLE %s", drv.quotedMigrationsTableName())).
 		Scan(&exists)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -273,14 +498,12 @@ func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
 
 // CreateMigrationsTable creates the schema migrations table
 func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
-	engineClause := "ReplacingMergeTree(ts)"
-	if drv.clusterParameters.OnCluster {
-		escapedZooPath := drv.escapeString(drv.clusterParameters.ZooPath)
-		escapedReplicaMacro := drv.escapeString(drv.clusterParameters.ReplicaMacro)
-		engineClause = fmt.Sprintf("ReplicatedReplacingMergeTree('%s', '%s', ts)", escapedZooPath, escapedReplicaMacro)
-	}
+	return drv.CreateMigrationsTableContext(context.Background(), db)
+}
 
-	_, err := db.Exec(fmt.Sprintf(`
+// CreateMigrationsTableContext is like CreateMigrationsTable, but aborts when the context is done
+func (drv *Driver) CreateMigrationsTableContext(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
 		create table if not exists %s%s (
 			version String,
 			ts DateTime default now(),
@@ -288,21 +511,91 @@ func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
 		) engine = %s
 		primary key version
 		order by version
-	`, drv.quotedMigrationsTableName(), drv.onClusterClause(), engineClause))
+	`, drv.quotedMigrationsTableName(), drv.onClusterClause(), drv.replacingMergeTreeEngine()))
+	if err != nil {
+		return err
+	}
 
-	return err
+	return drv.upgradeMigrationsTable(ctx, db)
+}
+
+// replacingMergeTreeEngine returns the engine clause for tables where the
+// row with the latest ts replaces earlier rows with the same key
+func (drv *Driver) replacingMergeTreeEngine() string {
+	if drv.clusterParameters.OnCluster {
+		escapedZooPath := drv.escapeString(drv.clusterParameters.ZooPath)
+		escapedReplicaMacro := drv.escapeString(drv.clusterParameters.ReplicaMacro)
+		return fmt.Sprintf("ReplicatedReplacingMergeTree('%s', '%s', ts)", escapedZooPath, escapedReplicaMacro)
+	}
+
+	return "ReplacingMergeTree(ts)"
+}
+
+// migrationsTableColumns lists the columns recorded alongside each version,
+// which are added to existing migrations tables if they are missing
+var migrationsTableColumns = []struct {
+	name       string
+	definition string
+}{
+	{"applied_at", "Nullable(DateTime64(6, 'UTC'))"},
+	{"duration_ms", "Nullable(Int64)"},
+	{"checksum", "Nullable(String)"},
+	{"dbmate_version", "Nullable(String)"},
+}
+
+// migrationsTableColumnNames returns the names of the existing migrations table columns
+func (drv *Driver) migrationsTableColumnNames(ctx context.Context, db dbutil.Transaction) (map[string]bool, error) {
+	columns, err := dbutil.QueryColumnContext(ctx, db, "select name from system.columns "+
+		"where database = currentDatabase() and table = ?", drv.migrationsTableName)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, column := range columns {
+		existing[column] = true
+	}
+
+	return existing, nil
+}
+
+// upgradeMigrationsTable adds any missing columns to the migrations table
+func (drv *Driver) upgradeMigrationsTable(ctx context.Context, db *sql.DB) error {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range migrationsTableColumns {
+		if existing[column.name] {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf("alter table %s%s add column if not exists %s %s",
+			drv.quotedMigrationsTableName(), drv.onClusterClause(), column.name, column.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
 func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, error) {
+	return drv.SelectMigrationsContext(context.Background(), db, limit)
+}
+
+// SelectMigrationsContext is like SelectMigrations, but aborts when the context is done
+func (drv *Driver) SelectMigrationsContext(ctx context.Context, db *sql.DB, limit int) (map[string]bool, error) {
 	query := fmt.Sprintf("select version from %s final where applied order by version desc",
 		drv.quotedMigrationsTableName())
 
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -326,18 +619,104 @@ func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, err
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the recorded details of all applied migrations
+func (drv *Driver) SelectMigrationRecords(db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	return drv.SelectMigrationRecordsContext(context.Background(), db)
+}
+
+// SelectMigrationRecordsContext is like SelectMigrationRecords, but aborts when the context is done
+func (drv *Driver) SelectMigrationRecordsContext(ctx context.Context, db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// migrations tables which have not been upgraded yet only record versions
+	upgraded := true
+	for _, column := range migrationsTableColumns {
+		upgraded = upgraded && existing[column.name]
+	}
+
+	query := "select version"
+	if upgraded {
+		query += ", applied_at, duration_ms, checksum, dbmate_version"
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("%s from %s final where applied order by version asc", query, drv.quotedMigrationsTableName()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer dbutil.MustClose(rows)
+
+	migrations := map[string]dbmate.MigrationRecord{}
+	for rows.Next() {
+		var version string
+		var appliedAt sql.NullTime
+		var durationMs sql.NullInt64
+		var checksum, dbmateVersion sql.NullString
+
+		dest := []interface{}{&version}
+		if upgraded {
+			dest = append(dest, &appliedAt, &durationMs, &checksum, &dbmateVersion)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		migrations[version] = dbmate.MigrationRecord{
+			Version:       version,
+			AppliedAt:     appliedAt.Time,
+			Duration:      time.Duration(durationMs.Int64) * time.Millisecond,
+			Checksum:      checksum.String,
+			DbmateVersion: dbmateVersion.String,
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
 // InsertMigration adds a new migration record
 func (drv *Driver) InsertMigration(db dbutil.Transaction, version string) error {
-	_, err := db.Exec(
-		fmt.Sprintf("insert into %s (version) values (?)", drv.quotedMigrationsTableName()),
-		version)
+	return drv.InsertMigrationContext(context.Background(), db, version)
+}
+
+// InsertMigrationContext is like InsertMigration, but aborts when the context is done
+func (drv *Driver) InsertMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	return drv.InsertMigrationRecordContext(ctx, db, dbmate.MigrationRecord{
+		Version:       version,
+		AppliedAt:     time.Now().UTC(),
+		DbmateVersion: dbmate.Version,
+	})
+}
+
+// InsertMigrationRecord adds a new migration record, including its details
+func (drv *Driver) InsertMigrationRecord(db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	return drv.InsertMigrationRecordContext(context.Background(), db, record)
+}
+
+// InsertMigrationRecordContext is like InsertMigrationRecord, but aborts when the context is done
+func (drv *Driver) InsertMigrationRecordContext(ctx context.Context, db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("insert into %s (version, applied_at, duration_ms, checksum, dbmate_version) "+
+			"values (?, ?, ?, ?, ?)", drv.quotedMigrationsTableName()),
+		record.Version, dbutil.NullTime(record.AppliedAt), record.Duration.Milliseconds(),
+		dbutil.NullString(record.Checksum), dbutil.NullString(record.DbmateVersion))
 
 	return err
 }
 
 // DeleteMigration removes a migration record
 func (drv *Driver) DeleteMigration(db dbutil.Transaction, version string) error {
-	_, err := db.Exec(
+	return drv.DeleteMigrationContext(context.Background(), db, version)
+}
+
+// DeleteMigrationContext is like DeleteMigration, but aborts when the context is done
+func (drv *Driver) DeleteMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	_, err := db.ExecContext(ctx,
 		fmt.Sprintf("insert into %s (version, applied) values (?, ?)",
 			drv.quotedMigrationsTableName()),
 		version, false,
@@ -346,16 +725,117 @@ func (drv *Driver) DeleteMigration(db dbutil.Transaction, version string) error
 	return err
 }
 
+// UpdateMigrationChecksum replaces the recorded checksum of an applied migration
+func (drv *Driver) UpdateMigrationChecksum(db dbutil.Transaction, version string, checksum string) error {
+	return drv.UpdateMigrationChecksumContext(context.Background(), db, version, checksum)
+}
+
+// UpdateMigrationChecksumContext is like UpdateMigrationChecksum, but aborts when the context is done
+func (drv *Driver) UpdateMigrationChecksumContext(ctx context.Context, db dbutil.Transaction, version string, checksum string) error {
+	// insert a newer row with the same details, which replaces the original when merged
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("insert into %[1]s (version, applied_at, duration_ms, checksum, dbmate_version) "+
+			"select version, applied_at, duration_ms, ?, dbmate_version from %[1]s final "+
+			"where applied and version = ?", drv.quotedMigrationsTableName()),
+		checksum, version)
+
+	return err
+}
+
+// lockPollInterval specifies how often to check whether the migration lock has been acquired
+const lockPollInterval = 500 * time.Millisecond
+
+// Lock acquires the migration lock. ClickHouse has no locking primitives, so
+// each process records a claim in a lock table alongside the migrations table,
+// and the earliest unreleased claim holds the lock. A claim must be observed as
+// the earliest twice in a row, to allow concurrent claims to become visible.
+func (drv *Driver) Lock(ctx context.Context, db *sql.DB) (func() error, error) {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		create table if not exists %s%s (
+			owner String,
+			claimed_at DateTime64(6) default now64(6),
+			released UInt8 default 0,
+			ts DateTime64(6) default now64(6)
+		) engine = %s
+		primary key owner
+		order by owner
+	`, drv.quoteIdentifier(drv.lockTableName()), drv.onClusterClause(), drv.replacingMergeTreeEngine()))
+	if err != nil {
+		return nil, err
+	}
+
+	ownerBytes := make([]byte, 16)
+	if _, err := rand.Read(ownerBytes); err != nil {
+		return nil, err
+	}
+	owner := hex.EncodeToString(ownerBytes)
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("insert into %s (owner) values (?)",
+		drv.quoteIdentifier(drv.lockTableName())), owner)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := func() error {
+		_, err := db.ExecContext(context.Background(), fmt.Sprintf("insert into %s (owner, released) values (?, 1)",
+			drv.quoteIdentifier(drv.lockTableName())), owner)
+		return err
+	}
+
+	confirmed := false
+	for {
+		var holder, claimedAt sql.NullString
+		err := db.QueryRowContext(ctx, fmt.Sprintf("select owner, toString(claimed_at) from %s final "+
+			"where not released order by claimed_at, owner limit 1",
+			drv.quoteIdentifier(drv.lockTableName()))).Scan(&holder, &claimedAt)
+		if err != nil && err != sql.ErrNoRows {
+			_ = unlock()
+			return nil, err
+		}
+
+		if holder.String == owner {
+			if confirmed {
+				return unlock, nil
+			}
+			confirmed = true
+		} else {
+			confirmed = false
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = unlock()
+			// claims left behind by a process which was killed must be released by hand
+			return nil, fmt.Errorf("%w: lock claimed at %s: if no other dbmate process is running, "+
+				"truncate the %s table to release the lock", ctx.Err(), claimedAt.String, drv.lockTableName())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func (drv *Driver) lockTableName() string {
+	return drv.migrationsTableName + "_lock"
+}
+
 // Ping verifies a connection to the database server. It does not verify whether the
 // specified database exists.
 func (drv *Driver) Ping() error {
+	return drv.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but aborts when the context is done
+func (drv *Driver) PingContext(ctx context.Context) error {
+	if drv.connection != nil {
+		return drv.connection.PingContext(ctx)
+	}
+
 	db, err := drv.Open()
 	if err != nil {
 		return err
 	}
 	defer dbutil.MustClose(db)
 
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err == nil {
 		return nil
 	}
@@ -2,7 +2,11 @@ package clickhouse
 
 import (
 	"database/sql"
+	"io"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
@@ -136,6 +140,98 @@ func TestClickHouseDumpSchema(t *testing.T) {
 	require.EqualError(t, err, "code: 81, message: Database fakedb doesn't exist")
 }
 
+func TestClickHouseDumpSchemaDependencies(t *testing.T) {
+	drv := testClickHouseDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestClickHouseDB(t, drv)
+	defer dbutil.MustClose(db)
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	for _, stmt := range []string{
+		"create table z_events (id UInt64, user_id UInt64) engine = MergeTree order by id",
+		"create table a_counts (user_id UInt64, n UInt64) engine = SummingMergeTree order by user_id",
+		"create materialized view a_counts_mv to a_counts as select user_id, count() as n from z_events group by user_id",
+		"create view a_recent as select * from z_events where id > 100",
+		"create table m_users (id UInt64, name String) engine = MergeTree order by id",
+		"create dictionary b_users_dict (id UInt64, name String) primary key id " +
+			"source(clickhouse(table 'm_users')) layout(flat()) lifetime(0)",
+	} {
+		_, err = db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	schema, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+
+	// objects follow the objects they reference
+	index := func(name string) int {
+		i := strings.Index(string(schema), drv.databaseName()+"."+name+" ")
+		require.NotEqual(t, -1, i, name)
+		return i
+	}
+	require.Less(t, index("z_events"), index("a_recent"))
+	require.Less(t, index("z_events"), index("a_counts_mv"))
+	require.Less(t, index("a_counts"), index("a_counts_mv"))
+	require.Less(t, index("m_users"), index("b_users_dict"))
+	require.Contains(t, string(schema), "CREATE DICTIONARY "+drv.databaseName()+".b_users_dict")
+	require.NotContains(t, string(schema), ".inner")
+
+	// the schema can be loaded into an empty database with dbmate load
+	db = prepTestClickHouseDB(t, drv)
+	defer dbutil.MustClose(db)
+	dm := dbmate.New(dbutil.MustParseURL(os.Getenv("CLICKHOUSE_TEST_URL")))
+	dm.MigrationsTableName = "test_migrations"
+	dm.SchemaFile = filepath.Join(t.TempDir(), "schema.sql")
+	dm.Log = io.Discard
+	err = os.WriteFile(dm.SchemaFile, schema, 0o644)
+	require.NoError(t, err)
+	err = dm.LoadSchema()
+	require.NoError(t, err)
+
+	schema2, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Equal(t, string(schema), string(schema2))
+}
+
+func TestClickHouseSplitStatements(t *testing.T) {
+	schema := "\n--\n-- Database schema\n--\n\n" +
+		"CREATE DATABASE IF NOT EXISTS test;\n\n" +
+		"CREATE TABLE test.t\n(\n    `a;b` String DEFAULT 'x;\\'y',\n    c String COMMENT 'it''s; here'\n)\n" +
+		"ENGINE = MergeTree /* a; comment */ ORDER BY c;\n\n" +
+		"\n--\n-- Dbmate schema migrations\n--\n\n" +
+		"INSERT INTO test.schema_migrations (version) VALUES\n    ('1'),\n    ('2');\n"
+
+	require.Equal(t, []string{
+		"CREATE DATABASE IF NOT EXISTS test",
+		"CREATE TABLE test.t\n(\n    `a;b` String DEFAULT 'x;\\'y',\n    c String COMMENT 'it''s; here'\n)\n" +
+			"ENGINE = MergeTree  ORDER BY c",
+		"INSERT INTO test.schema_migrations (version) VALUES\n    ('1'),\n    ('2')",
+	}, splitStatements(schema))
+
+	require.Equal(t, []string{}, splitStatements("-- comment only\n\n"))
+}
+
+func TestClickHouseSortSchemaObjects(t *testing.T) {
+	objects := []schemaObject{
+		{name: "a_mv", rank: 3, create: "CREATE MATERIALIZED VIEW db.a_mv TO db.b_totals AS SELECT * FROM db.z_events"},
+		{name: "b_totals", create: "CREATE TABLE db.b_totals (n UInt64, user String DEFAULT dictGet('db.c_dict', 'name', 1))"},
+		{name: "c_dict", rank: 1, dictionary: true, create: "CREATE DICTIONARY db.c_dict SOURCE(CLICKHOUSE(TABLE 'y_users'))"},
+		{name: "v", rank: 2, create: "CREATE VIEW db.v AS SELECT * FROM `db`.`z_events_archive`"},
+		{name: "y_users", create: "CREATE TABLE db.y_users (id UInt64)"},
+		{name: "z_events", create: "CREATE TABLE db.z_events (id UInt64)"},
+		{name: "z_events_archive", create: "CREATE TABLE db.z_events_archive (id UInt64)"},
+	}
+
+	var names []string
+	for _, obj := range sortSchemaObjects(objects, "db") {
+		names = append(names, obj.name)
+	}
+
+	require.Equal(t, []string{"y_users", "c_dict", "b_totals", "z_events", "z_events_archive", "v", "a_mv"}, names)
+}
+
 func TestClickHouseDatabaseExists(t *testing.T) {
 	drv := testClickHouseDriver(t)
 
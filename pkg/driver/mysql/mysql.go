@@ -2,12 +2,18 @@ package mysql
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
@@ -23,7 +29,9 @@ func init() {
 type Driver struct {
 	migrationsTableName string
 	databaseURL         *url.URL
+	connection          *sql.DB
 	log                 io.Writer
+	nativeDump          bool
 }
 
 // NewDriver initializes the driver
@@ -31,7 +39,9 @@ func NewDriver(config dbmate.DriverConfig) dbmate.Driver {
 	return &Driver{
 		migrationsTableName: config.MigrationsTableName,
 		databaseURL:         config.DatabaseURL,
+		connection:          config.Connection,
 		log:                 config.Log,
+		nativeDump:          config.NativeDump,
 	}
 }
 
@@ -69,8 +79,13 @@ func connectionString(u *url.URL) string {
 	return normalizedString
 }
 
-// Open creates a new database connection
+// Open creates a new database connection, or returns the existing connection
+// the driver was configured with
 func (drv *Driver) Open() (*sql.DB, error) {
+	if drv.connection != nil {
+		return drv.connection, nil
+	}
+
 	return sql.Open("mysql", connectionString(drv.databaseURL))
 }
 
@@ -95,6 +110,11 @@ func (drv *Driver) quoteIdentifier(str string) string {
 
 // CreateDatabase creates the specified database
 func (drv *Driver) CreateDatabase() error {
+	return drv.CreateDatabaseContext(context.Background())
+}
+
+// CreateDatabaseContext is like CreateDatabase, but aborts when the context is done
+func (drv *Driver) CreateDatabaseContext(ctx context.Context) error {
 	name := dbutil.DatabaseName(drv.databaseURL)
 	fmt.Fprintf(drv.log, "Creating: %s\n", name)
 
@@ -104,7 +124,7 @@ func (drv *Driver) CreateDatabase() error {
 	}
 	defer dbutil.MustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("create database %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("create database %s",
 		drv.quoteIdentifier(name)))
 
 	return err
@@ -112,6 +132,11 @@ func (drv *Driver) CreateDatabase() error {
 
 // DropDatabase drops the specified database (if it exists)
 func (drv *Driver) DropDatabase() error {
+	return drv.DropDatabaseContext(context.Background())
+}
+
+// DropDatabaseContext is like DropDatabase, but aborts when the context is done
+func (drv *Driver) DropDatabaseContext(ctx context.Context) error {
 	name := dbutil.DatabaseName(drv.databaseURL)
 	fmt.Fprintf(drv.log, "Dropping: %s\n", name)
 
@@ -121,7 +146,7 @@ func (drv *Driver) DropDatabase() error {
 	}
 	defer dbutil.MustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("drop database if exists %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("drop database if exists %s",
 		drv.quoteIdentifier(name)))
 
 	return err
@@ -157,11 +182,11 @@ func (drv *Driver) mysqldumpArgs() []string {
 	return args
 }
 
-func (drv *Driver) schemaMigrationsDump(db *sql.DB) ([]byte, error) {
+func (drv *Driver) schemaMigrationsDump(ctx context.Context, db *sql.DB) ([]byte, error) {
 	migrationsTable := drv.quotedMigrationsTableName()
 
 	// load applied migrations
-	migrations, err := dbutil.QueryColumn(db,
+	migrations, err := dbutil.QueryColumnContext(ctx, db,
 		fmt.Sprintf("select quote(version) from %s order by version asc", migrationsTable))
 	if err != nil {
 		return nil, err
@@ -186,12 +211,23 @@ func (drv *Driver) schemaMigrationsDump(db *sql.DB) ([]byte, error) {
 
 // DumpSchema returns the current database schema
 func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
-	schema, err := dbutil.RunCommand("mysqldump", drv.mysqldumpArgs()...)
+	return drv.DumpSchemaContext(context.Background(), db)
+}
+
+// DumpSchemaContext is like DumpSchema, but aborts when the context is done
+func (drv *Driver) DumpSchemaContext(ctx context.Context, db *sql.DB) ([]byte, error) {
+	var schema []byte
+	var err error
+	if drv.nativeDump {
+		schema, err = drv.nativeSchemaDump(ctx, db)
+	} else {
+		schema, err = dbutil.RunCommandContext(ctx, "mysqldump", drv.mysqldumpArgs()...)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	migrations, err := drv.schemaMigrationsDump(db)
+	migrations, err := drv.schemaMigrationsDump(ctx, db)
 	if err != nil {
 		return nil, err
 	}
@@ -204,6 +240,18 @@ func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
 	return trimAutoincrementValues(schema), nil
 }
 
+// LoadSchemaContext loads a schema file, which may use DELIMITER statements
+// for routines and triggers like mysqldump output
+func (drv *Driver) LoadSchemaContext(ctx context.Context, db *sql.DB, schema string) error {
+	for _, batch := range splitDelimiters(schema) {
+		if _, err := db.ExecContext(ctx, batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // trimAutoincrementValues removes AUTO_INCREMENT values from MySQL schema dumps
 func trimAutoincrementValues(data []byte) []byte {
 	aiPattern := regexp.MustCompile(" AUTO_INCREMENT=[0-9]*")
@@ -212,6 +260,11 @@ func trimAutoincrementValues(data []byte) []byte {
 
 // DatabaseExists determines whether the database exists
 func (drv *Driver) DatabaseExists() (bool, error) {
+	return drv.DatabaseExistsContext(context.Background())
+}
+
+// DatabaseExistsContext is like DatabaseExists, but aborts when the context is done
+func (drv *Driver) DatabaseExistsContext(ctx context.Context) (bool, error) {
 	name := dbutil.DatabaseName(drv.databaseURL)
 
 	db, err := drv.openRootDB()
@@ -221,7 +274,7 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 	defer dbutil.MustClose(db)
 
 	exists := false
-	err = db.QueryRow("select true from information_schema.schemata "+
+	err = db.QueryRowContext(ctx, "select true from information_schema.schemata "+
 		"where schema_name = ?", name).Scan(&exists)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -232,8 +285,13 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 
 // MigrationsTableExists checks if the schema_migrations table exists
 func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
+	return drv.MigrationsTableExistsContext(context.Background(), db)
+}
+
+// MigrationsTableExistsContext is like MigrationsTableExists, but aborts when the context is done
+func (drv *Driver) MigrationsTableExistsContext(ctx context.Context, db *sql.DB) (bool, error) {
 	match := ""
-	err := db.QueryRow(fmt.Sprintf("show tables like '%s'",
+	err := db.QueryRowContext(ctx, fmt.Sprintf("show tables like '%s'",
 		drv.migrationsTableName)).
 		Scan(&match)
 	if err == sql.ErrNoRows {
@@ -245,21 +303,84 @@ func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
 
 // CreateMigrationsTable creates the schema_migrations table
 func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
-	_, err := db.Exec(fmt.Sprintf(
+	return drv.CreateMigrationsTableContext(context.Background(), db)
+}
+
+// CreateMigrationsTableContext is like CreateMigrationsTable, but aborts when the context is done
+func (drv *Driver) CreateMigrationsTableContext(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
 		"create table if not exists %s (version varchar(128) primary key)",
 		drv.quotedMigrationsTableName()))
+	if err != nil {
+		return err
+	}
 
-	return err
+	return drv.upgradeMigrationsTable(ctx, db)
+}
+
+// migrationsTableColumns lists the columns recorded alongside each version,
+// which are added to existing migrations tables if they are missing
+var migrationsTableColumns = []struct {
+	name       string
+	definition string
+}{
+	{"applied_at", "datetime(6) null"},
+	{"duration_ms", "bigint"},
+	{"checksum", "varchar(64)"},
+	{"dbmate_version", "varchar(32)"},
+}
+
+// migrationsTableColumnNames returns the names of the existing migrations table columns
+func (drv *Driver) migrationsTableColumnNames(ctx context.Context, db dbutil.Transaction) (map[string]bool, error) {
+	columns, err := dbutil.QueryColumnContext(ctx, db, "select column_name from information_schema.columns "+
+		"where table_schema = database() and table_name = ?", drv.migrationsTableName)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, column := range columns {
+		existing[strings.ToLower(column)] = true
+	}
+
+	return existing, nil
+}
+
+// upgradeMigrationsTable adds any missing columns to the migrations table
+func (drv *Driver) upgradeMigrationsTable(ctx context.Context, db *sql.DB) error {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range migrationsTableColumns {
+		if existing[column.name] {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf("alter table %s add column %s %s",
+			drv.quotedMigrationsTableName(), column.name, column.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
 func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, error) {
+	return drv.SelectMigrationsContext(context.Background(), db, limit)
+}
+
+// SelectMigrationsContext is like SelectMigrations, but aborts when the context is done
+func (drv *Driver) SelectMigrationsContext(ctx context.Context, db *sql.DB, limit int) (map[string]bool, error) {
 	query := fmt.Sprintf("select version from %s order by version desc", drv.quotedMigrationsTableName())
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -283,34 +404,221 @@ func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, err
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the recorded details of all applied migrations
+func (drv *Driver) SelectMigrationRecords(db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	return drv.SelectMigrationRecordsContext(context.Background(), db)
+}
+
+// SelectMigrationRecordsContext is like SelectMigrationRecords, but aborts when the context is done
+func (drv *Driver) SelectMigrationRecordsContext(ctx context.Context, db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// migrations tables which have not been upgraded yet only record versions
+	upgraded := true
+	for _, column := range migrationsTableColumns {
+		upgraded = upgraded && existing[column.name]
+	}
+
+	query := "select version"
+	if upgraded {
+		query += ", applied_at, duration_ms, checksum, dbmate_version"
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("%s from %s order by version asc", query, drv.quotedMigrationsTableName()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer dbutil.MustClose(rows)
+
+	migrations := map[string]dbmate.MigrationRecord{}
+	for rows.Next() {
+		var version string
+		var appliedAt sql.NullString
+		var durationMs sql.NullInt64
+		var checksum, dbmateVersion sql.NullString
+
+		dest := []interface{}{&version}
+		if upgraded {
+			dest = append(dest, &appliedAt, &durationMs, &checksum, &dbmateVersion)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		migrations[version] = dbmate.MigrationRecord{
+			Version:       version,
+			AppliedAt:     parseDatetime(appliedAt.String),
+			Duration:      time.Duration(durationMs.Int64) * time.Millisecond,
+			Checksum:      checksum.String,
+			DbmateVersion: dbmateVersion.String,
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
+// parseDatetime parses a datetime column value, which is returned as a string
+// unless parseTime is enabled in the connection string
+func parseDatetime(s string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
 // InsertMigration adds a new migration record
 func (drv *Driver) InsertMigration(db dbutil.Transaction, version string) error {
-	_, err := db.Exec(
-		fmt.Sprintf("insert into %s (version) values (?)", drv.quotedMigrationsTableName()),
-		version)
+	return drv.InsertMigrationContext(context.Background(), db, version)
+}
+
+// InsertMigrationContext is like InsertMigration, but aborts when the context is done
+func (drv *Driver) InsertMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	return drv.InsertMigrationRecordContext(ctx, db, dbmate.MigrationRecord{
+		Version:       version,
+		AppliedAt:     time.Now().UTC(),
+		DbmateVersion: dbmate.Version,
+	})
+}
+
+// InsertMigrationRecord adds a new migration record, including its details
+func (drv *Driver) InsertMigrationRecord(db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	return drv.InsertMigrationRecordContext(context.Background(), db, record)
+}
+
+// InsertMigrationRecordContext is like InsertMigrationRecord, but aborts when the context is done
+func (drv *Driver) InsertMigrationRecordContext(ctx context.Context, db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("insert into %s (version, applied_at, duration_ms, checksum, dbmate_version) "+
+			"values (?, ?, ?, ?, ?)", drv.quotedMigrationsTableName()),
+		record.Version, dbutil.NullTime(record.AppliedAt), record.Duration.Milliseconds(),
+		dbutil.NullString(record.Checksum), dbutil.NullString(record.DbmateVersion))
 
 	return err
 }
 
 // DeleteMigration removes a migration record
 func (drv *Driver) DeleteMigration(db dbutil.Transaction, version string) error {
-	_, err := db.Exec(
+	return drv.DeleteMigrationContext(context.Background(), db, version)
+}
+
+// DeleteMigrationContext is like DeleteMigration, but aborts when the context is done
+func (drv *Driver) DeleteMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	_, err := db.ExecContext(ctx,
 		fmt.Sprintf("delete from %s where version = ?", drv.quotedMigrationsTableName()),
 		version)
 
 	return err
 }
 
+// UpdateMigrationChecksum replaces the recorded checksum of an applied migration
+func (drv *Driver) UpdateMigrationChecksum(db dbutil.Transaction, version string, checksum string) error {
+	return drv.UpdateMigrationChecksumContext(context.Background(), db, version, checksum)
+}
+
+// UpdateMigrationChecksumContext is like UpdateMigrationChecksum, but aborts when the context is done
+func (drv *Driver) UpdateMigrationChecksumContext(ctx context.Context, db dbutil.Transaction, version string, checksum string) error {
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("update %s set checksum = ? where version = ?", drv.quotedMigrationsTableName()),
+		checksum, version)
+
+	return err
+}
+
+// Lock acquires a named lock for the migrations table using GET_LOCK(). The
+// lock is held by a dedicated connection, and is released automatically by
+// the server if that connection is lost. The connection pool must allow at
+// least 2 open connections, since migrations run on other connections.
+func (drv *Driver) Lock(ctx context.Context, db *sql.DB) (func() error, error) {
+	conn, err := dbutil.SessionConn(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// a negative timeout waits indefinitely
+	timeout := -1
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = int(math.Max(0, math.Ceil(time.Until(deadline).Seconds())))
+	}
+
+	name, err := drv.lockName(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "select get_lock(?, ?)", name, timeout).Scan(&acquired)
+	if err == nil && acquired.Int64 != 1 {
+		err = errors.New("timed out waiting for lock " + name)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), "select release_lock(?)", name)
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+
+		return err
+	}, nil
+}
+
+// lockName returns the name of the migration lock, which is server wide
+// and so includes the database name
+func (drv *Driver) lockName(ctx context.Context, conn *sql.Conn) (string, error) {
+	databaseName := dbutil.DatabaseName(drv.databaseURL)
+	if databaseName == "" {
+		// existing connections may be configured without a database url
+		var current sql.NullString
+		if err := conn.QueryRowContext(ctx, "select database()").Scan(&current); err != nil {
+			return "", err
+		}
+		databaseName = current.String
+	}
+
+	name := fmt.Sprintf("dbmate:%s.%s", databaseName, drv.migrationsTableName)
+
+	// mysql lock names are limited to 64 characters
+	if len(name) > 64 {
+		sum := sha1.Sum([]byte(name))
+		name = "dbmate:" + hex.EncodeToString(sum[:])
+	}
+
+	return name, nil
+}
+
 // Ping verifies a connection to the database server. It does not verify whether the
 // specified database exists.
 func (drv *Driver) Ping() error {
+	return drv.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but aborts when the context is done
+func (drv *Driver) PingContext(ctx context.Context) error {
+	if drv.connection != nil {
+		return drv.connection.PingContext(ctx)
+	}
+
 	db, err := drv.openRootDB()
 	if err != nil {
 		return err
 	}
 	defer dbutil.MustClose(db)
 
-	return db.Ping()
+	return db.PingContext(ctx)
 }
 
 // Return a normalized version of the driver-specific error type.
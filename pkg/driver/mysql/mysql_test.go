@@ -1,10 +1,13 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
@@ -247,6 +250,108 @@ func TestMySQLDumpSchemaContainsNoAutoIncrement(t *testing.T) {
 	require.NotContains(t, string(schema), "AUTO_INCREMENT=")
 }
 
+func TestMySQLNativeDumpSchema(t *testing.T) {
+	drv := testMySQLDriver(t)
+	drv.migrationsTableName = "test_migrations"
+	drv.nativeDump = true
+
+	// prepare database
+	db := prepTestMySQLDB(t)
+	defer dbutil.MustClose(db)
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+	err = drv.InsertMigration(db, "abc1")
+	require.NoError(t, err)
+
+	_, err = db.Exec(`create table users (id int not null primary key auto_increment, name varchar(50));
+		create table posts (
+			id int not null primary key auto_increment,
+			user_id int,
+			foreign key (user_id) references users (id)
+		);
+		insert into users (name) values ('alice');
+		create function greeting(name varchar(50)) returns varchar(60) deterministic return concat('hi ', name);
+		create procedure count_users() begin select count(*) from users; end;
+		create view user_greetings as select greeting(name) as greeting from users;
+		create view a_user_greetings as select * from user_greetings;
+		create trigger users_insert before insert on users for each row set new.name = trim(new.name);`)
+	require.NoError(t, err)
+
+	schema, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Contains(t, string(schema), "--\n-- Table structure for table `posts`\n--\n\nCREATE TABLE `posts`")
+	require.Contains(t, string(schema), "CREATE FUNCTION `greeting`")
+	require.Contains(t, string(schema), "CREATE PROCEDURE `count_users`()")
+	require.Contains(t, string(schema), "DELIMITER ;;\nCREATE TRIGGER `users_insert`")
+	require.Contains(t, string(schema), "begin select count(*) from users; end ;;\nDELIMITER ;\n")
+	require.Contains(t, string(schema), "\n--\n"+
+		"-- Dbmate schema migrations\n"+
+		"--\n\n"+
+		"LOCK TABLES `test_migrations` WRITE;\n"+
+		"INSERT INTO `test_migrations` (version) VALUES\n"+
+		"  ('abc1');\n"+
+		"UNLOCK TABLES;\n")
+	require.NotContains(t, string(schema), "AUTO_INCREMENT=")
+	require.NotContains(t, string(schema), "DEFINER=")
+
+	// views follow the views they depend on
+	require.Less(t, strings.Index(string(schema), "VIEW `user_greetings`"),
+		strings.Index(string(schema), "VIEW `a_user_greetings`"))
+
+	// loading the dump into an empty database reproduces it
+	_, err = db.Exec("drop table posts, users, test_migrations; drop view user_greetings, a_user_greetings; " +
+		"drop function greeting; drop procedure count_users")
+	require.NoError(t, err)
+	err = drv.LoadSchemaContext(context.Background(), db, string(schema))
+	require.NoError(t, err)
+
+	schema2, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Equal(t, string(schema), string(schema2))
+}
+
+func TestMySQLStripDefiner(t *testing.T) {
+	require.Equal(t, "CREATE ALGORITHM=UNDEFINED SQL SECURITY DEFINER VIEW `v` AS select 1 AS `1`",
+		stripDefiner("CREATE ALGORITHM=UNDEFINED DEFINER=`root`@`%` SQL SECURITY DEFINER VIEW `v` AS select 1 AS `1`"))
+	require.Equal(t, "CREATE PROCEDURE `p`() select 1",
+		stripDefiner("CREATE DEFINER=`odd``user`@`localhost` PROCEDURE `p`() select 1"))
+}
+
+func TestMySQLSortViews(t *testing.T) {
+	drv := &Driver{}
+	stmts := map[string]string{
+		"a": "CREATE VIEW `a` AS select * from `c`",
+		"b": "CREATE VIEW `b` AS select * from `t`",
+		"c": "CREATE VIEW `c` AS select * from `b`",
+		"d": "CREATE VIEW `d` AS select 1",
+	}
+	require.Equal(t, []string{"b", "c", "a", "d"}, sortViews([]string{"a", "b", "c", "d"}, stmts, drv.quoteIdentifier))
+}
+
+func TestMySQLSplitDelimiters(t *testing.T) {
+	schema := "--\n-- Table structure for table `users`\n--\n\n" +
+		"CREATE TABLE `users` (`id` int);\n\n" +
+		"--\n-- Procedure `count_users`\n--\n\n" +
+		"DELIMITER ;;\n" +
+		"CREATE PROCEDURE `count_users`()\nbegin\n  select count(*) from users;\nend ;;\n" +
+		"/*!50003 CREATE*/ /*!50003 TRIGGER `t` BEFORE INSERT ON `users` FOR EACH ROW set new.id = 1 */;;\n" +
+		"DELIMITER ;\n\n" +
+		"--\n-- View structure for view `v`\n--\n\n" +
+		"CREATE VIEW `v` AS select 1;\n" +
+		"CREATE VIEW `w` AS select 2;\n"
+
+	require.Equal(t, []string{
+		"CREATE TABLE `users` (`id` int);",
+		"CREATE PROCEDURE `count_users`()\nbegin\n  select count(*) from users;\nend",
+		"/*!50003 CREATE*/ /*!50003 TRIGGER `t` BEFORE INSERT ON `users` FOR EACH ROW set new.id = 1 */",
+		"CREATE VIEW `v` AS select 1;\nCREATE VIEW `w` AS select 2;",
+	}, splitDelimiters(schema))
+
+	// files without DELIMITER statements are a single batch
+	require.Equal(t, []string{"select 1;\nselect 2;"}, splitDelimiters("-- comment\nselect 1;\nselect 2;\n"))
+	require.Equal(t, []string{}, splitDelimiters("-- comment\n\n"))
+}
+
 func TestMySQLDatabaseExists(t *testing.T) {
 	drv := testMySQLDriver(t)
 
@@ -305,6 +410,36 @@ func TestMySQLCreateMigrationsTable(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestMySQLUpgradeMigrationsTable(t *testing.T) {
+	drv := testMySQLDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestMySQLDB(t)
+	defer dbutil.MustClose(db)
+
+	// create migrations table in the original format
+	_, err := db.Exec("create table test_migrations (version varchar(128) primary key)")
+	require.NoError(t, err)
+	_, err = db.Exec("insert into test_migrations (version) values ('abc1')")
+	require.NoError(t, err)
+
+	// create table should add missing columns
+	err = drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	// existing records are preserved without details
+	var appliedAt, checksum sql.NullString
+	err = db.QueryRow("select applied_at, checksum from test_migrations where version = 'abc1'").
+		Scan(&appliedAt, &checksum)
+	require.NoError(t, err)
+	require.False(t, appliedAt.Valid)
+	require.False(t, checksum.Valid)
+
+	// upgrade should be idempotent
+	err = drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+}
+
 func TestMySQLSelectMigrations(t *testing.T) {
 	drv := testMySQLDriver(t)
 	drv.migrationsTableName = "test_migrations"
@@ -356,6 +491,69 @@ func TestMySQLInsertMigration(t *testing.T) {
 		Scan(&count)
 	require.NoError(t, err)
 	require.Equal(t, 1, count)
+
+	// insert migration with details
+	err = drv.InsertMigrationRecord(db, dbmate.MigrationRecord{
+		Version:       "abc2",
+		AppliedAt:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:      1500 * time.Millisecond,
+		Checksum:      "d41d8cd98f00b204e9800998ecf8427e",
+		DbmateVersion: dbmate.Version,
+	})
+	require.NoError(t, err)
+
+	var durationMs int64
+	var checksum, dbmateVersion string
+	err = db.QueryRow("select duration_ms, checksum, dbmate_version from test_migrations where version = 'abc2'").
+		Scan(&durationMs, &checksum, &dbmateVersion)
+	require.NoError(t, err)
+	require.Equal(t, int64(1500), durationMs)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", checksum)
+	require.Equal(t, dbmate.Version, dbmateVersion)
+}
+
+func TestMySQLSelectMigrationRecords(t *testing.T) {
+	drv := testMySQLDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestMySQLDB(t)
+	defer dbutil.MustClose(db)
+
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into test_migrations (version, checksum)
+		values ('abc1', 'sum1'), ('abc2', null)`)
+	require.NoError(t, err)
+
+	records, err := drv.SelectMigrationRecords(db)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "sum1", records["abc1"].Checksum)
+	require.Equal(t, "", records["abc2"].Checksum)
+}
+
+func TestMySQLUpdateMigrationChecksum(t *testing.T) {
+	drv := testMySQLDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestMySQLDB(t)
+	defer dbutil.MustClose(db)
+
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into test_migrations (version, checksum)
+		values ('abc1', 'sum1'), ('abc2', 'sum2')`)
+	require.NoError(t, err)
+
+	err = drv.UpdateMigrationChecksum(db, "abc1", "new1")
+	require.NoError(t, err)
+
+	records, err := drv.SelectMigrationRecords(db)
+	require.NoError(t, err)
+	require.Equal(t, "new1", records["abc1"].Checksum)
+	require.Equal(t, "sum2", records["abc2"].Checksum)
 }
 
 func TestMySQLDeleteMigration(t *testing.T) {
@@ -381,6 +579,37 @@ func TestMySQLDeleteMigration(t *testing.T) {
 	require.Equal(t, 1, count)
 }
 
+func TestMySQLLock(t *testing.T) {
+	drv := testMySQLDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestMySQLDB(t)
+	defer dbutil.MustClose(db)
+
+	unlock, err := drv.Lock(context.Background(), db)
+	require.NoError(t, err)
+
+	// lock is exclusive
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = drv.Lock(ctx, db)
+	require.Error(t, err)
+
+	err = unlock()
+	require.NoError(t, err)
+
+	// lock can be acquired again once released
+	unlock, err = drv.Lock(context.Background(), db)
+	require.NoError(t, err)
+	err = unlock()
+	require.NoError(t, err)
+
+	// lock connection would leave none for migrations
+	db.SetMaxOpenConns(1)
+	_, err = drv.Lock(context.Background(), db)
+	require.ErrorIs(t, err, dbutil.ErrPoolTooSmall)
+}
+
 func TestMySQLPing(t *testing.T) {
 	drv := testMySQLDriver(t)
 
@@ -0,0 +1,232 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/amacneil/dbmate/v2/pkg/dbutil"
+)
+
+// definerPattern matches the DEFINER clause of views, routines and triggers,
+// which depends on the user who created them rather than the schema
+var definerPattern = regexp.MustCompile(" DEFINER=`(?:[^`]|``)*`@`(?:[^`]|``)*`")
+
+// nativeSchemaDump returns the current database schema using SHOW CREATE
+// statements, without mysqldump. Objects are written in a fixed order (tables,
+// routines, views, then triggers), sorted by name within each section.
+// Routines and triggers are wrapped in DELIMITER statements like mysqldump
+// output, since their bodies may contain semicolons.
+func (drv *Driver) nativeSchemaDump(ctx context.Context, db *sql.DB) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// tables are sorted by name, so foreign keys may reference later tables
+	buf.WriteString("/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;\n\n")
+
+	tables, err := dbutil.QueryColumnContext(ctx, db, "select table_name from information_schema.tables "+
+		"where table_schema = database() and table_type = 'BASE TABLE' order by table_name")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range tables {
+		stmt, err := showCreate(ctx, db, "show create table "+drv.quoteIdentifier(name), "Create Table")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "--\n-- Table structure for table %s\n--\n\n%s;\n\n", drv.quoteIdentifier(name), stmt)
+	}
+
+	// functions may be used by views, so routines come first
+	for _, routine := range []struct{ kind, title string }{
+		{"FUNCTION", "Function"},
+		{"PROCEDURE", "Procedure"},
+	} {
+		names, err := dbutil.QueryColumnContext(ctx, db, "select routine_name from information_schema.routines "+
+			"where routine_schema = database() and routine_type = ? order by routine_name", routine.kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			stmt, err := showCreate(ctx, db, "show create "+routine.kind+" "+drv.quoteIdentifier(name),
+				"Create "+routine.title)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "--\n-- %s %s\n--\n\nDELIMITER ;;\n%s ;;\nDELIMITER ;\n\n", routine.title,
+				drv.quoteIdentifier(name), stripDefiner(stmt))
+		}
+	}
+
+	views, err := dbutil.QueryColumnContext(ctx, db, "select table_name from information_schema.views "+
+		"where table_schema = database() order by table_name")
+	if err != nil {
+		return nil, err
+	}
+	viewStmts := map[string]string{}
+	for _, name := range views {
+		stmt, err := showCreate(ctx, db, "show create view "+drv.quoteIdentifier(name), "Create View")
+		if err != nil {
+			return nil, err
+		}
+		viewStmts[name] = stripDefiner(stmt)
+	}
+	for _, name := range sortViews(views, viewStmts, drv.quoteIdentifier) {
+		fmt.Fprintf(&buf, "--\n-- View structure for view %s\n--\n\n%s;\n\n", drv.quoteIdentifier(name), viewStmts[name])
+	}
+
+	triggers, err := dbutil.QueryColumnContext(ctx, db, "select trigger_name from information_schema.triggers "+
+		"where trigger_schema = database() "+
+		"order by event_object_table, action_timing, event_manipulation, action_order, trigger_name")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range triggers {
+		stmt, err := showCreate(ctx, db, "show create trigger "+drv.quoteIdentifier(name), "SQL Original Statement")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "--\n-- Trigger %s\n--\n\nDELIMITER ;;\n%s ;;\nDELIMITER ;\n\n", drv.quoteIdentifier(name),
+			stripDefiner(stmt))
+	}
+
+	buf.WriteString("/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;\n")
+
+	return buf.Bytes(), nil
+}
+
+// showCreate runs a SHOW CREATE statement and returns the named column, since
+// the number of columns differs between object types and server versions
+func showCreate(ctx context.Context, db *sql.DB, query, column string) (string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", sql.ErrNoRows
+	}
+
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return "", err
+	}
+
+	for i, name := range columns {
+		if strings.EqualFold(name, column) {
+			return values[i].String, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: missing column %q", query, column)
+}
+
+// stripDefiner removes the DEFINER clause from a create statement
+func stripDefiner(stmt string) string {
+	return definerPattern.ReplaceAllString(stmt, "")
+}
+
+// sortViews orders views so that each view follows the views it references.
+// Views are otherwise kept in the given (name) order, so the dump is stable.
+func sortViews(names []string, stmts map[string]string, quote func(string) string) []string {
+	sorted := make([]string, 0, len(names))
+	done := map[string]bool{}
+	visiting := map[string]bool{}
+
+	var visit func(string)
+	visit = func(name string) {
+		if done[name] || visiting[name] {
+			return
+		}
+		visiting[name] = true
+
+		var deps []string
+		for _, other := range names {
+			if other != name && strings.Contains(stmts[name], quote(other)) {
+				deps = append(deps, other)
+			}
+		}
+		sort.Strings(deps)
+		for _, dep := range deps {
+			visit(dep)
+		}
+
+		visiting[name] = false
+		done[name] = true
+		sorted = append(sorted, name)
+	}
+
+	for _, name := range names {
+		visit(name)
+	}
+
+	return sorted
+}
+
+// delimiterPattern matches a DELIMITER command of the mysql client
+var delimiterPattern = regexp.MustCompile(`(?i)^DELIMITER\s+(\S+)$`)
+
+// splitDelimiters splits a schema file into batches which can be executed by
+// the server, handling the DELIMITER commands understood by the mysql client.
+// Each statement ending with a custom delimiter becomes its own batch, without
+// the delimiter. Comments and blank lines around each batch are removed.
+func splitDelimiters(schema string) []string {
+	batches := []string{}
+	lines := []string{}
+	delimiter := ";"
+
+	flush := func() {
+		// skip leading and trailing comments, since the server rejects
+		// batches which don't contain a statement
+		for len(lines) > 0 && isBlankOrComment(lines[0]) {
+			lines = lines[1:]
+		}
+		for len(lines) > 0 && isBlankOrComment(lines[len(lines)-1]) {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) > 0 {
+			batches = append(batches, strings.Join(lines, "\n"))
+		}
+		lines = lines[:0]
+	}
+
+	for _, line := range strings.Split(schema, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if match := delimiterPattern.FindStringSubmatch(trimmed); match != nil {
+			flush()
+			delimiter = match[1]
+			continue
+		}
+		if delimiter != ";" && strings.HasSuffix(trimmed, delimiter) {
+			lines = append(lines, strings.TrimRight(strings.TrimSuffix(trimmed, delimiter), " \t"))
+			flush()
+			continue
+		}
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+	flush()
+
+	return batches
+}
+
+// isBlankOrComment reports whether a line is empty or a single line comment
+func isBlankOrComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "--") || strings.HasPrefix(trimmed, "#")
+}
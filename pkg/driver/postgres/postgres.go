@@ -2,13 +2,16 @@ package postgres
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/url"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
@@ -25,7 +28,9 @@ func init() {
 type Driver struct {
 	migrationsTableName string
 	databaseURL         *url.URL
+	connection          *sql.DB
 	log                 io.Writer
+	nativeDump          bool
 }
 
 // NewDriver initializes the driver
@@ -33,7 +38,9 @@ func NewDriver(config dbmate.DriverConfig) dbmate.Driver {
 	return &Driver{
 		migrationsTableName: config.MigrationsTableName,
 		databaseURL:         config.DatabaseURL,
+		connection:          config.Connection,
 		log:                 config.Log,
+		nativeDump:          config.NativeDump,
 	}
 }
 
@@ -103,8 +110,13 @@ func connectionArgsForDump(u *url.URL) []string {
 	return out
 }
 
-// Open creates a new database connection
+// Open creates a new database connection, or returns the existing connection
+// the driver was configured with
 func (drv *Driver) Open() (*sql.DB, error) {
+	if drv.connection != nil {
+		return drv.connection, nil
+	}
+
 	return sql.Open("postgres", connectionString(drv.databaseURL))
 }
 
@@ -123,6 +135,11 @@ func (drv *Driver) openPostgresDB() (*sql.DB, error) {
 
 // CreateDatabase creates the specified database
 func (drv *Driver) CreateDatabase() error {
+	return drv.CreateDatabaseContext(context.Background())
+}
+
+// CreateDatabaseContext is like CreateDatabase, but aborts when the context is done
+func (drv *Driver) CreateDatabaseContext(ctx context.Context) error {
 	name := dbutil.DatabaseName(drv.databaseURL)
 	fmt.Fprintf(drv.log, "Creating: %s\n", name)
 
@@ -132,7 +149,7 @@ func (drv *Driver) CreateDatabase() error {
 	}
 	defer dbutil.MustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("create database %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("create database %s",
 		pq.QuoteIdentifier(name)))
 
 	return err
@@ -140,6 +157,11 @@ func (drv *Driver) CreateDatabase() error {
 
 // DropDatabase drops the specified database (if it exists)
 func (drv *Driver) DropDatabase() error {
+	return drv.DropDatabaseContext(context.Background())
+}
+
+// DropDatabaseContext is like DropDatabase, but aborts when the context is done
+func (drv *Driver) DropDatabaseContext(ctx context.Context) error {
 	name := dbutil.DatabaseName(drv.databaseURL)
 	fmt.Fprintf(drv.log, "Dropping: %s\n", name)
 
@@ -149,20 +171,20 @@ func (drv *Driver) DropDatabase() error {
 	}
 	defer dbutil.MustClose(db)
 
-	_, err = db.Exec(fmt.Sprintf("drop database if exists %s",
+	_, err = db.ExecContext(ctx, fmt.Sprintf("drop database if exists %s",
 		pq.QuoteIdentifier(name)))
 
 	return err
 }
 
-func (drv *Driver) schemaMigrationsDump(db *sql.DB) ([]byte, error) {
-	migrationsTable, err := drv.quotedMigrationsTableName(db)
+func (drv *Driver) schemaMigrationsDump(ctx context.Context, db *sql.DB) ([]byte, error) {
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
 	if err != nil {
 		return nil, err
 	}
 
 	// load applied migrations
-	migrations, err := dbutil.QueryColumn(db,
+	migrations, err := dbutil.QueryColumnContext(ctx, db,
 		"select quote_literal(version) from "+migrationsTable+" order by version asc")
 	if err != nil {
 		return nil, err
@@ -183,15 +205,26 @@ func (drv *Driver) schemaMigrationsDump(db *sql.DB) ([]byte, error) {
 
 // DumpSchema returns the current database schema
 func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
+	return drv.DumpSchemaContext(context.Background(), db)
+}
+
+// DumpSchemaContext is like DumpSchema, but aborts when the context is done
+func (drv *Driver) DumpSchemaContext(ctx context.Context, db *sql.DB) ([]byte, error) {
 	// load schema
-	args := append([]string{"--format=plain", "--encoding=UTF8", "--schema-only",
-		"--no-privileges", "--no-owner"}, connectionArgsForDump(drv.databaseURL)...)
-	schema, err := dbutil.RunCommand("pg_dump", args...)
+	var schema []byte
+	var err error
+	if drv.nativeDump {
+		schema, err = drv.nativeSchemaDump(ctx, db)
+	} else {
+		args := append([]string{"--format=plain", "--encoding=UTF8", "--schema-only",
+			"--no-privileges", "--no-owner"}, connectionArgsForDump(drv.databaseURL)...)
+		schema, err = dbutil.RunCommandContext(ctx, "pg_dump", args...)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	migrations, err := drv.schemaMigrationsDump(db)
+	migrations, err := drv.schemaMigrationsDump(ctx, db)
 	if err != nil {
 		return nil, err
 	}
@@ -202,6 +235,11 @@ func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
 
 // DatabaseExists determines whether the database exists
 func (drv *Driver) DatabaseExists() (bool, error) {
+	return drv.DatabaseExistsContext(context.Background())
+}
+
+// DatabaseExistsContext is like DatabaseExists, but aborts when the context is done
+func (drv *Driver) DatabaseExistsContext(ctx context.Context) (bool, error) {
 	name := dbutil.DatabaseName(drv.databaseURL)
 
 	db, err := drv.openPostgresDB()
@@ -211,7 +249,7 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 	defer dbutil.MustClose(db)
 
 	exists := false
-	err = db.QueryRow("select true from pg_database where datname = $1", name).
+	err = db.QueryRowContext(ctx, "select true from pg_database where datname = $1", name).
 		Scan(&exists)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -222,14 +260,19 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 
 // MigrationsTableExists checks if the schema_migrations table exists
 func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
-	schema, migrationsTableNameParts, err := drv.migrationsTableNameParts(db)
+	return drv.MigrationsTableExistsContext(context.Background(), db)
+}
+
+// MigrationsTableExistsContext is like MigrationsTableExists, but aborts when the context is done
+func (drv *Driver) MigrationsTableExistsContext(ctx context.Context, db *sql.DB) (bool, error) {
+	schema, migrationsTableNameParts, err := drv.migrationsTableNameParts(ctx, db)
 	if err != nil {
 		return false, err
 	}
 
 	migrationsTable := strings.Join(migrationsTableNameParts, ".")
 	exists := false
-	err = db.QueryRow("SELECT 1 FROM information_schema.tables "+
+	err = db.QueryRowContext(ctx, "SELECT 1 FROM information_schema.tables "+
 		"WHERE  table_schema = $1 "+
 		"AND    table_name   = $2",
 		schema, migrationsTable).
@@ -243,7 +286,12 @@ func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
 
 // CreateMigrationsTable creates the schema_migrations table
 func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
-	schema, migrationsTable, err := drv.quotedMigrationsTableNameParts(db)
+	return drv.CreateMigrationsTableContext(context.Background(), db)
+}
+
+// CreateMigrationsTableContext is like CreateMigrationsTable, but aborts when the context is done
+func (drv *Driver) CreateMigrationsTableContext(ctx context.Context, db *sql.DB) error {
+	schema, migrationsTable, err := drv.quotedMigrationsTableNameParts(ctx, db)
 	if err != nil {
 		return err
 	}
@@ -252,10 +300,10 @@ func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
 	createTableStmt := fmt.Sprintf(
 		"create table if not exists %s.%s (version varchar(128) primary key)",
 		schema, migrationsTable)
-	_, err = db.Exec(createTableStmt)
+	_, err = db.ExecContext(ctx, createTableStmt)
 	if err == nil {
 		// table exists or created successfully
-		return nil
+		return drv.upgradeMigrationsTable(ctx, db)
 	}
 
 	// catch 'schema does not exist' error
@@ -268,20 +316,90 @@ func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
 	// in theory we could attempt to create the schema every time, but we avoid that
 	// in case the user doesn't have permissions to create schemas
 	fmt.Fprintf(drv.log, "Creating schema: %s\n", schema)
-	_, err = db.Exec(fmt.Sprintf("create schema if not exists %s", schema))
+	_, err = db.ExecContext(ctx, fmt.Sprintf("create schema if not exists %s", schema))
 	if err != nil {
 		return err
 	}
 
 	// second and final attempt at creating migrations table
-	_, err = db.Exec(createTableStmt)
-	return err
+	_, err = db.ExecContext(ctx, createTableStmt)
+	if err != nil {
+		return err
+	}
+
+	return drv.upgradeMigrationsTable(ctx, db)
+}
+
+// migrationsTableColumns lists the columns recorded alongside each version,
+// which are added to existing migrations tables if they are missing
+var migrationsTableColumns = []struct {
+	name       string
+	definition string
+}{
+	{"applied_at", "timestamp with time zone"},
+	{"duration_ms", "bigint"},
+	{"checksum", "varchar(64)"},
+	{"dbmate_version", "varchar(32)"},
+}
+
+// migrationsTableColumnNames returns the names of the existing migrations table columns
+func (drv *Driver) migrationsTableColumnNames(ctx context.Context, db dbutil.Transaction) (map[string]bool, error) {
+	schema, migrationsTableNameParts, err := drv.migrationsTableNameParts(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := dbutil.QueryColumnContext(ctx, db, "select column_name from information_schema.columns "+
+		"where table_schema = $1 and table_name = $2",
+		schema, strings.Join(migrationsTableNameParts, "."))
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, column := range columns {
+		existing[column] = true
+	}
+
+	return existing, nil
+}
+
+// upgradeMigrationsTable adds any missing columns to the migrations table
+func (drv *Driver) upgradeMigrationsTable(ctx context.Context, db *sql.DB) error {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range migrationsTableColumns {
+		if existing[column.name] {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf("alter table %s add column %s %s",
+			migrationsTable, column.name, column.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
 func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, error) {
-	migrationsTable, err := drv.quotedMigrationsTableName(db)
+	return drv.SelectMigrationsContext(context.Background(), db, limit)
+}
+
+// SelectMigrationsContext is like SelectMigrations, but aborts when the context is done
+func (drv *Driver) SelectMigrationsContext(ctx context.Context, db *sql.DB, limit int) (map[string]bool, error) {
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
 	if err != nil {
 		return nil, err
 	}
@@ -290,7 +408,7 @@ func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, err
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -314,33 +432,185 @@ func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, err
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the recorded details of all applied migrations
+func (drv *Driver) SelectMigrationRecords(db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	return drv.SelectMigrationRecordsContext(context.Background(), db)
+}
+
+// SelectMigrationRecordsContext is like SelectMigrationRecords, but aborts when the context is done
+func (drv *Driver) SelectMigrationRecordsContext(ctx context.Context, db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// migrations tables which have not been upgraded yet only record versions
+	upgraded := true
+	for _, column := range migrationsTableColumns {
+		upgraded = upgraded && existing[column.name]
+	}
+
+	query := "select version"
+	if upgraded {
+		query += ", applied_at, duration_ms, checksum, dbmate_version"
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("%s from %s order by version asc", query, migrationsTable))
+	if err != nil {
+		return nil, err
+	}
+
+	defer dbutil.MustClose(rows)
+
+	migrations := map[string]dbmate.MigrationRecord{}
+	for rows.Next() {
+		var version string
+		var appliedAt sql.NullTime
+		var durationMs sql.NullInt64
+		var checksum, dbmateVersion sql.NullString
+
+		dest := []interface{}{&version}
+		if upgraded {
+			dest = append(dest, &appliedAt, &durationMs, &checksum, &dbmateVersion)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		migrations[version] = dbmate.MigrationRecord{
+			Version:       version,
+			AppliedAt:     appliedAt.Time,
+			Duration:      time.Duration(durationMs.Int64) * time.Millisecond,
+			Checksum:      checksum.String,
+			DbmateVersion: dbmateVersion.String,
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
 // InsertMigration adds a new migration record
 func (drv *Driver) InsertMigration(db dbutil.Transaction, version string) error {
-	migrationsTable, err := drv.quotedMigrationsTableName(db)
+	return drv.InsertMigrationContext(context.Background(), db, version)
+}
+
+// InsertMigrationContext is like InsertMigration, but aborts when the context is done
+func (drv *Driver) InsertMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	return drv.InsertMigrationRecordContext(ctx, db, dbmate.MigrationRecord{
+		Version:       version,
+		AppliedAt:     time.Now().UTC(),
+		DbmateVersion: dbmate.Version,
+	})
+}
+
+// InsertMigrationRecord adds a new migration record, including its details
+func (drv *Driver) InsertMigrationRecord(db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	return drv.InsertMigrationRecordContext(context.Background(), db, record)
+}
+
+// InsertMigrationRecordContext is like InsertMigrationRecord, but aborts when the context is done
+func (drv *Driver) InsertMigrationRecordContext(ctx context.Context, db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("insert into "+migrationsTable+" (version) values ($1)", version)
+	_, err = db.ExecContext(ctx, "insert into "+migrationsTable+
+		" (version, applied_at, duration_ms, checksum, dbmate_version) values ($1, $2, $3, $4, $5)",
+		record.Version, dbutil.NullTime(record.AppliedAt), record.Duration.Milliseconds(),
+		dbutil.NullString(record.Checksum), dbutil.NullString(record.DbmateVersion))
 
 	return err
 }
 
 // DeleteMigration removes a migration record
 func (drv *Driver) DeleteMigration(db dbutil.Transaction, version string) error {
-	migrationsTable, err := drv.quotedMigrationsTableName(db)
+	return drv.DeleteMigrationContext(context.Background(), db, version)
+}
+
+// DeleteMigrationContext is like DeleteMigration, but aborts when the context is done
+func (drv *Driver) DeleteMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "delete from "+migrationsTable+" where version = $1", version)
+
+	return err
+}
+
+// UpdateMigrationChecksum replaces the recorded checksum of an applied migration
+func (drv *Driver) UpdateMigrationChecksum(db dbutil.Transaction, version string, checksum string) error {
+	return drv.UpdateMigrationChecksumContext(context.Background(), db, version, checksum)
+}
+
+// UpdateMigrationChecksumContext is like UpdateMigrationChecksum, but aborts when the context is done
+func (drv *Driver) UpdateMigrationChecksumContext(ctx context.Context, db dbutil.Transaction, version string, checksum string) error {
+	migrationsTable, err := drv.quotedMigrationsTableName(ctx, db)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec("delete from "+migrationsTable+" where version = $1", version)
+	_, err = db.ExecContext(ctx, "update "+migrationsTable+" set checksum = $1 where version = $2", checksum, version)
 
 	return err
 }
 
+// Lock acquires a session level advisory lock for the migrations table.
+// The lock is held by a dedicated connection, and is released automatically
+// by the server if that connection is lost. The connection pool must allow
+// at least 2 open connections, since migrations run on other connections.
+func (drv *Driver) Lock(ctx context.Context, db *sql.DB) (func() error, error) {
+	conn, err := dbutil.SessionConn(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	key := drv.advisoryLockKey()
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock($1)", key); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return func() error {
+		_, err := conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", key)
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+
+		return err
+	}, nil
+}
+
+// advisoryLockKey derives the advisory lock key from the migrations table name
+func (drv *Driver) advisoryLockKey() int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("dbmate:" + drv.migrationsTableName))
+
+	return int64(h.Sum64())
+}
+
 // Ping verifies a connection to the database server. It does not verify whether the
 // specified database exists.
 func (drv *Driver) Ping() error {
+	return drv.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but aborts when the context is done
+func (drv *Driver) PingContext(ctx context.Context) error {
+	if drv.connection != nil {
+		return drv.connection.PingContext(ctx)
+	}
+
 	// attempt connection to primary database, not "postgres" database
 	// to support servers with no "postgres" database
 	// (see https://github.com/amacneil/dbmate/issues/78)
@@ -350,7 +620,7 @@ func (drv *Driver) Ping() error {
 	}
 	defer dbutil.MustClose(db)
 
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err == nil {
 		return nil
 	}
@@ -377,8 +647,8 @@ func (drv *Driver) QueryError(query string, err error) error {
 	return &dbmate.QueryError{Err: err, Query: query, Position: position}
 }
 
-func (drv *Driver) quotedMigrationsTableName(db dbutil.Transaction) (string, error) {
-	schema, name, err := drv.quotedMigrationsTableNameParts(db)
+func (drv *Driver) quotedMigrationsTableName(ctx context.Context, db dbutil.Transaction) (string, error) {
+	schema, name, err := drv.quotedMigrationsTableNameParts(ctx, db)
 	if err != nil {
 		return "", err
 	}
@@ -386,7 +656,7 @@ func (drv *Driver) quotedMigrationsTableName(db dbutil.Transaction) (string, err
 	return schema + "." + name, nil
 }
 
-func (drv *Driver) migrationsTableNameParts(db dbutil.Transaction) (string, []string, error) {
+func (drv *Driver) migrationsTableNameParts(ctx context.Context, db dbutil.Transaction) (string, []string, error) {
 	schema := ""
 	tableNameParts := strings.Split(drv.migrationsTableName, ".")
 	if len(tableNameParts) > 1 {
@@ -404,7 +674,7 @@ func (drv *Driver) migrationsTableNameParts(db dbutil.Transaction) (string, []st
 	if schema == "" {
 		// if no URL available, use current schema
 		// this is a hack because we don't always have the URL context available
-		schema, err = dbutil.QueryValue(db, "select current_schema()")
+		schema, err = dbutil.QueryValueContext(ctx, db, "select current_schema()")
 		if err != nil {
 			return "", nil, err
 		}
@@ -418,8 +688,8 @@ func (drv *Driver) migrationsTableNameParts(db dbutil.Transaction) (string, []st
 	return schema, tableNameParts, nil
 }
 
-func (drv *Driver) quotedMigrationsTableNameParts(db dbutil.Transaction) (string, string, error) {
-	schema, tableNameParts, err := drv.migrationsTableNameParts(db)
+func (drv *Driver) quotedMigrationsTableNameParts(ctx context.Context, db dbutil.Transaction) (string, string, error) {
+	schema, tableNameParts, err := drv.migrationsTableNameParts(ctx, db)
 
 	if err != nil {
 		return "", "", err
@@ -429,7 +699,7 @@ func (drv *Driver) quotedMigrationsTableNameParts(db dbutil.Transaction) (string
 	// use server rather than client to do this to avoid unnecessary quotes
 	// (which would change schema.sql diff)
 	tableNameParts = append([]string{schema}, tableNameParts...)
-	quotedNameParts, err := dbutil.QueryColumn(db, "select quote_ident(unnest($1::text[]))", pq.Array(tableNameParts))
+	quotedNameParts, err := dbutil.QueryColumnContext(ctx, db, "select quote_ident(unnest($1::text[]))", pq.Array(tableNameParts))
 	if err != nil {
 		return "", "", err
 	}
@@ -1,11 +1,14 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
@@ -224,6 +227,216 @@ func TestPostgresDumpSchema(t *testing.T) {
 	})
 }
 
+func TestPostgresNativeDumpSchema(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.nativeDump = true
+
+	// prepare database
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+	err = drv.InsertMigration(db, "abc1")
+	require.NoError(t, err)
+
+	_, err = db.Exec(`create schema other;
+		create type mood as enum ('sad', 'happy');
+		create table users (
+			id serial primary key,
+			email text not null unique,
+			mood mood default 'happy',
+			constraint email_length check (length(email) > 3)
+		);
+		create table other.posts (
+			id bigint generated always as identity primary key,
+			user_id integer references users (id),
+			title text
+		);
+		create index posts_title on other.posts (title);
+		create function touch() returns trigger language plpgsql as $$
+		begin
+			return new;
+		end;
+		$$;
+		create trigger users_touch before update on users for each row execute function touch();
+		create view user_posts as select u.email, p.title from users u join other.posts p on p.user_id = u.id;
+		create view a_user_posts as select * from user_posts;`)
+	require.NoError(t, err)
+
+	schema, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Contains(t, string(schema), "CREATE SCHEMA other;")
+	require.Contains(t, string(schema), "CREATE TYPE public.mood AS ENUM (\n    'sad',\n    'happy'\n);")
+	require.Contains(t, string(schema), "CREATE SEQUENCE public.users_id_seq\n    AS integer\n")
+	require.Contains(t, string(schema), "    email text NOT NULL,\n")
+	require.Contains(t, string(schema), "    CONSTRAINT email_length CHECK ((length(email) > 3))\n")
+	require.Contains(t, string(schema), "    id bigint NOT NULL,\n")
+	require.Contains(t, string(schema), "ALTER TABLE other.posts ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (\n"+
+		"    SEQUENCE NAME other.posts_id_seq\n"+
+		"    START WITH 1\n")
+	require.Contains(t, string(schema), "ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;")
+	require.Contains(t, string(schema), "ALTER TABLE ONLY public.users\n    ADD CONSTRAINT users_pkey PRIMARY KEY (id);")
+	require.Contains(t, string(schema), "CREATE INDEX posts_title ON other.posts USING btree (title);")
+	require.Contains(t, string(schema), "CREATE TRIGGER users_touch BEFORE UPDATE ON public.users")
+	require.Contains(t, string(schema), "-- Dbmate schema migrations\n")
+	require.NotContains(t, string(schema), "users_email_key ON")
+
+	// views follow the views they depend on
+	require.Less(t, strings.Index(string(schema), "CREATE VIEW public.user_posts"),
+		strings.Index(string(schema), "CREATE VIEW public.a_user_posts"))
+
+	// foreign keys follow the constraints they reference
+	require.Less(t, strings.Index(string(schema), "ADD CONSTRAINT users_pkey"),
+		strings.Index(string(schema), "ADD CONSTRAINT posts_user_id_fkey"))
+
+	// loading the dump into an empty database reproduces it
+	_, err = db.Exec("drop schema public cascade; drop schema other cascade; create schema public")
+	require.NoError(t, err)
+	_, err = db.Exec(string(schema) + "RESET search_path;\n")
+	require.NoError(t, err)
+
+	schema2, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Equal(t, string(schema), string(schema2))
+}
+
+func TestPostgresSequenceStatement(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		s := sequence{schema: "public", name: "users_id_seq", qualifiedName: "public.users_id_seq", dataType: "integer",
+			start: 1, increment: 1, min: 1, max: 2147483647, cache: 1}
+		require.Equal(t, "CREATE SEQUENCE public.users_id_seq\n"+
+			"    AS integer\n"+
+			"    START WITH 1\n"+
+			"    INCREMENT BY 1\n"+
+			"    NO MINVALUE\n"+
+			"    NO MAXVALUE\n"+
+			"    CACHE 1;", s.statement())
+	})
+
+	t.Run("descending bigint with cycle", func(t *testing.T) {
+		s := sequence{schema: "public", name: "countdown", qualifiedName: "public.countdown", dataType: "bigint",
+			start: -1, increment: -1, min: -100, max: -1, cache: 10, cycle: true}
+		require.Equal(t, "CREATE SEQUENCE public.countdown\n"+
+			"    START WITH -1\n"+
+			"    INCREMENT BY -1\n"+
+			"    MINVALUE -100\n"+
+			"    NO MAXVALUE\n"+
+			"    CACHE 10\n"+
+			"    CYCLE;", s.statement())
+	})
+}
+
+func TestPostgresNativeDumpSchemaObjects(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.nativeDump = true
+
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`create domain email as text check (value like '%@%');
+		create type address as (street text, city text);
+		create table people (
+			id integer generated by default as identity (start with 100 increment by 10) primary key,
+			email email not null,
+			home address
+		);
+		create table staff (salary integer) inherits (people);
+		create function people_named(text) returns setof people language sql as $$
+			select * from people where email = $1
+		$$;
+		create function normalize(text) returns text language sql immutable as $$ select lower($1) $$;
+		create view staff_emails as select normalize(email) as email from staff;
+		create function audit() returns trigger language plpgsql as $$
+		begin
+			return new;
+		end;
+		$$;
+		create trigger staff_audit after insert on staff for each row execute function audit();
+		comment on table people is 'everyone';
+		comment on column people.email is 'contact address';
+		comment on domain email is 'an email address';
+		comment on function normalize(text) is 'lower case';`)
+	require.NoError(t, err)
+
+	schema, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Contains(t, string(schema), "CREATE DOMAIN public.email AS text\n"+
+		"\tCONSTRAINT email_check CHECK ((VALUE ~~ '%@%'::text));")
+	require.Contains(t, string(schema), "CREATE TYPE public.address AS (\n    street text,\n    city text\n);")
+	require.Contains(t, string(schema), "CREATE TABLE public.staff (\n    salary integer\n)\nINHERITS (public.people);")
+	require.Contains(t, string(schema), "ALTER TABLE public.people ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY (\n"+
+		"    SEQUENCE NAME public.people_id_seq\n"+
+		"    START WITH 100\n"+
+		"    INCREMENT BY 10\n")
+	require.Contains(t, string(schema), "COMMENT ON TABLE public.people IS 'everyone';")
+	require.Contains(t, string(schema), "COMMENT ON COLUMN public.people.email IS 'contact address';")
+	require.Contains(t, string(schema), "COMMENT ON DOMAIN public.email IS 'an email address';")
+	require.Contains(t, string(schema), "COMMENT ON FUNCTION public.normalize(text) IS 'lower case';")
+
+	// objects follow the objects they depend on
+	order := func(stmts ...string) {
+		for i := 1; i < len(stmts); i++ {
+			require.Less(t, strings.Index(string(schema), stmts[i-1]), strings.Index(string(schema), stmts[i]))
+		}
+	}
+	order("CREATE DOMAIN public.email", "CREATE TYPE public.address", "CREATE TABLE public.people",
+		"CREATE FUNCTION public.people_named", "CREATE TABLE public.staff", "CREATE VIEW public.staff_emails",
+		"CREATE TRIGGER staff_audit")
+	order("CREATE FUNCTION public.normalize", "CREATE VIEW public.staff_emails")
+
+	// loading the dump into an empty database reproduces it
+	_, err = db.Exec("drop schema public cascade; create schema public")
+	require.NoError(t, err)
+	_, err = db.Exec(string(schema) + "RESET search_path;\n")
+	require.NoError(t, err)
+
+	schema2, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.Equal(t, string(schema), string(schema2))
+}
+
+func TestPostgresNativeDumpSchemaUnsupported(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.nativeDump = true
+
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+
+	_, err := db.Exec(`create table users (id integer);
+		create aggregate total(integer) (sfunc = int4pl, stype = integer);
+		create policy own_rows on users using (true);`)
+	require.NoError(t, err)
+
+	_, err = drv.DumpSchema(db)
+	require.EqualError(t, err, "native schema dump does not support aggregate public.total, "+
+		"policy own_rows on public.users, use pg_dump instead")
+}
+
+func TestPostgresSortObjects(t *testing.T) {
+	objects := []object{
+		{key: "a", name: "a"},
+		{key: "b", name: "b"},
+		{name: "no key"},
+		{key: "c", name: "c"},
+		{key: "d", name: "d"},
+	}
+	dependencies := map[string][]string{
+		"a": {"c", "unknown"},
+		"c": {"d", "b"},
+		"d": {"a"},
+	}
+
+	names := []string{}
+	for _, o := range sortObjects(objects, dependencies) {
+		names = append(names, o.name)
+	}
+
+	// dependencies are moved first, and the cycle from d back to a is ignored
+	require.Equal(t, []string{"b", "d", "c", "a", "no key"}, names)
+}
+
 func TestPostgresDatabaseExists(t *testing.T) {
 	drv := testPostgresDriver(t)
 
@@ -367,6 +580,36 @@ func TestPostgresCreateMigrationsTable(t *testing.T) {
 	})
 }
 
+func TestPostgresUpgradeMigrationsTable(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+
+	// create migrations table in the original format
+	_, err := db.Exec("create table public.test_migrations (version varchar(128) primary key)")
+	require.NoError(t, err)
+	_, err = db.Exec("insert into public.test_migrations (version) values ('abc1')")
+	require.NoError(t, err)
+
+	// create table should add missing columns
+	err = drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	// existing records are preserved without details
+	var appliedAt, checksum sql.NullString
+	err = db.QueryRow("select applied_at, checksum from public.test_migrations where version = 'abc1'").
+		Scan(&appliedAt, &checksum)
+	require.NoError(t, err)
+	require.False(t, appliedAt.Valid)
+	require.False(t, checksum.Valid)
+
+	// upgrade should be idempotent
+	err = drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+}
+
 func TestPostgresSelectMigrations(t *testing.T) {
 	drv := testPostgresDriver(t)
 	drv.migrationsTableName = "test_migrations"
@@ -418,6 +661,69 @@ func TestPostgresInsertMigration(t *testing.T) {
 		Scan(&count)
 	require.NoError(t, err)
 	require.Equal(t, 1, count)
+
+	// insert migration with details
+	err = drv.InsertMigrationRecord(db, dbmate.MigrationRecord{
+		Version:       "abc2",
+		AppliedAt:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:      1500 * time.Millisecond,
+		Checksum:      "d41d8cd98f00b204e9800998ecf8427e",
+		DbmateVersion: dbmate.Version,
+	})
+	require.NoError(t, err)
+
+	var durationMs int64
+	var checksum, dbmateVersion string
+	err = db.QueryRow("select duration_ms, checksum, dbmate_version from public.test_migrations where version = 'abc2'").
+		Scan(&durationMs, &checksum, &dbmateVersion)
+	require.NoError(t, err)
+	require.Equal(t, int64(1500), durationMs)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", checksum)
+	require.Equal(t, dbmate.Version, dbmateVersion)
+}
+
+func TestPostgresSelectMigrationRecords(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into public.test_migrations (version, checksum)
+		values ('abc1', 'sum1'), ('abc2', null)`)
+	require.NoError(t, err)
+
+	records, err := drv.SelectMigrationRecords(db)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "sum1", records["abc1"].Checksum)
+	require.Equal(t, "", records["abc2"].Checksum)
+}
+
+func TestPostgresUpdateMigrationChecksum(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into public.test_migrations (version, checksum)
+		values ('abc1', 'sum1'), ('abc2', 'sum2')`)
+	require.NoError(t, err)
+
+	err = drv.UpdateMigrationChecksum(db, "abc1", "new1")
+	require.NoError(t, err)
+
+	records, err := drv.SelectMigrationRecords(db)
+	require.NoError(t, err)
+	require.Equal(t, "new1", records["abc1"].Checksum)
+	require.Equal(t, "sum2", records["abc2"].Checksum)
 }
 
 func TestPostgresDeleteMigration(t *testing.T) {
@@ -443,6 +749,37 @@ func TestPostgresDeleteMigration(t *testing.T) {
 	require.Equal(t, 1, count)
 }
 
+func TestPostgresLock(t *testing.T) {
+	drv := testPostgresDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestPostgresDB(t)
+	defer dbutil.MustClose(db)
+
+	unlock, err := drv.Lock(context.Background(), db)
+	require.NoError(t, err)
+
+	// lock is exclusive
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = drv.Lock(ctx, db)
+	require.Error(t, err)
+
+	err = unlock()
+	require.NoError(t, err)
+
+	// lock can be acquired again once released
+	unlock, err = drv.Lock(context.Background(), db)
+	require.NoError(t, err)
+	err = unlock()
+	require.NoError(t, err)
+
+	// lock connection would leave none for migrations
+	db.SetMaxOpenConns(1)
+	_, err = drv.Lock(context.Background(), db)
+	require.ErrorIs(t, err, dbutil.ErrPoolTooSmall)
+}
+
 func TestPostgresPing(t *testing.T) {
 	drv := testPostgresDriver(t)
 
@@ -467,7 +804,7 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 		db := prepTestPostgresDB(t)
 		defer dbutil.MustClose(db)
 
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "public.schema_migrations", name)
 	})
@@ -487,7 +824,7 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 		require.NoError(t, err)
 
 		// should use first schema from search path
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "foo.schema_migrations", name)
 	})
@@ -502,7 +839,7 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 		_, err := db.Exec("select pg_catalog.set_config('search_path', '', false)")
 		require.NoError(t, err)
 
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "public.schema_migrations", name)
 	})
@@ -513,7 +850,7 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 		defer dbutil.MustClose(db)
 
 		drv.migrationsTableName = "simple_name"
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "public.simple_name", name)
 	})
@@ -525,7 +862,7 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 
 		// this table name will need quoting
 		drv.migrationsTableName = "camelCase"
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "public.\"camelCase\"", name)
 	})
@@ -543,7 +880,7 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 		require.NoError(t, err)
 
 		drv.migrationsTableName = "simple_name"
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "foo.simple_name", name)
 	})
@@ -564,19 +901,19 @@ func TestPostgresQuotedMigrationsTableName(t *testing.T) {
 
 		// if schema is specified as part of table name, it should override search_path
 		drv.migrationsTableName = "bar.simple_name"
-		name, err := drv.quotedMigrationsTableName(db)
+		name, err := drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "bar.simple_name", name)
 
 		// schema and table name should be quoted if necessary
 		drv.migrationsTableName = "barName.camelTable"
-		name, err = drv.quotedMigrationsTableName(db)
+		name, err = drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "\"barName\".\"camelTable\"", name)
 
 		// more than 2 components is unexpected but we will quote and pass it along anyway
 		drv.migrationsTableName = "whyWould.i.doThis"
-		name, err = drv.quotedMigrationsTableName(db)
+		name, err = drv.quotedMigrationsTableName(context.Background(), db)
 		require.NoError(t, err)
 		require.Equal(t, "\"whyWould\".i.\"doThis\"", name)
 	})
@@ -0,0 +1,878 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// schemaDumpHeader matches the settings pg_dump writes at the start of a dump
+const schemaDumpHeader = `SET statement_timeout = 0;
+SET lock_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SELECT pg_catalog.set_config('search_path', '', false);
+SET check_function_bodies = false;
+SET client_min_messages = warning;
+
+
+`
+
+// namespaceFilter restricts a query to the dumped schemas, given a
+// pg_namespace alias "n" and the schema names as the first argument
+const namespaceFilter = `n.nspname <> 'information_schema' and n.nspname !~ '^pg_' ` +
+	`and (cardinality($1::text[]) = 0 or n.nspname = any($1::text[]))`
+
+// notExtensionMember excludes objects created by an extension
+func notExtensionMember(catalog, oid string) string {
+	return fmt.Sprintf("not exists (select 1 from pg_catalog.pg_depend e "+
+		"where e.classid = 'pg_catalog.%s'::regclass and e.objid = %s and e.deptype = 'e')", catalog, oid)
+}
+
+// objectKey returns an expression identifying the catalog object with the
+// given oid, in the same form as the dependencies query
+func objectKey(catalog, oid string) string {
+	return fmt.Sprintf("format('%%s:%%s', 'pg_catalog.%s'::regclass::oid, %s)", catalog, oid)
+}
+
+// collateClause returns an expression for the COLLATE clause of an attribute,
+// given pg_attribute and pg_type aliases, if it differs from its type
+func collateClause(attribute, typ string) string {
+	return fmt.Sprintf(`case when %[1]s.attcollation <> %[2]s.typcollation then
+		(select format(' COLLATE %%I.%%I', cn.nspname, co.collname)
+		from pg_catalog.pg_collation co
+		join pg_catalog.pg_namespace cn on cn.oid = co.collnamespace
+		where co.oid = %[1]s.attcollation) else '' end`, attribute, typ)
+}
+
+// object is a statement in the dump. Objects which others can depend on
+// have a key, matching the keys returned by the dependencies query.
+type object struct {
+	key, kind, schema, name, stmt string
+}
+
+// schemaDumper builds a schema dump by querying pg_catalog, as an alternative
+// to pg_dump which must match the major version of the server. Objects are
+// collected in a fixed order of sections, sorted by name within each section,
+// and then moved after any objects they depend on.
+type schemaDumper struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	schemas pq.StringArray
+	objects []object
+}
+
+// nativeSchemaDump returns the current database schema without using pg_dump
+func (drv *Driver) nativeSchemaDump(ctx context.Context, db *sql.DB) ([]byte, error) {
+	// read the catalog from a consistent snapshot, with an empty search path
+	// so that names in expressions and definitions are schema qualified
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, "set local search_path = ''"); err != nil {
+		return nil, err
+	}
+
+	d := &schemaDumper{ctx: ctx, tx: tx, schemas: pq.StringArray{}}
+
+	// restrict the dump to schemas in search_path, like pg_dump --schema
+	for _, schema := range strings.Split(drv.databaseURL.Query().Get("search_path"), ",") {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			d.schemas = append(d.schemas, schema)
+		}
+	}
+
+	for _, section := range []func() error{
+		d.checkUnsupported,
+		d.dumpSchemas,
+		d.dumpExtensions,
+		d.dumpEnums,
+		d.dumpDomains,
+		d.dumpCompositeTypes,
+		d.dumpFunctions,
+		d.dumpSequences,
+		d.dumpTables,
+		d.dumpIdentities,
+		d.dumpPartitions,
+		d.dumpSequenceOwners,
+		d.dumpViews,
+		d.dumpConstraints,
+		d.dumpIndexes,
+		d.dumpTriggers,
+		d.dumpForeignKeys,
+		d.dumpComments,
+	} {
+		if err := section(); err != nil {
+			return nil, err
+		}
+	}
+
+	dependencies, err := d.dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(schemaDumpHeader)
+	for _, o := range sortObjects(d.objects, dependencies) {
+		fmt.Fprintf(&buf, "--\n-- Name: %s; Type: %s; Schema: %s; Owner: -\n--\n\n%s\n\n\n", o.name, o.kind, o.schema, o.stmt)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// write adds a statement to the dump
+func (d *schemaDumper) write(key, kind, schema, name, stmt string) {
+	d.objects = append(d.objects, object{key: key, kind: kind, schema: schema, name: name, stmt: stmt})
+}
+
+// dumpQuery adds each statement returned by a query of key, kind, schema,
+// name and statement columns. The key is empty for objects which others
+// can't depend on.
+func (d *schemaDumper) dumpQuery(query string) error {
+	rows, err := d.tx.QueryContext(d.ctx, query, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, kind, schema, name, stmt string
+		if err := rows.Scan(&key, &kind, &schema, &name, &stmt); err != nil {
+			return err
+		}
+		d.write(key, kind, schema, name, stmt)
+	}
+
+	return rows.Err()
+}
+
+// checkUnsupported returns an error listing objects which the native dumper
+// can't write, rather than silently leaving them out of the dump
+func (d *schemaDumper) checkUnsupported() error {
+	rows, err := d.tx.QueryContext(d.ctx, `select kind || ' ' || name from (
+		select 1 as ord, case p.prokind when 'a' then 'aggregate' else 'window function' end as kind,
+			format('%I.%I', n.nspname, p.proname) as name
+		from pg_catalog.pg_proc p
+		join pg_catalog.pg_namespace n on n.oid = p.pronamespace
+		where `+namespaceFilter+` and p.prokind in ('a', 'w')
+		and `+notExtensionMember("pg_proc", "p.oid")+`
+		union all
+		select 2, case t.typtype when 'b' then 'base type' when 'r' then 'range type' else 'pseudo type' end,
+			format('%I.%I', n.nspname, t.typname)
+		from pg_catalog.pg_type t
+		join pg_catalog.pg_namespace n on n.oid = t.typnamespace
+		where `+namespaceFilter+` and t.typtype in ('b', 'r', 'p')
+		and not exists (select 1 from pg_catalog.pg_type e where e.typarray = t.oid)
+		and `+notExtensionMember("pg_type", "t.oid")+`
+		union all
+		select 3, case c.relkind when 'f' then 'foreign table' else 'row level security on' end,
+			format('%I.%I', n.nspname, c.relname)
+		from pg_catalog.pg_class c
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where `+namespaceFilter+` and (c.relkind = 'f' or c.relrowsecurity)
+		and `+notExtensionMember("pg_class", "c.oid")+`
+		union all
+		select 4, 'rule', format('%I on %I.%I', r.rulename, n.nspname, c.relname)
+		from pg_catalog.pg_rewrite r
+		join pg_catalog.pg_class c on c.oid = r.ev_class
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where `+namespaceFilter+` and r.rulename <> '_RETURN'
+		and `+notExtensionMember("pg_class", "c.oid")+`
+		union all
+		select 5, 'policy', format('%I on %I.%I', pol.polname, n.nspname, c.relname)
+		from pg_catalog.pg_policy pol
+		join pg_catalog.pg_class c on c.oid = pol.polrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where `+namespaceFilter+` and `+notExtensionMember("pg_class", "c.oid")+`
+		union all
+		select 6, 'domain constraint', format('%I on %I.%I', con.conname, n.nspname, t.typname)
+		from pg_catalog.pg_constraint con
+		join pg_catalog.pg_type t on t.oid = con.contypid
+		join pg_catalog.pg_namespace n on n.oid = t.typnamespace
+		where `+namespaceFilter+` and con.contype = 'c' and not con.convalidated
+		and `+notExtensionMember("pg_type", "t.oid")+`
+		union all
+		select 7, 'operator', format('%I.%s', n.nspname, o.oprname)
+		from pg_catalog.pg_operator o
+		join pg_catalog.pg_namespace n on n.oid = o.oprnamespace
+		where `+namespaceFilter+` and `+notExtensionMember("pg_operator", "o.oid")+`
+		union all
+		select 8, 'collation', format('%I.%I', n.nspname, co.collname)
+		from pg_catalog.pg_collation co
+		join pg_catalog.pg_namespace n on n.oid = co.collnamespace
+		where `+namespaceFilter+` and `+notExtensionMember("pg_collation", "co.oid")+`
+		union all
+		select 9, 'statistics object', format('%I.%I', n.nspname, st.stxname)
+		from pg_catalog.pg_statistic_ext st
+		join pg_catalog.pg_namespace n on n.oid = st.stxnamespace
+		where `+namespaceFilter+`
+		union all
+		select 10, 'text search configuration', format('%I.%I', n.nspname, cfg.cfgname)
+		from pg_catalog.pg_ts_config cfg
+		join pg_catalog.pg_namespace n on n.oid = cfg.cfgnamespace
+		where `+namespaceFilter+` and `+notExtensionMember("pg_ts_config", "cfg.oid")+`
+	) unsupported
+	order by ord, name`, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var unsupported []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		unsupported = append(unsupported, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("native schema dump does not support %s, use pg_dump instead",
+			strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
+// dependencies returns the keys of the objects each object depends on. The
+// dependencies of parts of an object, such as column defaults, constraints and
+// view rules, are attributed to the object itself, and dependencies on row
+// types and array types to their relation or element type.
+func (d *schemaDumper) dependencies() (map[string][]string, error) {
+	rows, err := d.tx.QueryContext(d.ctx, `with owners (classid, objid, ownerclassid, ownerid) as (
+		select 'pg_catalog.pg_attrdef'::regclass::oid, ad.oid, 'pg_catalog.pg_class'::regclass::oid, ad.adrelid
+		from pg_catalog.pg_attrdef ad
+		union all
+		select 'pg_catalog.pg_rewrite'::regclass::oid, r.oid, 'pg_catalog.pg_class'::regclass::oid, r.ev_class
+		from pg_catalog.pg_rewrite r
+		union all
+		select 'pg_catalog.pg_constraint'::regclass::oid, con.oid,
+			case when con.conrelid <> 0 then 'pg_catalog.pg_class'::regclass::oid
+				else 'pg_catalog.pg_type'::regclass::oid end,
+			case when con.conrelid <> 0 then con.conrelid else con.contypid end
+		from pg_catalog.pg_constraint con
+		union all
+		select 'pg_catalog.pg_type'::regclass::oid, t.oid,
+			case when coalesce(e.typrelid, t.typrelid) <> 0 then 'pg_catalog.pg_class'::regclass::oid
+				else 'pg_catalog.pg_type'::regclass::oid end,
+			case when coalesce(e.typrelid, t.typrelid) <> 0 then coalesce(e.typrelid, t.typrelid) else e.oid end
+		from pg_catalog.pg_type t
+		left join pg_catalog.pg_type e on e.typarray = t.oid
+		where t.typrelid <> 0 or e.oid is not null
+	)
+	select distinct format('%s:%s', coalesce(o.ownerclassid, dep.classid), coalesce(o.ownerid, dep.objid)),
+		format('%s:%s', coalesce(r.ownerclassid, dep.refclassid), coalesce(r.ownerid, dep.refobjid))
+	from pg_catalog.pg_depend dep
+	left join owners o on o.classid = dep.classid and o.objid = dep.objid
+	left join owners r on r.classid = dep.refclassid and r.objid = dep.refobjid
+	where dep.deptype = 'n' and dep.objid >= 16384 and dep.refobjid >= 16384`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dependencies := map[string][]string{}
+	for rows.Next() {
+		var key, ref string
+		if err := rows.Scan(&key, &ref); err != nil {
+			return nil, err
+		}
+		dependencies[key] = append(dependencies[key], ref)
+	}
+
+	return dependencies, rows.Err()
+}
+
+// sortObjects orders objects so that each object follows the objects it
+// depends on. Objects are otherwise kept in the given order, so the dump is
+// stable. Dependency cycles are broken at the first object visited.
+func sortObjects(objects []object, dependencies map[string][]string) []object {
+	index := map[string]int{}
+	for i, o := range objects {
+		if o.key != "" {
+			index[o.key] = i
+		}
+	}
+
+	sorted := make([]object, 0, len(objects))
+	done := make([]bool, len(objects))
+	visiting := make([]bool, len(objects))
+
+	var visit func(int)
+	visit = func(i int) {
+		if done[i] || visiting[i] {
+			return
+		}
+		visiting[i] = true
+
+		var deps []int
+		if objects[i].key != "" {
+			for _, key := range dependencies[objects[i].key] {
+				if j, ok := index[key]; ok && j != i {
+					deps = append(deps, j)
+				}
+			}
+		}
+		sort.Ints(deps)
+		for _, j := range deps {
+			visit(j)
+		}
+
+		visiting[i] = false
+		done[i] = true
+		sorted = append(sorted, objects[i])
+	}
+
+	for i := range objects {
+		visit(i)
+	}
+
+	return sorted
+}
+
+func (d *schemaDumper) dumpSchemas() error {
+	return d.dumpQuery(`select '', 'SCHEMA', '-', n.nspname, format('CREATE SCHEMA %I;', n.nspname)
+		from pg_catalog.pg_namespace n
+		where ` + namespaceFilter + ` and n.nspname <> 'public'
+		and ` + notExtensionMember("pg_namespace", "n.oid") + `
+		order by n.nspname`)
+}
+
+func (d *schemaDumper) dumpExtensions() error {
+	return d.dumpQuery(`select '', 'EXTENSION', '-', x.extname,
+		format('CREATE EXTENSION IF NOT EXISTS %I WITH SCHEMA %I;', x.extname, n.nspname)
+		from pg_catalog.pg_extension x
+		join pg_catalog.pg_namespace n on n.oid = x.extnamespace
+		where ` + namespaceFilter + ` and x.extname <> 'plpgsql'
+		order by x.extname`)
+}
+
+func (d *schemaDumper) dumpEnums() error {
+	return d.dumpQuery(`select ` + objectKey("pg_type", "t.oid") + `, 'TYPE', n.nspname, t.typname,
+		format(E'CREATE TYPE %I.%I AS ENUM (\n%s\n);', n.nspname, t.typname,
+			(select string_agg(format('    %L', e.enumlabel), E',\n' order by e.enumsortorder)
+			from pg_catalog.pg_enum e where e.enumtypid = t.oid))
+		from pg_catalog.pg_type t
+		join pg_catalog.pg_namespace n on n.oid = t.typnamespace
+		where ` + namespaceFilter + ` and t.typtype = 'e'
+		and ` + notExtensionMember("pg_type", "t.oid") + `
+		order by n.nspname, t.typname`)
+}
+
+func (d *schemaDumper) dumpDomains() error {
+	// unvalidated constraints are reported by checkUnsupported
+	return d.dumpQuery(`select ` + objectKey("pg_type", "t.oid") + `, 'DOMAIN', n.nspname, t.typname,
+		format('CREATE DOMAIN %I.%I AS %s', n.nspname, t.typname, pg_catalog.format_type(t.typbasetype, t.typtypmod))
+		|| case when t.typcollation <> bt.typcollation then (select format(' COLLATE %I.%I', cn.nspname, co.collname)
+			from pg_catalog.pg_collation co
+			join pg_catalog.pg_namespace cn on cn.oid = co.collnamespace
+			where co.oid = t.typcollation) else '' end
+		|| case when t.typnotnull then ' NOT NULL' else '' end
+		|| coalesce(' DEFAULT ' || pg_catalog.pg_get_expr(t.typdefaultbin, 0), '')
+		|| coalesce((select string_agg(format(E'\n\tCONSTRAINT %I %s', con.conname, pg_catalog.pg_get_constraintdef(con.oid)),
+			'' order by con.conname)
+			from pg_catalog.pg_constraint con where con.contypid = t.oid and con.contype = 'c'), '')
+		|| ';'
+		from pg_catalog.pg_type t
+		join pg_catalog.pg_namespace n on n.oid = t.typnamespace
+		join pg_catalog.pg_type bt on bt.oid = t.typbasetype
+		where ` + namespaceFilter + ` and t.typtype = 'd'
+		and ` + notExtensionMember("pg_type", "t.oid") + `
+		order by n.nspname, t.typname`)
+}
+
+func (d *schemaDumper) dumpCompositeTypes() error {
+	// composite types are keyed by their relation, which holds the attributes
+	return d.dumpQuery(`select ` + objectKey("pg_class", "c.oid") + `, 'TYPE', n.nspname, t.typname,
+		format(E'CREATE TYPE %I.%I AS (\n%s\n);', n.nspname, t.typname,
+			(select string_agg(format('    %I %s', a.attname, pg_catalog.format_type(a.atttypid, a.atttypmod))
+				|| ` + collateClause("a", "ty") + `, E',\n' order by a.attnum)
+			from pg_catalog.pg_attribute a
+			join pg_catalog.pg_type ty on ty.oid = a.atttypid
+			where a.attrelid = c.oid and a.attnum > 0 and not a.attisdropped))
+		from pg_catalog.pg_type t
+		join pg_catalog.pg_class c on c.oid = t.typrelid
+		join pg_catalog.pg_namespace n on n.oid = t.typnamespace
+		where ` + namespaceFilter + ` and t.typtype = 'c' and c.relkind = 'c'
+		and ` + notExtensionMember("pg_type", "t.oid") + `
+		order by n.nspname, t.typname`)
+}
+
+func (d *schemaDumper) dumpFunctions() error {
+	return d.dumpQuery(`select ` + objectKey("pg_proc", "p.oid") + `, case p.prokind when 'p' then 'PROCEDURE' else 'FUNCTION' end,
+		n.nspname, format('%s(%s)', p.proname, pg_catalog.pg_get_function_identity_arguments(p.oid)),
+		regexp_replace(rtrim(pg_catalog.pg_get_functiondef(p.oid), E'\n'), '^CREATE OR REPLACE ', 'CREATE ') || ';'
+		from pg_catalog.pg_proc p
+		join pg_catalog.pg_namespace n on n.oid = p.pronamespace
+		where ` + namespaceFilter + ` and p.prokind in ('f', 'p')
+		and ` + notExtensionMember("pg_proc", "p.oid") + `
+		order by n.nspname, p.proname, pg_catalog.pg_get_function_identity_arguments(p.oid)`)
+}
+
+// sequence holds the options of a sequence
+type sequence struct {
+	key                         string
+	schema, name, qualifiedName string
+	dataType                    string
+	start, increment, min, max  int64
+	cache                       int64
+	cycle                       bool
+}
+
+// statement returns the create statement for a sequence
+func (s sequence) statement() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "CREATE SEQUENCE %s\n", s.qualifiedName)
+	if s.dataType != "bigint" {
+		fmt.Fprintf(&sb, "    AS %s\n", s.dataType)
+	}
+	sb.WriteString(s.options())
+	sb.WriteString(";")
+
+	return sb.String()
+}
+
+// identityStatement returns the statement which makes a column an identity
+// column backed by the sequence, given its qualified table and column name
+func (s sequence) identityStatement(table, column string, always bool) string {
+	generated := "BY DEFAULT"
+	if always {
+		generated = "ALWAYS"
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s ADD GENERATED %s AS IDENTITY (\n    SEQUENCE NAME %s\n%s\n);",
+		table, column, generated, s.qualifiedName, s.options())
+}
+
+// options returns the options of a sequence, omitting limits which are the
+// default for its data type like pg_dump does
+func (s sequence) options() string {
+	var typeMin, typeMax int64 = math.MinInt64, math.MaxInt64
+	switch s.dataType {
+	case "smallint":
+		typeMin, typeMax = math.MinInt16, math.MaxInt16
+	case "integer":
+		typeMin, typeMax = math.MinInt32, math.MaxInt32
+	}
+
+	defaultMin, defaultMax := int64(1), typeMax
+	if s.increment < 0 {
+		defaultMin, defaultMax = typeMin, -1
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "    START WITH %d\n    INCREMENT BY %d\n", s.start, s.increment)
+	if s.min == defaultMin {
+		sb.WriteString("    NO MINVALUE\n")
+	} else {
+		fmt.Fprintf(&sb, "    MINVALUE %d\n", s.min)
+	}
+	if s.max == defaultMax {
+		sb.WriteString("    NO MAXVALUE\n")
+	} else {
+		fmt.Fprintf(&sb, "    MAXVALUE %d\n", s.max)
+	}
+	fmt.Fprintf(&sb, "    CACHE %d", s.cache)
+	if s.cycle {
+		sb.WriteString("\n    CYCLE")
+	}
+
+	return sb.String()
+}
+
+func (d *schemaDumper) dumpSequences() error {
+	// identity column sequences are created by dumpIdentities
+	rows, err := d.tx.QueryContext(d.ctx, `select `+objectKey("pg_class", "c.oid")+`,
+		n.nspname, c.relname, format('%I.%I', n.nspname, c.relname),
+		pg_catalog.format_type(s.seqtypid, null), s.seqstart, s.seqincrement,
+		s.seqmin, s.seqmax, s.seqcache, s.seqcycle
+		from pg_catalog.pg_sequence s
+		join pg_catalog.pg_class c on c.oid = s.seqrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where `+namespaceFilter+`
+		and `+notExtensionMember("pg_class", "c.oid")+`
+		and not exists (select 1 from pg_catalog.pg_depend i
+			where i.classid = 'pg_catalog.pg_class'::regclass and i.objid = c.oid and i.deptype = 'i')
+		order by n.nspname, c.relname`, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s sequence
+		if err := rows.Scan(&s.key, &s.schema, &s.name, &s.qualifiedName, &s.dataType, &s.start, &s.increment,
+			&s.min, &s.max, &s.cache, &s.cycle); err != nil {
+			return err
+		}
+		d.write(s.key, "SEQUENCE", s.schema, s.name, s.statement())
+	}
+
+	return rows.Err()
+}
+
+func (d *schemaDumper) dumpIdentities() error {
+	rows, err := d.tx.QueryContext(d.ctx, `select `+objectKey("pg_class", "c.oid")+`,
+		n.nspname, c.relname, format('%I.%I', n.nspname, c.relname),
+		pg_catalog.format_type(s.seqtypid, null), s.seqstart, s.seqincrement,
+		s.seqmin, s.seqmax, s.seqcache, s.seqcycle,
+		format('%I.%I', tn.nspname, t.relname), format('%I', a.attname), a.attidentity = 'a'
+		from pg_catalog.pg_sequence s
+		join pg_catalog.pg_class c on c.oid = s.seqrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		join pg_catalog.pg_depend i on i.classid = 'pg_catalog.pg_class'::regclass and i.objid = c.oid
+			and i.refclassid = 'pg_catalog.pg_class'::regclass and i.deptype = 'i'
+		join pg_catalog.pg_class t on t.oid = i.refobjid
+		join pg_catalog.pg_namespace tn on tn.oid = t.relnamespace
+		join pg_catalog.pg_attribute a on a.attrelid = t.oid and a.attnum = i.refobjsubid
+		where `+namespaceFilter+` and t.relkind in ('r', 'p') and a.attidentity <> ''
+		and `+notExtensionMember("pg_class", "t.oid")+`
+		order by n.nspname, c.relname`, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s sequence
+		var table, column string
+		var always bool
+		if err := rows.Scan(&s.key, &s.schema, &s.name, &s.qualifiedName, &s.dataType, &s.start, &s.increment,
+			&s.min, &s.max, &s.cache, &s.cycle, &table, &column, &always); err != nil {
+			return err
+		}
+		d.write(s.key, "SEQUENCE", s.schema, s.name, s.identityStatement(table, column, always))
+	}
+
+	return rows.Err()
+}
+
+// table holds the parts of a create table statement
+type table struct {
+	key                         string
+	schema, name, qualifiedName string
+	unlogged                    bool
+	partitionKey                string
+	inherits                    string
+	elements                    []string
+}
+
+func (d *schemaDumper) dumpTables() error {
+	var tables []*table
+	tablesByOid := map[int64]*table{}
+
+	// partitions are attached by dumpPartitions, rather than inheriting
+	rows, err := d.tx.QueryContext(d.ctx, `select c.oid, `+objectKey("pg_class", "c.oid")+`, n.nspname, c.relname,
+		format('%I.%I', n.nspname, c.relname), c.relpersistence = 'u',
+		case when c.relkind = 'p' then pg_catalog.pg_get_partkeydef(c.oid) else '' end,
+		case when c.relispartition then '' else coalesce((select string_agg(format('%I.%I', pn.nspname, p.relname),
+				', ' order by i.inhseqno)
+			from pg_catalog.pg_inherits i
+			join pg_catalog.pg_class p on p.oid = i.inhparent
+			join pg_catalog.pg_namespace pn on pn.oid = p.relnamespace
+			where i.inhrelid = c.oid), '') end
+		from pg_catalog.pg_class c
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where `+namespaceFilter+` and c.relkind in ('r', 'p')
+		and `+notExtensionMember("pg_class", "c.oid")+`
+		order by n.nspname, c.relname`, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid int64
+		t := &table{}
+		if err := rows.Scan(&oid, &t.key, &t.schema, &t.name, &t.qualifiedName, &t.unlogged, &t.partitionKey,
+			&t.inherits); err != nil {
+			return err
+		}
+		tables = append(tables, t)
+		tablesByOid[oid] = t
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// columns, in table order. Inherited columns are created by the parent, and
+	// identity columns are completed by dumpIdentities.
+	rows, err = d.tx.QueryContext(d.ctx, `select a.attrelid, format('%I %s', a.attname,
+			pg_catalog.format_type(a.atttypid, a.atttypmod))
+		|| `+collateClause("a", "t")+`
+		|| case when a.attgenerated = 's' then format(' GENERATED ALWAYS AS (%s) STORED', pg_catalog.pg_get_expr(ad.adbin, ad.adrelid))
+			when ad.adbin is not null then ' DEFAULT ' || pg_catalog.pg_get_expr(ad.adbin, ad.adrelid) else '' end
+		|| case when a.attnotnull then ' NOT NULL' else '' end
+		from pg_catalog.pg_attribute a
+		join pg_catalog.pg_class c on c.oid = a.attrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		join pg_catalog.pg_type t on t.oid = a.atttypid
+		left join pg_catalog.pg_attrdef ad on ad.adrelid = a.attrelid and ad.adnum = a.attnum
+		where `+namespaceFilter+` and c.relkind in ('r', 'p') and a.attnum > 0 and not a.attisdropped
+		and (a.attislocal or c.relispartition)
+		order by a.attrelid, a.attnum`, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if err := d.scanTableElements(rows, tablesByOid); err != nil {
+		return err
+	}
+
+	// validated check constraints are created with the table
+	rows, err = d.tx.QueryContext(d.ctx, `select con.conrelid,
+		format('CONSTRAINT %I %s', con.conname, pg_catalog.pg_get_constraintdef(con.oid))
+		from pg_catalog.pg_constraint con
+		join pg_catalog.pg_class c on c.oid = con.conrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where `+namespaceFilter+` and c.relkind in ('r', 'p') and con.contype = 'c' and con.convalidated
+		and (con.conislocal or c.relispartition)
+		order by con.conrelid, con.conname`, d.schemas)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if err := d.scanTableElements(rows, tablesByOid); err != nil {
+		return err
+	}
+
+	for _, t := range tables {
+		create := "CREATE TABLE"
+		if t.unlogged {
+			create = "CREATE UNLOGGED TABLE"
+		}
+
+		stmt := fmt.Sprintf("%s %s (\n", create, t.qualifiedName)
+		if len(t.elements) > 0 {
+			stmt += "    " + strings.Join(t.elements, ",\n    ") + "\n"
+		}
+		stmt += ")"
+		if t.inherits != "" {
+			stmt += "\nINHERITS (" + t.inherits + ")"
+		}
+		if t.partitionKey != "" {
+			stmt += "\nPARTITION BY " + t.partitionKey
+		}
+
+		d.write(t.key, "TABLE", t.schema, t.name, stmt+";")
+	}
+
+	return nil
+}
+
+// scanTableElements appends column and constraint definitions to their tables
+func (d *schemaDumper) scanTableElements(rows *sql.Rows, tablesByOid map[int64]*table) error {
+	for rows.Next() {
+		var oid int64
+		var element string
+		if err := rows.Scan(&oid, &element); err != nil {
+			return err
+		}
+		if t, ok := tablesByOid[oid]; ok {
+			t.elements = append(t.elements, element)
+		}
+	}
+
+	return rows.Err()
+}
+
+func (d *schemaDumper) dumpPartitions() error {
+	return d.dumpQuery(`select '', 'TABLE ATTACH', n.nspname, c.relname,
+		format('ALTER TABLE ONLY %I.%I ATTACH PARTITION %I.%I %s;', pn.nspname, p.relname,
+			n.nspname, c.relname, pg_catalog.pg_get_expr(c.relpartbound, c.oid))
+		from pg_catalog.pg_inherits i
+		join pg_catalog.pg_class c on c.oid = i.inhrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		join pg_catalog.pg_class p on p.oid = i.inhparent
+		join pg_catalog.pg_namespace pn on pn.oid = p.relnamespace
+		where ` + namespaceFilter + ` and c.relispartition and c.relkind in ('r', 'p')
+		order by n.nspname, c.relname`)
+}
+
+func (d *schemaDumper) dumpSequenceOwners() error {
+	return d.dumpQuery(`select '', 'SEQUENCE OWNED BY', n.nspname, c.relname,
+		format('ALTER SEQUENCE %I.%I OWNED BY %I.%I.%I;', n.nspname, c.relname, tn.nspname, t.relname, a.attname)
+		from pg_catalog.pg_class c
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		join pg_catalog.pg_depend dep on dep.classid = 'pg_catalog.pg_class'::regclass
+			and dep.objid = c.oid and dep.refclassid = 'pg_catalog.pg_class'::regclass and dep.deptype = 'a'
+		join pg_catalog.pg_class t on t.oid = dep.refobjid
+		join pg_catalog.pg_namespace tn on tn.oid = t.relnamespace
+		join pg_catalog.pg_attribute a on a.attrelid = t.oid and a.attnum = dep.refobjsubid
+		where ` + namespaceFilter + ` and c.relkind = 'S'
+		order by n.nspname, c.relname`)
+}
+
+func (d *schemaDumper) dumpViews() error {
+	// views which depend on other views are moved after them by sortObjects
+	return d.dumpQuery(`select ` + objectKey("pg_class", "c.oid") + `,
+		case c.relkind when 'm' then 'MATERIALIZED VIEW' else 'VIEW' end, n.nspname, c.relname,
+		case c.relkind when 'm' then format(E'CREATE MATERIALIZED VIEW %I.%I AS\n%s\n  WITH NO DATA;',
+				n.nspname, c.relname, rtrim(pg_catalog.pg_get_viewdef(c.oid), ';'))
+			else format(E'CREATE VIEW %I.%I AS\n%s', n.nspname, c.relname, pg_catalog.pg_get_viewdef(c.oid)) end
+		from pg_catalog.pg_class c
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where ` + namespaceFilter + ` and c.relkind in ('v', 'm')
+		and ` + notExtensionMember("pg_class", "c.oid") + `
+		order by n.nspname, c.relname`)
+}
+
+// constraintsQuery selects constraints matching a condition as
+// ALTER TABLE statements
+func constraintsQuery(kind, condition string) string {
+	return `select '', '` + kind + `', n.nspname, format('%s %s', c.relname, con.conname),
+		format(E'ALTER TABLE %s%I.%I\n    ADD CONSTRAINT %I %s;',
+			case when c.relkind = 'p' then '' else 'ONLY ' end,
+			n.nspname, c.relname, con.conname, pg_catalog.pg_get_constraintdef(con.oid))
+		from pg_catalog.pg_constraint con
+		join pg_catalog.pg_class c on c.oid = con.conrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where ` + namespaceFilter + ` and c.relkind in ('r', 'p') and con.conparentid = 0
+		and (` + condition + `)
+		and ` + notExtensionMember("pg_class", "c.oid") + `
+		order by n.nspname, c.relname, con.conname`
+}
+
+func (d *schemaDumper) dumpConstraints() error {
+	// check constraints which have not been validated can't be created with the table
+	return d.dumpQuery(constraintsQuery("CONSTRAINT",
+		"con.contype in ('p', 'u', 'x') or con.contype = 'c' and not con.convalidated and con.conislocal"))
+}
+
+func (d *schemaDumper) dumpIndexes() error {
+	// indexes on partitioned tables are created on each partition, so the
+	// partitions' own indexes are skipped
+	return d.dumpQuery(`select ` + objectKey("pg_class", "i.oid") + `, 'INDEX', n.nspname, i.relname,
+		replace(pg_catalog.pg_get_indexdef(i.oid), ' ON ONLY ', ' ON ') || ';'
+		from pg_catalog.pg_index x
+		join pg_catalog.pg_class i on i.oid = x.indexrelid
+		join pg_catalog.pg_class c on c.oid = x.indrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where ` + namespaceFilter + ` and c.relkind in ('r', 'p', 'm')
+		and ` + notExtensionMember("pg_class", "c.oid") + `
+		and not exists (select 1 from pg_catalog.pg_constraint con
+			where con.conindid = i.oid and con.contype in ('p', 'u', 'x'))
+		and not exists (select 1 from pg_catalog.pg_inherits inh where inh.inhrelid = i.oid)
+		order by n.nspname, i.relname`)
+}
+
+func (d *schemaDumper) dumpTriggers() error {
+	// triggers on partitioned tables are cloned to each partition, so the
+	// clones are skipped
+	return d.dumpQuery(`select ` + objectKey("pg_trigger", "t.oid") + `, 'TRIGGER', n.nspname,
+		format('%s %s', c.relname, t.tgname),
+		pg_catalog.pg_get_triggerdef(t.oid) || ';'
+		from pg_catalog.pg_trigger t
+		join pg_catalog.pg_class c on c.oid = t.tgrelid
+		join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+		where ` + namespaceFilter + ` and not t.tgisinternal
+		and ` + notExtensionMember("pg_class", "c.oid") + `
+		and not (c.relispartition and exists (select 1 from pg_catalog.pg_inherits inh
+			join pg_catalog.pg_trigger pt on pt.tgrelid = inh.inhparent and pt.tgname = t.tgname
+			where inh.inhrelid = c.oid))
+		order by n.nspname, c.relname, t.tgname`)
+}
+
+func (d *schemaDumper) dumpForeignKeys() error {
+	// foreign keys come last, since they may reference any unique index
+	return d.dumpQuery(constraintsQuery("FK CONSTRAINT", "con.contype = 'f'"))
+}
+
+func (d *schemaDumper) dumpComments() error {
+	return d.dumpQuery(`select '', 'COMMENT', schema, kind || ' ' || name, format('COMMENT ON %s %s IS %L;', kind, target, description)
+		from (
+			select 1 as ord, 'SCHEMA' as kind, '-' as schema, n.nspname as name,
+				format('%I', n.nspname) as target, d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_namespace n on n.oid = d.objoid
+			where d.classoid = 'pg_catalog.pg_namespace'::regclass
+			and ` + namespaceFilter + ` and n.nspname <> 'public'
+			and ` + notExtensionMember("pg_namespace", "n.oid") + `
+			union all
+			select 2, 'EXTENSION', '-', x.extname, format('%I', x.extname), d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_extension x on x.oid = d.objoid
+			join pg_catalog.pg_namespace n on n.oid = x.extnamespace
+			where d.classoid = 'pg_catalog.pg_extension'::regclass
+			and ` + namespaceFilter + ` and x.extname <> 'plpgsql'
+			union all
+			select 3, case t.typtype when 'd' then 'DOMAIN' else 'TYPE' end, n.nspname, t.typname,
+				format('%I.%I', n.nspname, t.typname), d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_type t on t.oid = d.objoid
+			join pg_catalog.pg_namespace n on n.oid = t.typnamespace
+			where d.classoid = 'pg_catalog.pg_type'::regclass
+			and ` + namespaceFilter + ` and t.typtype in ('c', 'd', 'e')
+			and ` + notExtensionMember("pg_type", "t.oid") + `
+			union all
+			select 4, case p.prokind when 'p' then 'PROCEDURE' else 'FUNCTION' end, n.nspname,
+				format('%s(%s)', p.proname, pg_catalog.pg_get_function_identity_arguments(p.oid)),
+				format('%I.%I(%s)', n.nspname, p.proname, pg_catalog.pg_get_function_identity_arguments(p.oid)),
+				d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_proc p on p.oid = d.objoid
+			join pg_catalog.pg_namespace n on n.oid = p.pronamespace
+			where d.classoid = 'pg_catalog.pg_proc'::regclass
+			and ` + namespaceFilter + ` and p.prokind in ('f', 'p')
+			and ` + notExtensionMember("pg_proc", "p.oid") + `
+			union all
+			select 5, case c.relkind when 'v' then 'VIEW' when 'm' then 'MATERIALIZED VIEW'
+					when 'S' then 'SEQUENCE' when 'i' then 'INDEX' when 'I' then 'INDEX' else 'TABLE' end,
+				n.nspname, c.relname, format('%I.%I', n.nspname, c.relname), d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_class c on c.oid = d.objoid
+			join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+			where d.classoid = 'pg_catalog.pg_class'::regclass and d.objsubid = 0
+			and ` + namespaceFilter + ` and c.relkind in ('r', 'p', 'v', 'm', 'S', 'i', 'I')
+			and ` + notExtensionMember("pg_class", "c.oid") + `
+			union all
+			select 6, 'COLUMN', n.nspname, format('%s.%s', c.relname, a.attname),
+				format('%I.%I.%I', n.nspname, c.relname, a.attname), d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_class c on c.oid = d.objoid
+			join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+			join pg_catalog.pg_attribute a on a.attrelid = c.oid and a.attnum = d.objsubid
+			where d.classoid = 'pg_catalog.pg_class'::regclass and d.objsubid > 0
+			and ` + namespaceFilter + ` and c.relkind in ('r', 'p', 'v', 'm', 'c')
+			and ` + notExtensionMember("pg_class", "c.oid") + `
+			union all
+			select 7, 'CONSTRAINT', n.nspname, format('%s %s', coalesce(c.relname, t.typname), con.conname),
+				case when con.conrelid <> 0 then format('%I ON %I.%I', con.conname, n.nspname, c.relname)
+					else format('%I ON DOMAIN %I.%I', con.conname, n.nspname, t.typname) end,
+				d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_constraint con on con.oid = d.objoid
+			join pg_catalog.pg_namespace n on n.oid = con.connamespace
+			left join pg_catalog.pg_class c on c.oid = con.conrelid
+			left join pg_catalog.pg_type t on t.oid = con.contypid
+			where d.classoid = 'pg_catalog.pg_constraint'::regclass
+			and ` + namespaceFilter + `
+			union all
+			select 8, 'TRIGGER', n.nspname, format('%s %s', c.relname, tg.tgname),
+				format('%I ON %I.%I', tg.tgname, n.nspname, c.relname), d.description
+			from pg_catalog.pg_description d
+			join pg_catalog.pg_trigger tg on tg.oid = d.objoid
+			join pg_catalog.pg_class c on c.oid = tg.tgrelid
+			join pg_catalog.pg_namespace n on n.oid = c.relnamespace
+			where d.classoid = 'pg_catalog.pg_trigger'::regclass
+			and ` + namespaceFilter + `
+			and ` + notExtensionMember("pg_class", "c.oid") + `
+		) comments
+		order by ord, schema, name`)
+}
@@ -0,0 +1,185 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// schemaDump builds the same output as `sqlite3 <path> .schema --nosys` from
+// sqlite_master, so schema files are stable whichever way they were written
+func (drv *Driver) schemaDump(ctx context.Context, db *sql.DB) ([]byte, error) {
+	rows, err := db.QueryContext(ctx, "select type, name, sql from sqlite_master "+
+		"where sql is not null and name not like 'sqlite_%' order by rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type object struct {
+		kind, name, sql string
+	}
+	var objects []object
+	for rows.Next() {
+		var obj object
+		if err := rows.Scan(&obj.kind, &obj.name, &obj.sql); err != nil {
+			return nil, err
+		}
+		// the lock table only exists while a migration is running
+		if obj.name == drv.lockTableName() {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		stmt := obj.sql
+
+		// the sqlite3 shell lists the columns of views and virtual tables
+		if obj.kind == "view" || strings.HasPrefix(stmt, "CREATE VIRTUAL TABLE ") {
+			columns, err := drv.fakeSchema(ctx, db, obj.name)
+			if err != nil {
+				return nil, err
+			}
+			if columns != "" {
+				stmt = fmt.Sprintf("%s\n/* %s */", stmt, columns)
+			}
+		}
+
+		// a trailing line comment would swallow the terminating semicolon
+		tail := ";\n"
+		if endsInLineComment(stmt) {
+			tail = "\n;\n"
+		}
+
+		// tables with quoted names are written as "create if not exists",
+		// matching the sqlite3 shell
+		if strings.HasPrefix(stmt, `CREATE TABLE "`) || strings.HasPrefix(stmt, "CREATE TABLE '") {
+			stmt = "CREATE TABLE IF NOT EXISTS " + strings.TrimPrefix(stmt, "CREATE TABLE ")
+		}
+
+		buf.WriteString(stmt)
+		buf.WriteString(tail)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fakeSchema returns a description of a view or virtual table and its
+// columns, e.g. `v(a,"b c")`
+func (drv *Driver) fakeSchema(ctx context.Context, db *sql.DB, name string) (string, error) {
+	rows, err := db.QueryContext(ctx, "select name from pragma_table_info(?)", name)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column sql.NullString
+		if err := rows.Scan(&column); err != nil {
+			return "", err
+		}
+		columns = append(columns, shellQuote(column.String))
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if len(columns) == 0 {
+		return "", nil
+	}
+
+	return shellQuote(name) + "(" + strings.Join(columns, ",") + ")", nil
+}
+
+// shellQuote quotes an identifier the way the sqlite3 shell does, only when
+// it is not a plain identifier
+func shellQuote(name string) string {
+	plain := name != "" && !sqliteKeywords[strings.ToUpper(name)]
+	for i, ch := range name {
+		if ch == '_' || ch < 0x80 && (ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z') ||
+			i > 0 && ch >= '0' && ch <= '9' {
+			continue
+		}
+		plain = false
+		break
+	}
+	if plain {
+		return name
+	}
+
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// endsInLineComment reports whether a statement ends inside a -- comment
+func endsInLineComment(stmt string) bool {
+	var quote rune
+	lineComment, blockComment := false, false
+
+	runes := []rune(stmt)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		switch {
+		case lineComment:
+			lineComment = ch != '\n'
+		case blockComment:
+			if ch == '*' && next == '/' {
+				blockComment = false
+				i++
+			}
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '-' && next == '-':
+			lineComment = true
+			i++
+		case ch == '/' && next == '*':
+			blockComment = true
+			i++
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '[':
+			quote = ']'
+		}
+	}
+
+	return lineComment
+}
+
+// sqliteKeywords must be quoted when used as identifiers
+// (see https://www.sqlite.org/lang_keywords.html)
+var sqliteKeywords = map[string]bool{}
+
+func init() {
+	for _, keyword := range strings.Fields(`
+		ABORT ACTION ADD AFTER ALL ALTER ALWAYS ANALYZE AND AS ASC ATTACH
+		AUTOINCREMENT BEFORE BEGIN BETWEEN BY CASCADE CASE CAST CHECK COLLATE
+		COLUMN COMMIT CONFLICT CONSTRAINT CREATE CROSS CURRENT CURRENT_DATE
+		CURRENT_TIME CURRENT_TIMESTAMP DATABASE DEFAULT DEFERRABLE DEFERRED
+		DELETE DESC DETACH DISTINCT DO DROP EACH ELSE END ESCAPE EXCEPT EXCLUDE
+		EXCLUSIVE EXISTS EXPLAIN FAIL FILTER FIRST FOLLOWING FOR FOREIGN FROM
+		FULL GENERATED GLOB GROUP GROUPS HAVING IF IGNORE IMMEDIATE IN INDEX
+		INDEXED INITIALLY INNER INSERT INSTEAD INTERSECT INTO IS ISNULL JOIN KEY
+		LAST LEFT LIKE LIMIT MATCH MATERIALIZED NATURAL NO NOT NOTHING NOTNULL
+		NULL NULLS OF OFFSET ON OR ORDER OTHERS OUTER OVER PARTITION PLAN PRAGMA
+		PRECEDING PRIMARY QUERY RAISE RANGE RECURSIVE REFERENCES REGEXP REINDEX
+		RELEASE RENAME REPLACE RESTRICT RETURNING RIGHT ROLLBACK ROW ROWS
+		SAVEPOINT SELECT SET TABLE TEMP TEMPORARY THEN TIES TO TRANSACTION
+		TRIGGER UNBOUNDED UNION UNIQUE UPDATE USING VACUUM VALUES VIEW VIRTUAL
+		WHEN WHERE WINDOW WITH WITHOUT`) {
+		sqliteKeywords[keyword] = true
+	}
+}
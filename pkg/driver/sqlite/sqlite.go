@@ -1,10 +1,8 @@
-//go:build cgo
-// +build cgo
-
 package sqlite
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
@@ -12,12 +10,12 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
 
 	"github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3" // database/sql driver
 )
 
 func init() {
@@ -29,6 +27,7 @@ func init() {
 type Driver struct {
 	migrationsTableName string
 	databaseURL         *url.URL
+	connection          *sql.DB
 	log                 io.Writer
 }
 
@@ -37,6 +36,7 @@ func NewDriver(config dbmate.DriverConfig) dbmate.Driver {
 	return &Driver{
 		migrationsTableName: config.MigrationsTableName,
 		databaseURL:         config.DatabaseURL,
+		connection:          config.Connection,
 		log:                 config.Log,
 	}
 }
@@ -70,30 +70,40 @@ func ConnectionString(u *url.URL) string {
 	return str
 }
 
-// Open creates a new database connection
+// Open creates a new database connection, or returns the existing connection
+// the driver was configured with
 func (drv *Driver) Open() (*sql.DB, error) {
-	return sql.Open("sqlite3", ConnectionString(drv.databaseURL))
+	if drv.connection != nil {
+		return drv.connection, nil
+	}
+
+	return sql.Open(sqlDriverName, ConnectionString(drv.databaseURL))
 }
 
 // CreateDatabase creates the specified database
 func (drv *Driver) CreateDatabase() error {
-	fmt.Fprintf(drv.log, "Creating: %s\n", ConnectionString(drv.databaseURL))
+	return drv.CreateDatabaseContext(context.Background())
+}
 
-	db, err := drv.Open()
-	if err != nil {
-		return err
-	}
-	defer dbutil.MustClose(db)
+// CreateDatabaseContext is like CreateDatabase, but aborts when the context is done
+func (drv *Driver) CreateDatabaseContext(ctx context.Context) error {
+	fmt.Fprintf(drv.log, "Creating: %s\n", ConnectionString(drv.databaseURL))
 
-	return db.Ping()
+	// connecting to the database creates it
+	return drv.PingContext(ctx)
 }
 
 // DropDatabase drops the specified database (if it exists)
 func (drv *Driver) DropDatabase() error {
+	return drv.DropDatabaseContext(context.Background())
+}
+
+// DropDatabaseContext is like DropDatabase, but aborts when the context is done
+func (drv *Driver) DropDatabaseContext(ctx context.Context) error {
 	path := ConnectionString(drv.databaseURL)
 	fmt.Fprintf(drv.log, "Dropping: %s\n", path)
 
-	exists, err := drv.DatabaseExists()
+	exists, err := drv.DatabaseExistsContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -104,11 +114,11 @@ func (drv *Driver) DropDatabase() error {
 	return os.Remove(path)
 }
 
-func (drv *Driver) schemaMigrationsDump(db *sql.DB) ([]byte, error) {
+func (drv *Driver) schemaMigrationsDump(ctx context.Context, db *sql.DB) ([]byte, error) {
 	migrationsTable := drv.quotedMigrationsTableName()
 
 	// load applied migrations
-	migrations, err := dbutil.QueryColumn(db,
+	migrations, err := dbutil.QueryColumnContext(ctx, db,
 		fmt.Sprintf("select quote(version) from %s order by version asc", migrationsTable))
 	if err != nil {
 		return nil, err
@@ -130,13 +140,17 @@ func (drv *Driver) schemaMigrationsDump(db *sql.DB) ([]byte, error) {
 
 // DumpSchema returns the current database schema
 func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
-	path := ConnectionString(drv.databaseURL)
-	schema, err := dbutil.RunCommand("sqlite3", path, ".schema --nosys")
+	return drv.DumpSchemaContext(context.Background(), db)
+}
+
+// DumpSchemaContext is like DumpSchema, but aborts when the context is done
+func (drv *Driver) DumpSchemaContext(ctx context.Context, db *sql.DB) ([]byte, error) {
+	schema, err := drv.schemaDump(ctx, db)
 	if err != nil {
 		return nil, err
 	}
 
-	migrations, err := drv.schemaMigrationsDump(db)
+	migrations, err := drv.schemaMigrationsDump(ctx, db)
 	if err != nil {
 		return nil, err
 	}
@@ -147,6 +161,11 @@ func (drv *Driver) DumpSchema(db *sql.DB) ([]byte, error) {
 
 // DatabaseExists determines whether the database exists
 func (drv *Driver) DatabaseExists() (bool, error) {
+	return drv.DatabaseExistsContext(context.Background())
+}
+
+// DatabaseExistsContext is like DatabaseExists, but aborts when the context is done
+func (drv *Driver) DatabaseExistsContext(ctx context.Context) (bool, error) {
 	_, err := os.Stat(ConnectionString(drv.databaseURL))
 	if os.IsNotExist(err) {
 		return false, nil
@@ -160,8 +179,13 @@ func (drv *Driver) DatabaseExists() (bool, error) {
 
 // MigrationsTableExists checks if the schema_migrations table exists
 func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
+	return drv.MigrationsTableExistsContext(context.Background(), db)
+}
+
+// MigrationsTableExistsContext is like MigrationsTableExists, but aborts when the context is done
+func (drv *Driver) MigrationsTableExistsContext(ctx context.Context, db *sql.DB) (bool, error) {
 	exists := false
-	err := db.QueryRow("SELECT 1 FROM sqlite_master "+
+	err := db.QueryRowContext(ctx, "SELECT 1 FROM sqlite_master "+
 		"WHERE type='table' AND name=$1",
 		drv.migrationsTableName).
 		Scan(&exists)
@@ -174,21 +198,83 @@ func (drv *Driver) MigrationsTableExists(db *sql.DB) (bool, error) {
 
 // CreateMigrationsTable creates the schema migrations table
 func (drv *Driver) CreateMigrationsTable(db *sql.DB) error {
-	_, err := db.Exec(fmt.Sprintf(
+	return drv.CreateMigrationsTableContext(context.Background(), db)
+}
+
+// CreateMigrationsTableContext is like CreateMigrationsTable, but aborts when the context is done
+func (drv *Driver) CreateMigrationsTableContext(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
 		"create table if not exists %s (version varchar(128) primary key)",
 		drv.quotedMigrationsTableName()))
+	if err != nil {
+		return err
+	}
 
-	return err
+	return drv.upgradeMigrationsTable(ctx, db)
+}
+
+// migrationsTableColumns lists the columns recorded alongside each version,
+// which are added to existing migrations tables if they are missing
+var migrationsTableColumns = []struct {
+	name       string
+	definition string
+}{
+	{"applied_at", "datetime"},
+	{"duration_ms", "integer"},
+	{"checksum", "varchar(64)"},
+	{"dbmate_version", "varchar(32)"},
+}
+
+// migrationsTableColumnNames returns the names of the existing migrations table columns
+func (drv *Driver) migrationsTableColumnNames(ctx context.Context, db dbutil.Transaction) (map[string]bool, error) {
+	columns, err := dbutil.QueryColumnContext(ctx, db, "select name from pragma_table_info(?)", drv.migrationsTableName)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+	for _, column := range columns {
+		existing[strings.ToLower(column)] = true
+	}
+
+	return existing, nil
+}
+
+// upgradeMigrationsTable adds any missing columns to the migrations table
+func (drv *Driver) upgradeMigrationsTable(ctx context.Context, db *sql.DB) error {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range migrationsTableColumns {
+		if existing[column.name] {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf("alter table %s add column %s %s",
+			drv.quotedMigrationsTableName(), column.name, column.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // SelectMigrations returns a list of applied migrations
 // with an optional limit (in descending order)
 func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, error) {
+	return drv.SelectMigrationsContext(context.Background(), db, limit)
+}
+
+// SelectMigrationsContext is like SelectMigrations, but aborts when the context is done
+func (drv *Driver) SelectMigrationsContext(ctx context.Context, db *sql.DB, limit int) (map[string]bool, error) {
 	query := fmt.Sprintf("select version from %s order by version desc", drv.quotedMigrationsTableName())
 	if limit >= 0 {
 		query = fmt.Sprintf("%s limit %d", query, limit)
 	}
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -212,35 +298,223 @@ func (drv *Driver) SelectMigrations(db *sql.DB, limit int) (map[string]bool, err
 	return migrations, nil
 }
 
+// SelectMigrationRecords returns the recorded details of all applied migrations
+func (drv *Driver) SelectMigrationRecords(db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	return drv.SelectMigrationRecordsContext(context.Background(), db)
+}
+
+// SelectMigrationRecordsContext is like SelectMigrationRecords, but aborts when the context is done
+func (drv *Driver) SelectMigrationRecordsContext(ctx context.Context, db *sql.DB) (map[string]dbmate.MigrationRecord, error) {
+	existing, err := drv.migrationsTableColumnNames(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// migrations tables which have not been upgraded yet only record versions
+	upgraded := true
+	for _, column := range migrationsTableColumns {
+		upgraded = upgraded && existing[column.name]
+	}
+
+	query := "select version"
+	if upgraded {
+		query += ", applied_at, duration_ms, checksum, dbmate_version"
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("%s from %s order by version asc", query, drv.quotedMigrationsTableName()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer dbutil.MustClose(rows)
+
+	migrations := map[string]dbmate.MigrationRecord{}
+	for rows.Next() {
+		var version string
+		var appliedAt sql.NullTime
+		var durationMs sql.NullInt64
+		var checksum, dbmateVersion sql.NullString
+
+		dest := []interface{}{&version}
+		if upgraded {
+			dest = append(dest, &appliedAt, &durationMs, &checksum, &dbmateVersion)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		migrations[version] = dbmate.MigrationRecord{
+			Version:       version,
+			AppliedAt:     appliedAt.Time,
+			Duration:      time.Duration(durationMs.Int64) * time.Millisecond,
+			Checksum:      checksum.String,
+			DbmateVersion: dbmateVersion.String,
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
 // InsertMigration adds a new migration record
 func (drv *Driver) InsertMigration(db dbutil.Transaction, version string) error {
-	_, err := db.Exec(
-		fmt.Sprintf("insert into %s (version) values (?)", drv.quotedMigrationsTableName()),
-		version)
+	return drv.InsertMigrationContext(context.Background(), db, version)
+}
+
+// InsertMigrationContext is like InsertMigration, but aborts when the context is done
+func (drv *Driver) InsertMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	return drv.InsertMigrationRecordContext(ctx, db, dbmate.MigrationRecord{
+		Version:       version,
+		AppliedAt:     time.Now().UTC(),
+		DbmateVersion: dbmate.Version,
+	})
+}
+
+// InsertMigrationRecord adds a new migration record, including its details
+func (drv *Driver) InsertMigrationRecord(db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	return drv.InsertMigrationRecordContext(context.Background(), db, record)
+}
+
+// InsertMigrationRecordContext is like InsertMigrationRecord, but aborts when the context is done
+func (drv *Driver) InsertMigrationRecordContext(ctx context.Context, db dbutil.Transaction, record dbmate.MigrationRecord) error {
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("insert into %s (version, applied_at, duration_ms, checksum, dbmate_version) "+
+			"values (?, ?, ?, ?, ?)", drv.quotedMigrationsTableName()),
+		record.Version, dbutil.NullTime(record.AppliedAt), record.Duration.Milliseconds(),
+		dbutil.NullString(record.Checksum), dbutil.NullString(record.DbmateVersion))
 
 	return err
 }
 
 // DeleteMigration removes a migration record
 func (drv *Driver) DeleteMigration(db dbutil.Transaction, version string) error {
-	_, err := db.Exec(
+	return drv.DeleteMigrationContext(context.Background(), db, version)
+}
+
+// DeleteMigrationContext is like DeleteMigration, but aborts when the context is done
+func (drv *Driver) DeleteMigrationContext(ctx context.Context, db dbutil.Transaction, version string) error {
+	_, err := db.ExecContext(ctx,
 		fmt.Sprintf("delete from %s where version = ?", drv.quotedMigrationsTableName()),
 		version)
 
 	return err
 }
 
+// UpdateMigrationChecksum replaces the recorded checksum of an applied migration
+func (drv *Driver) UpdateMigrationChecksum(db dbutil.Transaction, version string, checksum string) error {
+	return drv.UpdateMigrationChecksumContext(context.Background(), db, version, checksum)
+}
+
+// UpdateMigrationChecksumContext is like UpdateMigrationChecksum, but aborts when the context is done
+func (drv *Driver) UpdateMigrationChecksumContext(ctx context.Context, db dbutil.Transaction, version string, checksum string) error {
+	_, err := db.ExecContext(ctx,
+		fmt.Sprintf("update %s set checksum = ? where version = ?", drv.quotedMigrationsTableName()),
+		checksum, version)
+
+	return err
+}
+
+// lockPollInterval specifies how often to retry acquiring the migration lock
+const lockPollInterval = 100 * time.Millisecond
+
+// Lock acquires the migration lock by creating a lock table alongside the
+// migrations table, and waits while another process holds it. The lock table
+// is dropped when the lock is released.
+func (drv *Driver) Lock(ctx context.Context, db *sql.DB) (func() error, error) {
+	lockTable := drv.quoteIdentifier(drv.lockTableName())
+
+	for {
+		acquired, err := drv.tryLock(ctx, db, lockTable)
+		if err == nil && acquired {
+			break
+		}
+		if err != nil && !isBusyError(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, drv.lockHeldError(ctx.Err(), db, lockTable)
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	return func() error {
+		_, err := db.ExecContext(context.Background(), fmt.Sprintf("drop table if exists %s", lockTable))
+		return err
+	}, nil
+}
+
+// lockTableName returns the name of the table which holds the migration lock
+func (drv *Driver) lockTableName() string {
+	return drv.migrationsTableName + "_lock"
+}
+
+// lockHeldError adds the lock table to an error returned while waiting for the
+// lock, since a lock left behind by a process which was killed must be
+// released by hand
+func (drv *Driver) lockHeldError(err error, db *sql.DB, lockTable string) error {
+	acquiredAt, _ := dbutil.QueryValue(db, fmt.Sprintf("select acquired_at from %s", lockTable))
+	if acquiredAt != "" {
+		err = fmt.Errorf("%w: lock acquired at %s", err, acquiredAt)
+	}
+
+	return fmt.Errorf("%w: if no other dbmate process is running, drop the %s table to release the lock",
+		err, lockTable)
+}
+
+// tryLock claims the lock table, returning false if it is already claimed
+func (drv *Driver) tryLock(ctx context.Context, db *sql.DB, lockTable string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("create table if not exists %s "+
+		"(id integer primary key, acquired_at datetime)", lockTable))
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("insert or ignore into %s (id, acquired_at) values (1, ?)", lockTable),
+		time.Now().UTC())
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	return claimed == 1, tx.Commit()
+}
+
 // Ping verifies a connection to the database. Due to the way SQLite works, by
 // testing whether the database is valid, it will automatically create the database
 // if it does not already exist.
 func (drv *Driver) Ping() error {
+	return drv.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but aborts when the context is done
+func (drv *Driver) PingContext(ctx context.Context) error {
+	if drv.connection != nil {
+		return drv.connection.PingContext(ctx)
+	}
+
 	db, err := drv.Open()
 	if err != nil {
 		return err
 	}
 	defer dbutil.MustClose(db)
 
-	return db.Ping()
+	return db.PingContext(ctx)
 }
 
 // Return a normalized version of the driver-specific error type.
@@ -0,0 +1,23 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlDriverName is the database/sql driver used to open connections
+const sqlDriverName = "sqlite3"
+
+// isBusyError reports whether the database was locked by another connection
+func isBusyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	return false
+}
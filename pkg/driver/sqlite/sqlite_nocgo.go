@@ -0,0 +1,27 @@
+//go:build !cgo
+// +build !cgo
+
+package sqlite
+
+import (
+	"errors"
+
+	moderncsqlite "modernc.org/sqlite"
+	sqlite3lib "modernc.org/sqlite/lib"
+)
+
+// sqlDriverName is the database/sql driver used to open connections. Without
+// cgo, this is a pure Go translation of SQLite.
+const sqlDriverName = "sqlite"
+
+// isBusyError reports whether the database was locked by another connection
+func isBusyError(err error) bool {
+	var sqliteErr *moderncsqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// mask extended result codes such as SQLITE_BUSY_SNAPSHOT
+		code := sqliteErr.Code() & 0xff
+		return code == sqlite3lib.SQLITE_BUSY || code == sqlite3lib.SQLITE_LOCKED
+	}
+
+	return false
+}
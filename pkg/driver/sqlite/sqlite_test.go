@@ -1,12 +1,12 @@
-//go:build cgo
-// +build cgo
-
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"os"
+	"os/exec"
 	"testing"
+	"time"
 
 	"github.com/amacneil/dbmate/v2/pkg/dbmate"
 	"github.com/amacneil/dbmate/v2/pkg/dbutil"
@@ -197,12 +197,41 @@ func TestSQLiteDumpSchema(t *testing.T) {
 	// sqlite_* tables should not be present in the dump (.schema --nosys)
 	require.NotContains(t, string(schema), "sqlite_")
 
-	// DumpSchema should return error if command fails
-	drv.databaseURL = dbutil.MustParseURL(".")
+	// DumpSchema should return error if the query fails
+	dbutil.MustClose(db)
 	schema, err = drv.DumpSchema(db)
 	require.Nil(t, schema)
-	require.Error(t, err)
-	require.EqualError(t, err, "Error: unable to open database \"/.\": unable to open database file")
+	require.EqualError(t, err, "sql: database is closed")
+}
+
+func TestSQLiteDumpSchemaMatchesCLI(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 command not found")
+	}
+
+	drv := testSQLiteDriver(t)
+	db := prepTestSQLiteDB(t)
+	defer dbutil.MustClose(db)
+
+	_, err := db.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, "first name" text -- comment
+	);
+	CREATE INDEX users_name ON users ("first name");
+	CREATE TABLE "quoted table" (a int);
+	CREATE TABLE [bracketed] (a int);
+	CREATE VIEW user_names AS SELECT id, "first name", 1 + 1 AS "select" FROM users;
+	CREATE TRIGGER users_insert AFTER INSERT ON users BEGIN SELECT 1; END;
+	CREATE VIEW trailing_comment AS SELECT 1 AS a -- comment
+	;
+	CREATE INDEX users_positive ON users (id) WHERE id > 0 -- comment`)
+	require.NoError(t, err)
+
+	// native dump should match the sqlite3 shell
+	expected, err := dbutil.RunCommand("sqlite3", ConnectionString(drv.databaseURL), ".schema --nosys")
+	require.NoError(t, err)
+
+	schema, err := drv.schemaDump(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(schema))
 }
 
 func TestSQLiteDatabaseExists(t *testing.T) {
@@ -279,6 +308,36 @@ func TestSQLiteCreateMigrationsTable(t *testing.T) {
 	})
 }
 
+func TestSQLiteUpgradeMigrationsTable(t *testing.T) {
+	drv := testSQLiteDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestSQLiteDB(t)
+	defer dbutil.MustClose(db)
+
+	// create migrations table in the original format
+	_, err := db.Exec("create table test_migrations (version varchar(128) primary key)")
+	require.NoError(t, err)
+	_, err = db.Exec("insert into test_migrations (version) values ('abc1')")
+	require.NoError(t, err)
+
+	// create table should add missing columns
+	err = drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	// existing records are preserved without details
+	var appliedAt, checksum sql.NullString
+	err = db.QueryRow("select applied_at, checksum from test_migrations where version = 'abc1'").
+		Scan(&appliedAt, &checksum)
+	require.NoError(t, err)
+	require.False(t, appliedAt.Valid)
+	require.False(t, checksum.Valid)
+
+	// upgrade should be idempotent
+	err = drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+}
+
 func TestSQLiteSelectMigrations(t *testing.T) {
 	drv := testSQLiteDriver(t)
 	drv.migrationsTableName = "test_migrations"
@@ -330,6 +389,69 @@ func TestSQLiteInsertMigration(t *testing.T) {
 		Scan(&count)
 	require.NoError(t, err)
 	require.Equal(t, 1, count)
+
+	// insert migration with details
+	err = drv.InsertMigrationRecord(db, dbmate.MigrationRecord{
+		Version:       "abc2",
+		AppliedAt:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:      1500 * time.Millisecond,
+		Checksum:      "d41d8cd98f00b204e9800998ecf8427e",
+		DbmateVersion: dbmate.Version,
+	})
+	require.NoError(t, err)
+
+	var durationMs int64
+	var checksum, dbmateVersion string
+	err = db.QueryRow("select duration_ms, checksum, dbmate_version from test_migrations where version = 'abc2'").
+		Scan(&durationMs, &checksum, &dbmateVersion)
+	require.NoError(t, err)
+	require.Equal(t, int64(1500), durationMs)
+	require.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", checksum)
+	require.Equal(t, dbmate.Version, dbmateVersion)
+}
+
+func TestSQLiteSelectMigrationRecords(t *testing.T) {
+	drv := testSQLiteDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestSQLiteDB(t)
+	defer dbutil.MustClose(db)
+
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into test_migrations (version, checksum)
+		values ('abc1', 'sum1'), ('abc2', null)`)
+	require.NoError(t, err)
+
+	records, err := drv.SelectMigrationRecords(db)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "sum1", records["abc1"].Checksum)
+	require.Equal(t, "", records["abc2"].Checksum)
+}
+
+func TestSQLiteUpdateMigrationChecksum(t *testing.T) {
+	drv := testSQLiteDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestSQLiteDB(t)
+	defer dbutil.MustClose(db)
+
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into test_migrations (version, checksum)
+		values ('abc1', 'sum1'), ('abc2', 'sum2')`)
+	require.NoError(t, err)
+
+	err = drv.UpdateMigrationChecksum(db, "abc1", "new1")
+	require.NoError(t, err)
+
+	records, err := drv.SelectMigrationRecords(db)
+	require.NoError(t, err)
+	require.Equal(t, "new1", records["abc1"].Checksum)
+	require.Equal(t, "sum2", records["abc2"].Checksum)
 }
 
 func TestSQLiteDeleteMigration(t *testing.T) {
@@ -355,6 +477,47 @@ func TestSQLiteDeleteMigration(t *testing.T) {
 	require.Equal(t, 1, count)
 }
 
+func TestSQLiteLock(t *testing.T) {
+	drv := testSQLiteDriver(t)
+	drv.migrationsTableName = "test_migrations"
+
+	db := prepTestSQLiteDB(t)
+	defer dbutil.MustClose(db)
+	err := drv.CreateMigrationsTable(db)
+	require.NoError(t, err)
+
+	unlock, err := drv.Lock(context.Background(), db)
+	require.NoError(t, err)
+
+	// lock is exclusive
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = drv.Lock(ctx, db)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "lock acquired at ")
+	require.ErrorContains(t, err, `drop the "test_migrations_lock" table to release the lock`)
+
+	// lock table is not included in the schema dump
+	schema, err := drv.DumpSchema(db)
+	require.NoError(t, err)
+	require.NotContains(t, string(schema), "test_migrations_lock")
+
+	err = unlock()
+	require.NoError(t, err)
+
+	// lock can be acquired again once released
+	unlock, err = drv.Lock(context.Background(), db)
+	require.NoError(t, err)
+	err = unlock()
+	require.NoError(t, err)
+
+	// lock table is dropped when released
+	var count int
+	err = db.QueryRow("select count(*) from sqlite_master where name = 'test_migrations_lock'").Scan(&count)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
+
 func TestSQLitePing(t *testing.T) {
 	drv := testSQLiteDriver(t)
 	path := ConnectionString(drv.databaseURL)
@@ -383,9 +546,9 @@ func TestSQLitePing(t *testing.T) {
 		require.NoError(t, err)
 	}()
 
-	// ping database should fail
+	// ping database should fail, with a message which depends on the driver
 	err = drv.Ping()
-	require.EqualError(t, err, "unable to open database file: is a directory")
+	require.ErrorContains(t, err, "unable to open database file")
 }
 
 func TestSQLiteQuotedMigrationsTableName(t *testing.T) {